@@ -5,6 +5,7 @@ import (
 	"imagepp/internal/config"
 	"imagepp/internal/db"
 	"imagepp/internal/handler"
+	custommiddleware "imagepp/internal/middleware"
 	"imagepp/internal/scheduler"
 	"imagepp/pkg/logger"
 	"net/http"
@@ -53,6 +54,11 @@ func main() {
 
 	router := handler.NewRouter(logg, cfg, dbpool, rdb, schedulerClient)
 
+	// Purge expired idempotency keys in the background
+	purgeCtx, stopPurge := context.WithCancel(ctx)
+	defer stopPurge()
+	go custommiddleware.PurgeExpiredIdempotencyKeys(purgeCtx, logg, db.New(dbpool), cfg.IdempotencyPurgeInterval)
+
 	server := &http.Server{
 		Addr:           ":" + cfg.AppPort,
 		Handler:        router,
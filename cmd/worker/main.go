@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"os"
 	"os/signal"
@@ -10,7 +11,9 @@ import (
 
 	"imagepp/internal/config"
 	"imagepp/internal/db"
+	"imagepp/internal/events"
 	jobs "imagepp/internal/jobs"
+	"imagepp/internal/scheduler"
 	workers "imagepp/internal/workers"
 	"imagepp/pkg/logger"
 
@@ -34,7 +37,11 @@ func main() {
 	dbpool := db.Get()
 	logg.Info().Msg("database pool initialized")
 
+	workers.DB = dbpool
 	workers.Queries = db.New(dbpool)
+	workers.LogoBuckets = cfg.LogoBuckets
+	workers.OutputBuckets = cfg.OutputBuckets
+	workers.FontBuckets = cfg.FontBuckets
 
 	opt, err := redis.ParseURL(cfg.RedisUrl)
 	if err != nil {
@@ -45,7 +52,10 @@ func main() {
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
 		logg.Fatal().Err(err).Msg("redis is not reachable")
 	}
-	rdb.Close()
+	defer rdb.Close()
+
+	// Progress and status events for the API's event streams
+	workers.Events = events.NewBroker(rdb)
 
 	// Convert redis.Options to asynq.RedisClientOpt
 	redisOpt := asynq.RedisClientOpt{
@@ -66,6 +76,10 @@ func main() {
 				"low":      1,
 			},
 			RetryDelayFunc: func(n int, e error, t *asynq.Task) time.Duration {
+				// Webhook endpoints get minutes to hours to recover, not seconds
+				if t.Type() == jobs.TypeWebhookDeliver {
+					return jobs.WebhookRetryDelay(n)
+				}
 				return time.Duration(1<<uint(n)) * time.Second
 			},
 			ErrorHandler: asynq.ErrorHandlerFunc(func(ctx context.Context, task *asynq.Task, err error) {
@@ -83,6 +97,31 @@ func main() {
 		},
 	)
 
+	// The relay enqueues tasks whose immediate enqueue failed in the API,
+	// the reaper re-enqueues tasks that were lost
+	schedulerClient := scheduler.NewClient(redisOpt)
+	defer schedulerClient.Close()
+	workers.Scheduler = schedulerClient
+
+	// Periodic maintenance tasks. Every worker runs a scheduler, Unique
+	// keeps replicas from enqueueing the same run twice.
+	reaperPayload, err := json.Marshal(jobs.ReapStuckImages{
+		PendingAfter:    cfg.StuckPendingAfter,
+		ProcessingAfter: cfg.StuckProcessingAfter,
+	})
+	if err != nil {
+		logg.Fatal().Err(err).Msg("failed to encode reaper payload")
+	}
+	periodic := asynq.NewScheduler(redisOpt, &asynq.SchedulerOpts{Location: time.UTC})
+	if _, err := periodic.Register(cfg.ReaperSchedule,
+		asynq.NewTask(jobs.TypeReapStuckImages, reaperPayload),
+		asynq.Queue("low"),
+		asynq.MaxRetry(0),
+		asynq.Unique(time.Minute),
+	); err != nil {
+		logg.Fatal().Err(err).Msg("failed to register reaper task")
+	}
+
 	mux := asynq.NewServeMux()
 	mux.Use(loggingMiddleware(logg))
 
@@ -93,10 +132,20 @@ func main() {
 		return nil
 	})
 	mux.HandleFunc(jobs.TypeImageProcess, workers.HandleImagePP)
+	mux.HandleFunc(jobs.TypeReapStuckImages, workers.HandleReapStuckImages)
+	mux.HandleFunc(jobs.TypeWebhookDeliver, workers.HandleWebhookDelivery)
+	mux.HandleFunc(jobs.TypeBatchIngest, workers.HandleBatchIngest)
 
 	sigctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	go jobs.RunOutboxRelay(sigctx, logg, dbpool, schedulerClient, cfg.OutboxPollInterval)
+
+	if err := periodic.Start(); err != nil {
+		logg.Fatal().Err(err).Msg("scheduler failed to start")
+	}
+	defer periodic.Shutdown()
+
 	go func() {
 		logg.Info().Msg("worker starting")
 		if err := srv.Run(mux); err != nil {
@@ -140,6 +189,7 @@ func loggingMiddleware(logg zerolog.Logger) asynq.MiddlewareFunc {
 
 			logEvent.Msg("task started")
 
+			ctx = logger.WithContext(ctx, logg)
 			err := next.ProcessTask(ctx, task)
 			duration := time.Since(start)
 
@@ -32,6 +32,32 @@ type Config struct {
 	RedisUsername string `env:"REDIS_USERNAME"` // optional, derived from REDIS_URL if not provided
 	RedisPassword string `env:"REDIS_PASSWORD"` // optional, derived from REDIS_URL if not provided
 	RedisDB       int    `env:"REDIS_DB"`       // optional, derived from REDIS_URL if not provided
+
+	// idempotency keys on POST endpoints
+	IdempotencyTTL           time.Duration `env:"IDEMPOTENCY_TTL" envDefault:"24h"`
+	IdempotencyPurgeInterval time.Duration `env:"IDEMPOTENCY_PURGE_INTERVAL" envDefault:"1h"`
+
+	// batches: items pending or processing at once, the default and the
+	// most a batch may ask for
+	BatchMaxInFlight int32 `env:"BATCH_MAX_IN_FLIGHT" envDefault:"50"`
+
+	// buckets overlays may read logos from besides the job's own bucket,
+	// comma separated
+	LogoBuckets []string `env:"LOGO_BUCKETS"`
+	// buckets outputs may be written to besides the job's own bucket,
+	// comma separated
+	OutputBuckets []string `env:"OUTPUT_BUCKETS"`
+	// buckets fonts may be registered from, comma separated; without any,
+	// only the bundled fonts can be used
+	FontBuckets []string `env:"FONT_BUCKETS"`
+
+	// outbox relay in the worker
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL" envDefault:"2s"`
+
+	// stuck job reaper in the worker
+	ReaperSchedule       string        `env:"REAPER_SCHEDULE" envDefault:"@every 5m"`
+	StuckPendingAfter    time.Duration `env:"STUCK_PENDING_AFTER" envDefault:"15m"`
+	StuckProcessingAfter time.Duration `env:"STUCK_PROCESSING_AFTER" envDefault:"45m"`
 }
 
 var (
@@ -11,19 +11,91 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const cancelImage = `-- name: CancelImage :execrows
+UPDATE images
+SET status = 'cancelled', updated_at = $2
+WHERE id = $1 AND status IN ('queued', 'pending', 'processing')
+`
+
+type CancelImageParams struct {
+	ID        int32            `json:"id"`
+	UpdatedAt pgtype.Timestamp `json:"updated_at"`
+}
+
+func (q *Queries) CancelImage(ctx context.Context, arg CancelImageParams) (int64, error) {
+	result, err := q.db.Exec(ctx, cancelImage, arg.ID, arg.UpdatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const countBatchImagesByStatus = `-- name: CountBatchImagesByStatus :many
+SELECT status, COUNT(*)::int AS count
+FROM images
+WHERE batch_id = $1
+GROUP BY status
+`
+
+type CountBatchImagesByStatusRow struct {
+	Status pgtype.Text `json:"status"`
+	Count  int32       `json:"count"`
+}
+
+func (q *Queries) CountBatchImagesByStatus(ctx context.Context, batchID pgtype.Int4) ([]CountBatchImagesByStatusRow, error) {
+	rows, err := q.db.Query(ctx, countBatchImagesByStatus, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CountBatchImagesByStatusRow
+	for rows.Next() {
+		var i CountBatchImagesByStatusRow
+		if err := rows.Scan(&i.Status, &i.Count); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const countInFlightBatchImages = `-- name: CountInFlightBatchImages :one
+SELECT COUNT(*)::int AS count
+FROM images
+WHERE batch_id = $1 AND status IN ('pending', 'processing')
+`
+
+func (q *Queries) CountInFlightBatchImages(ctx context.Context, batchID pgtype.Int4) (int32, error) {
+	row := q.db.QueryRow(ctx, countInFlightBatchImages, batchID)
+	var count int32
+	err := row.Scan(&count)
+	return count, err
+}
+
 const createImage = `-- name: CreateImage :one
-INSERT INTO images (user_id, bucket_name, image_key, status, created_at, updated_at)
-VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING id, user_id, bucket_name, image_key, status, created_at, updated_at
+INSERT INTO images (user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, parent_image_id, revision, pipeline_version, callback_url, callback_secret, batch_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+RETURNING id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id
 `
 
 type CreateImageParams struct {
-	UserID     pgtype.Int4      `json:"user_id"`
-	BucketName string           `json:"bucket_name"`
-	ImageKey   string           `json:"image_key"`
-	Status     pgtype.Text      `json:"status"`
-	CreatedAt  pgtype.Timestamp `json:"created_at"`
-	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	UserID          pgtype.Int4      `json:"user_id"`
+	BucketName      string           `json:"bucket_name"`
+	ImageKey        string           `json:"image_key"`
+	Status          pgtype.Text      `json:"status"`
+	CreatedAt       pgtype.Timestamp `json:"created_at"`
+	UpdatedAt       pgtype.Timestamp `json:"updated_at"`
+	PresetID        pgtype.Int4      `json:"preset_id"`
+	PresetVersion   pgtype.Int4      `json:"preset_version"`
+	ParentImageID   pgtype.Int4      `json:"parent_image_id"`
+	Revision        int32            `json:"revision"`
+	PipelineVersion pgtype.Int4      `json:"pipeline_version"`
+	CallbackUrl     pgtype.Text      `json:"callback_url"`
+	CallbackSecret  pgtype.Text      `json:"callback_secret"`
+	BatchID         pgtype.Int4      `json:"batch_id"`
 }
 
 func (q *Queries) CreateImage(ctx context.Context, arg CreateImageParams) (Image, error) {
@@ -34,6 +106,14 @@ func (q *Queries) CreateImage(ctx context.Context, arg CreateImageParams) (Image
 		arg.Status,
 		arg.CreatedAt,
 		arg.UpdatedAt,
+		arg.PresetID,
+		arg.PresetVersion,
+		arg.ParentImageID,
+		arg.Revision,
+		arg.PipelineVersion,
+		arg.CallbackUrl,
+		arg.CallbackSecret,
+		arg.BatchID,
 	)
 	var i Image
 	err := row.Scan(
@@ -44,6 +124,24 @@ func (q *Queries) CreateImage(ctx context.Context, arg CreateImageParams) (Image
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.PresetID,
+		&i.PresetVersion,
+		&i.CacheKey,
+		&i.CacheHit,
+		&i.CachedFromImageID,
+		&i.FailureReason,
+		&i.ReapCount,
+		&i.CancelRequested,
+		&i.JobPayload,
+		&i.Attempt,
+		&i.ParentImageID,
+		&i.Revision,
+		&i.Operations,
+		&i.Outputs,
+		&i.PipelineVersion,
+		&i.CallbackUrl,
+		&i.CallbackSecret,
+		&i.BatchID,
 	)
 	return i, err
 }
@@ -66,8 +164,52 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 	return i, err
 }
 
+const failImage = `-- name: FailImage :execrows
+UPDATE images
+SET status = 'failed', failure_reason = $2, updated_at = $3
+WHERE id = $1 AND status IN ('pending', 'processing')
+`
+
+type FailImageParams struct {
+	ID            int32            `json:"id"`
+	FailureReason pgtype.Text      `json:"failure_reason"`
+	UpdatedAt     pgtype.Timestamp `json:"updated_at"`
+}
+
+// Only unfinished images can fail, a late failure doesn't undo a completion
+func (q *Queries) FailImage(ctx context.Context, arg FailImageParams) (int64, error) {
+	result, err := q.db.Exec(ctx, failImage, arg.ID, arg.FailureReason, arg.UpdatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const findCachedImage = `-- name: FindCachedImage :one
+SELECT id
+FROM images
+WHERE cache_key = $1 AND status = 'completed' AND id <> $2 AND user_id = $3
+ORDER BY updated_at DESC
+LIMIT 1
+`
+
+type FindCachedImageParams struct {
+	CacheKey pgtype.Text `json:"cache_key"`
+	ID       int32       `json:"id"`
+	UserID   pgtype.Int4 `json:"user_id"`
+}
+
+// Most recent completed image of the same user with the same cache key,
+// other than the one being processed
+func (q *Queries) FindCachedImage(ctx context.Context, arg FindCachedImageParams) (int32, error) {
+	row := q.db.QueryRow(ctx, findCachedImage, arg.CacheKey, arg.ID, arg.UserID)
+	var id int32
+	err := row.Scan(&id)
+	return id, err
+}
+
 const getImageByID = `-- name: GetImageByID :one
-SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at
+SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id
 FROM images
 WHERE id = $1
 `
@@ -83,12 +225,30 @@ func (q *Queries) GetImageByID(ctx context.Context, id int32) (Image, error) {
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.PresetID,
+		&i.PresetVersion,
+		&i.CacheKey,
+		&i.CacheHit,
+		&i.CachedFromImageID,
+		&i.FailureReason,
+		&i.ReapCount,
+		&i.CancelRequested,
+		&i.JobPayload,
+		&i.Attempt,
+		&i.ParentImageID,
+		&i.Revision,
+		&i.Operations,
+		&i.Outputs,
+		&i.PipelineVersion,
+		&i.CallbackUrl,
+		&i.CallbackSecret,
+		&i.BatchID,
 	)
 	return i, err
 }
 
 const getImagesByUserID = `-- name: GetImagesByUserID :many
-SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at
+SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id
 FROM images
 WHERE user_id = $1
 ORDER BY created_at DESC
@@ -111,6 +271,24 @@ func (q *Queries) GetImagesByUserID(ctx context.Context, userID pgtype.Int4) ([]
 			&i.Status,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.PresetID,
+			&i.PresetVersion,
+			&i.CacheKey,
+			&i.CacheHit,
+			&i.CachedFromImageID,
+			&i.FailureReason,
+			&i.ReapCount,
+			&i.CancelRequested,
+			&i.JobPayload,
+			&i.Attempt,
+			&i.ParentImageID,
+			&i.Revision,
+			&i.Operations,
+			&i.Outputs,
+			&i.PipelineVersion,
+			&i.CallbackUrl,
+			&i.CallbackSecret,
+			&i.BatchID,
 		); err != nil {
 			return nil, err
 		}
@@ -135,10 +313,352 @@ func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error
 	return i, err
 }
 
-const updateImageStatus = `-- name: UpdateImageStatus :exec
+const imageAlreadyProcessed = `-- name: ImageAlreadyProcessed :one
+SELECT EXISTS (
+    SELECT 1
+    FROM images
+    WHERE user_id = $1 AND bucket_name = $2 AND image_key = $3
+      AND cache_key = $4 AND status = 'completed'
+      AND EXISTS (
+          SELECT 1
+          FROM image_outputs
+          WHERE image_outputs.image_id = images.id AND image_outputs.bucket_name = $5
+      )
+) AS processed
+`
+
+type ImageAlreadyProcessedParams struct {
+	UserID            pgtype.Int4 `json:"user_id"`
+	BucketName        string      `json:"bucket_name"`
+	ImageKey          string      `json:"image_key"`
+	CacheKey          pgtype.Text `json:"cache_key"`
+	DestinationBucket string      `json:"destination_bucket"`
+}
+
+// Whether the user completed the object before with the same source and
+// pipeline and has its outputs in the destination bucket
+func (q *Queries) ImageAlreadyProcessed(ctx context.Context, arg ImageAlreadyProcessedParams) (bool, error) {
+	row := q.db.QueryRow(ctx, imageAlreadyProcessed,
+		arg.UserID,
+		arg.BucketName,
+		arg.ImageKey,
+		arg.CacheKey,
+		arg.DestinationBucket,
+	)
+	var processed bool
+	err := row.Scan(&processed)
+	return processed, err
+}
+
+const listStuckImages = `-- name: ListStuckImages :many
+SELECT id, status, reap_count, attempt, updated_at
+FROM images
+WHERE (status = 'pending' AND updated_at < $1)
+   OR (status = 'processing' AND updated_at < $2)
+ORDER BY id
+LIMIT $3
+`
+
+type ListStuckImagesParams struct {
+	PendingBefore    pgtype.Timestamp `json:"pending_before"`
+	ProcessingBefore pgtype.Timestamp `json:"processing_before"`
+	MaxImages        int32            `json:"max_images"`
+}
+
+type ListStuckImagesRow struct {
+	ID        int32            `json:"id"`
+	Status    pgtype.Text      `json:"status"`
+	ReapCount int32            `json:"reap_count"`
+	Attempt   int32            `json:"attempt"`
+	UpdatedAt pgtype.Timestamp `json:"updated_at"`
+}
+
+func (q *Queries) ListStuckImages(ctx context.Context, arg ListStuckImagesParams) ([]ListStuckImagesRow, error) {
+	rows, err := q.db.Query(ctx, listStuckImages, arg.PendingBefore, arg.ProcessingBefore, arg.MaxImages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListStuckImagesRow
+	for rows.Next() {
+		var i ListStuckImagesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Status,
+			&i.ReapCount,
+			&i.Attempt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockImageChain = `-- name: LockImageChain :one
+WITH RECURSIVE ancestors AS (
+    SELECT id, parent_image_id, 0 AS depth
+    FROM images
+    WHERE id = $1
+    UNION ALL
+    SELECT images.id, images.parent_image_id, ancestors.depth + 1
+    FROM images
+    JOIN ancestors ON images.id = ancestors.parent_image_id
+)
+SELECT images.id AS root_id
+FROM images
+WHERE images.id = (SELECT ancestors.id FROM ancestors ORDER BY ancestors.depth DESC LIMIT 1)
+FOR UPDATE
+`
+
+// Locks the first image of the revision chain an image belongs to, so that
+// revisions of one chain are numbered one at a time
+func (q *Queries) LockImageChain(ctx context.Context, id int32) (int32, error) {
+	row := q.db.QueryRow(ctx, lockImageChain, id)
+	var rootID int32
+	err := row.Scan(&rootID)
+	return rootID, err
+}
+
+const markImageCacheHit = `-- name: MarkImageCacheHit :exec
+UPDATE images
+SET cache_hit = TRUE, cached_from_image_id = $2, updated_at = $3
+WHERE id = $1
+`
+
+type MarkImageCacheHitParams struct {
+	ID                int32            `json:"id"`
+	CachedFromImageID pgtype.Int4      `json:"cached_from_image_id"`
+	UpdatedAt         pgtype.Timestamp `json:"updated_at"`
+}
+
+func (q *Queries) MarkImageCacheHit(ctx context.Context, arg MarkImageCacheHitParams) error {
+	_, err := q.db.Exec(ctx, markImageCacheHit, arg.ID, arg.CachedFromImageID, arg.UpdatedAt)
+	return err
+}
+
+const nextImageRevision = `-- name: NextImageRevision :one
+WITH RECURSIVE chain AS (
+    SELECT id, revision
+    FROM images
+    WHERE id = $1
+    UNION ALL
+    SELECT images.id, images.revision
+    FROM images
+    JOIN chain ON images.parent_image_id = chain.id
+)
+SELECT (COALESCE(MAX(revision), 0) + 1)::integer AS revision
+FROM chain
+`
+
+// One past the highest revision in the chain starting at an image
+func (q *Queries) NextImageRevision(ctx context.Context, id int32) (int32, error) {
+	row := q.db.QueryRow(ctx, nextImageRevision, id)
+	var revision int32
+	err := row.Scan(&revision)
+	return revision, err
+}
+
+const recordAttemptFailure = `-- name: RecordAttemptFailure :execrows
+UPDATE images
+SET failure_reason = $2, updated_at = $3
+WHERE id = $1 AND status IN ('pending', 'processing')
+`
+
+type RecordAttemptFailureParams struct {
+	ID            int32            `json:"id"`
+	FailureReason pgtype.Text      `json:"failure_reason"`
+	UpdatedAt     pgtype.Timestamp `json:"updated_at"`
+}
+
+// A failed attempt asynq will retry: the image stays in flight, only the
+// reason is kept until the next attempt starts
+func (q *Queries) RecordAttemptFailure(ctx context.Context, arg RecordAttemptFailureParams) (int64, error) {
+	result, err := q.db.Exec(ctx, recordAttemptFailure, arg.ID, arg.FailureReason, arg.UpdatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const releaseQueuedBatchImages = `-- name: ReleaseQueuedBatchImages :many
+UPDATE images
+SET status = 'pending', updated_at = $1
+WHERE id IN (
+    SELECT id
+    FROM images
+    WHERE batch_id = $2 AND status = 'queued'
+    ORDER BY id
+    LIMIT $3
+) AND status = 'queued'
+RETURNING id, attempt, job_payload
+`
+
+type ReleaseQueuedBatchImagesParams struct {
+	UpdatedAt pgtype.Timestamp `json:"updated_at"`
+	BatchID   pgtype.Int4      `json:"batch_id"`
+	MaxImages int32            `json:"max_images"`
+}
+
+type ReleaseQueuedBatchImagesRow struct {
+	ID         int32  `json:"id"`
+	Attempt    int32  `json:"attempt"`
+	JobPayload []byte `json:"job_payload"`
+}
+
+// Moves the next queued items of a batch to pending, their tasks are
+// created by the caller in the same transaction
+func (q *Queries) ReleaseQueuedBatchImages(ctx context.Context, arg ReleaseQueuedBatchImagesParams) ([]ReleaseQueuedBatchImagesRow, error) {
+	rows, err := q.db.Query(ctx, releaseQueuedBatchImages, arg.UpdatedAt, arg.BatchID, arg.MaxImages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ReleaseQueuedBatchImagesRow
+	for rows.Next() {
+		var i ReleaseQueuedBatchImagesRow
+		if err := rows.Scan(&i.ID, &i.Attempt, &i.JobPayload); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const requestImageCancel = `-- name: RequestImageCancel :one
+UPDATE images
+SET cancel_requested = TRUE, updated_at = $2
+WHERE id = $1 AND status IN ('queued', 'pending', 'processing')
+RETURNING status
+`
+
+type RequestImageCancelParams struct {
+	ID        int32            `json:"id"`
+	UpdatedAt pgtype.Timestamp `json:"updated_at"`
+}
+
+func (q *Queries) RequestImageCancel(ctx context.Context, arg RequestImageCancelParams) (pgtype.Text, error) {
+	row := q.db.QueryRow(ctx, requestImageCancel, arg.ID, arg.UpdatedAt)
+	var status pgtype.Text
+	err := row.Scan(&status)
+	return status, err
+}
+
+const requeueStuckImage = `-- name: RequeueStuckImage :exec
+UPDATE images
+SET status = 'pending', reap_count = reap_count + 1, updated_at = $2
+WHERE id = $1
+`
+
+type RequeueStuckImageParams struct {
+	ID        int32            `json:"id"`
+	UpdatedAt pgtype.Timestamp `json:"updated_at"`
+}
+
+func (q *Queries) RequeueStuckImage(ctx context.Context, arg RequeueStuckImageParams) error {
+	_, err := q.db.Exec(ctx, requeueStuckImage, arg.ID, arg.UpdatedAt)
+	return err
+}
+
+const retryImage = `-- name: RetryImage :one
+UPDATE images
+SET status = 'pending',
+    attempt = attempt + 1,
+    cancel_requested = FALSE,
+    failure_reason = NULL,
+    reap_count = 0,
+    cache_hit = FALSE,
+    cached_from_image_id = NULL,
+    pipeline_version = $2,
+    updated_at = $3
+WHERE id = $1 AND status IN ('failed', 'cancelled')
+RETURNING id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id
+`
+
+type RetryImageParams struct {
+	ID              int32            `json:"id"`
+	PipelineVersion pgtype.Int4      `json:"pipeline_version"`
+	UpdatedAt       pgtype.Timestamp `json:"updated_at"`
+}
+
+// Starts a new attempt of a failed or cancelled image with its stored payload
+func (q *Queries) RetryImage(ctx context.Context, arg RetryImageParams) (Image, error) {
+	row := q.db.QueryRow(ctx, retryImage, arg.ID, arg.PipelineVersion, arg.UpdatedAt)
+	var i Image
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.BucketName,
+		&i.ImageKey,
+		&i.Status,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.PresetID,
+		&i.PresetVersion,
+		&i.CacheKey,
+		&i.CacheHit,
+		&i.CachedFromImageID,
+		&i.FailureReason,
+		&i.ReapCount,
+		&i.CancelRequested,
+		&i.JobPayload,
+		&i.Attempt,
+		&i.ParentImageID,
+		&i.Revision,
+		&i.Operations,
+		&i.Outputs,
+		&i.PipelineVersion,
+		&i.CallbackUrl,
+		&i.CallbackSecret,
+		&i.BatchID,
+	)
+	return i, err
+}
+
+const setImageCacheKey = `-- name: SetImageCacheKey :exec
+UPDATE images
+SET cache_key = $2, updated_at = $3
+WHERE id = $1
+`
+
+type SetImageCacheKeyParams struct {
+	ID        int32            `json:"id"`
+	CacheKey  pgtype.Text      `json:"cache_key"`
+	UpdatedAt pgtype.Timestamp `json:"updated_at"`
+}
+
+func (q *Queries) SetImageCacheKey(ctx context.Context, arg SetImageCacheKeyParams) error {
+	_, err := q.db.Exec(ctx, setImageCacheKey, arg.ID, arg.CacheKey, arg.UpdatedAt)
+	return err
+}
+
+const setImageJobPayload = `-- name: SetImageJobPayload :exec
+UPDATE images
+SET job_payload = $2
+WHERE id = $1
+`
+
+type SetImageJobPayloadParams struct {
+	ID         int32  `json:"id"`
+	JobPayload []byte `json:"job_payload"`
+}
+
+func (q *Queries) SetImageJobPayload(ctx context.Context, arg SetImageJobPayloadParams) error {
+	_, err := q.db.Exec(ctx, setImageJobPayload, arg.ID, arg.JobPayload)
+	return err
+}
+
+const updateImageStatus = `-- name: UpdateImageStatus :execrows
 UPDATE images 
-SET status = $1, updated_at = $2
-WHERE id = $3
+SET status = $1, updated_at = $2, failure_reason = NULL
+WHERE id = $3 AND status IN ('pending', 'processing')
 `
 
 type UpdateImageStatusParams struct {
@@ -147,7 +667,12 @@ type UpdateImageStatusParams struct {
 	ID        int32            `json:"id"`
 }
 
-func (q *Queries) UpdateImageStatus(ctx context.Context, arg UpdateImageStatusParams) error {
-	_, err := q.db.Exec(ctx, updateImageStatus, arg.Status, arg.UpdatedAt, arg.ID)
-	return err
+// Only unfinished images move on, a worker finishing late doesn't undo a
+// cancellation or a failure
+func (q *Queries) UpdateImageStatus(ctx context.Context, arg UpdateImageStatusParams) (int64, error) {
+	result, err := q.db.Exec(ctx, updateImageStatus, arg.Status, arg.UpdatedAt, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
 }
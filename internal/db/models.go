@@ -8,14 +8,116 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
-type Image struct {
+type Batch struct {
+	ID             int32            `json:"id"`
+	UserID         int32            `json:"user_id"`
+	Status         string           `json:"status"`
+	TotalItems     int32            `json:"total_items"`
+	MaxInFlight    int32            `json:"max_in_flight"`
+	CallbackUrl    pgtype.Text      `json:"callback_url"`
+	CallbackSecret pgtype.Text      `json:"callback_secret"`
+	CreatedAt      pgtype.Timestamp `json:"created_at"`
+	UpdatedAt      pgtype.Timestamp `json:"updated_at"`
+	CompletedAt    pgtype.Timestamp `json:"completed_at"`
+	SourcePrefix   pgtype.Text      `json:"source_prefix"`
+	ListAfter      pgtype.Text      `json:"list_after"`
+	SkippedItems   int32            `json:"skipped_items"`
+	Truncated      bool             `json:"truncated"`
+	ListingError   pgtype.Text      `json:"listing_error"`
+}
+
+type Font struct {
 	ID         int32            `json:"id"`
-	UserID     pgtype.Int4      `json:"user_id"`
+	UserID     int32            `json:"user_id"`
+	Name       string           `json:"name"`
 	BucketName string           `json:"bucket_name"`
-	ImageKey   string           `json:"image_key"`
-	Status     pgtype.Text      `json:"status"`
+	FontKey    string           `json:"font_key"`
+	Etag       string           `json:"etag"`
+	CreatedAt  pgtype.Timestamp `json:"created_at"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+}
+
+type IdempotencyKey struct {
+	Scope        string           `json:"scope"`
+	Key          string           `json:"key"`
+	RequestHash  string           `json:"request_hash"`
+	StatusCode   pgtype.Int4      `json:"status_code"`
+	ResponseBody []byte           `json:"response_body"`
+	CreatedAt    pgtype.Timestamp `json:"created_at"`
+	ExpiresAt    pgtype.Timestamp `json:"expires_at"`
+}
+
+type Image struct {
+	ID                int32            `json:"id"`
+	UserID            pgtype.Int4      `json:"user_id"`
+	BucketName        string           `json:"bucket_name"`
+	ImageKey          string           `json:"image_key"`
+	Status            pgtype.Text      `json:"status"`
+	CreatedAt         pgtype.Timestamp `json:"created_at"`
+	UpdatedAt         pgtype.Timestamp `json:"updated_at"`
+	PresetID          pgtype.Int4      `json:"preset_id"`
+	PresetVersion     pgtype.Int4      `json:"preset_version"`
+	CacheKey          pgtype.Text      `json:"cache_key"`
+	CacheHit          bool             `json:"cache_hit"`
+	CachedFromImageID pgtype.Int4      `json:"cached_from_image_id"`
+	FailureReason     pgtype.Text      `json:"failure_reason"`
+	ReapCount         int32            `json:"reap_count"`
+	CancelRequested   bool             `json:"cancel_requested"`
+	JobPayload        []byte           `json:"job_payload"`
+	Attempt           int32            `json:"attempt"`
+	ParentImageID     pgtype.Int4      `json:"parent_image_id"`
+	Revision          int32            `json:"revision"`
+	Operations        []byte           `json:"operations"`
+	Outputs           []byte           `json:"outputs"`
+	PipelineVersion   pgtype.Int4      `json:"pipeline_version"`
+	CallbackUrl       pgtype.Text      `json:"callback_url"`
+	CallbackSecret    pgtype.Text      `json:"callback_secret"`
+	BatchID           pgtype.Int4      `json:"batch_id"`
+}
+
+type ImageOutput struct {
+	ID          int32            `json:"id"`
+	ImageID     int32            `json:"image_id"`
+	Variant     string           `json:"variant"`
+	BucketName  string           `json:"bucket_name"`
+	OutputKey   string           `json:"output_key"`
+	Format      string           `json:"format"`
+	Width       int32            `json:"width"`
+	Height      int32            `json:"height"`
+	SizeBytes   int64            `json:"size_bytes"`
+	CreatedAt   pgtype.Timestamp `json:"created_at"`
+	ContentHash string           `json:"content_hash"`
+}
+
+type JobOutbox struct {
+	ID            int64            `json:"id"`
+	TaskType      string           `json:"task_type"`
+	TaskID        string           `json:"task_id"`
+	Queue         string           `json:"queue"`
+	Payload       []byte           `json:"payload"`
+	Attempts      int32            `json:"attempts"`
+	LastError     pgtype.Text      `json:"last_error"`
+	NextAttemptAt pgtype.Timestamp `json:"next_attempt_at"`
+	CreatedAt     pgtype.Timestamp `json:"created_at"`
+	DispatchedAt  pgtype.Timestamp `json:"dispatched_at"`
+}
+
+type Preset struct {
+	ID         int32            `json:"id"`
+	UserID     int32            `json:"user_id"`
+	Name       string           `json:"name"`
+	Version    int32            `json:"version"`
+	Operations []byte           `json:"operations"`
 	CreatedAt  pgtype.Timestamp `json:"created_at"`
 	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	DeletedAt  pgtype.Timestamp `json:"deleted_at"`
+}
+
+type PresetVersion struct {
+	PresetID   int32            `json:"preset_id"`
+	Version    int32            `json:"version"`
+	Operations []byte           `json:"operations"`
+	CreatedAt  pgtype.Timestamp `json:"created_at"`
 }
 
 type User struct {
@@ -23,3 +125,30 @@ type User struct {
 	Email     string           `json:"email"`
 	CreatedAt pgtype.Timestamp `json:"created_at"`
 }
+
+type Webhook struct {
+	ID        int32            `json:"id"`
+	UserID    int32            `json:"user_id"`
+	Url       string           `json:"url"`
+	Secret    string           `json:"secret"`
+	CreatedAt pgtype.Timestamp `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64            `json:"id"`
+	UserID         int32            `json:"user_id"`
+	ImageID        pgtype.Int4      `json:"image_id"`
+	Source         string           `json:"source"`
+	WebhookID      pgtype.Int4      `json:"webhook_id"`
+	Event          string           `json:"event"`
+	Url            string           `json:"url"`
+	Payload        []byte           `json:"payload"`
+	Status         string           `json:"status"`
+	Attempts       int32            `json:"attempts"`
+	ResponseStatus pgtype.Int4      `json:"response_status"`
+	LastError      pgtype.Text      `json:"last_error"`
+	RedeliveryOf   pgtype.Int8      `json:"redelivery_of"`
+	CreatedAt      pgtype.Timestamp `json:"created_at"`
+	DeliveredAt    pgtype.Timestamp `json:"delivered_at"`
+	BatchID        pgtype.Int4      `json:"batch_id"`
+}
@@ -0,0 +1,136 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Event types
+const (
+	// TypeStatus is sent on every status transition of an image
+	TypeStatus = "status"
+	// TypeProgress is sent after every step of the pipeline
+	TypeProgress = "progress"
+	// TypeRetry is sent when an attempt failed and asynq will run it again
+	TypeRetry = "retry"
+)
+
+// progressTTL bounds how long the latest progress of an abandoned job is kept
+const progressTTL = time.Hour
+
+// Event is one message on the event stream of an image
+type Event struct {
+	Type          string    `json:"type"`
+	ImageID       int64     `json:"image_id"`
+	Status        string    `json:"status,omitempty"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	Step          string    `json:"step,omitempty"` // decode, operation or output
+	Operation     string    `json:"operation,omitempty"`
+	Output        string    `json:"output,omitempty"`
+	Completed     int       `json:"completed,omitempty"`
+	Total         int       `json:"total,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// Terminal reports whether an image status is final. Attempts that asynq
+// retries leave the image processing, failed is only set on the last one.
+func Terminal(status string) bool {
+	switch status {
+	case "completed", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+// Broker publishes image events over Redis pub/sub, so the API can stream
+// what the workers do
+type Broker struct {
+	rdb *redis.Client
+}
+
+// NewBroker creates a broker on an open Redis client
+func NewBroker(rdb *redis.Client) *Broker {
+	return &Broker{rdb: rdb}
+}
+
+func channel(imageID int64) string {
+	return fmt.Sprintf("image:%d:events", imageID)
+}
+
+func progressKey(imageID int64) string {
+	return fmt.Sprintf("image:%d:progress", imageID)
+}
+
+// Publish sends an event to the subscribers of its image. The latest
+// progress event is kept for clients that connect mid-job, and dropped once
+// the image reaches a final status.
+func (b *Broker) Publish(ctx context.Context, e Event) error {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	pipe := b.rdb.Pipeline()
+	switch {
+	case e.Type == TypeProgress:
+		pipe.Set(ctx, progressKey(e.ImageID), msg, progressTTL)
+	case e.Type == TypeStatus && Terminal(e.Status):
+		pipe.Del(ctx, progressKey(e.ImageID))
+	}
+	pipe.Publish(ctx, channel(e.ImageID), msg)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// LastProgress returns the latest progress event of an image, or nil when
+// none is kept
+func (b *Broker) LastProgress(ctx context.Context, imageID int64) (*Event, error) {
+	msg, err := b.rdb.Get(ctx, progressKey(imageID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e Event
+	if err := json.Unmarshal(msg, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Subscribe starts receiving the events of an image. It returns once the
+// subscription is active, events published after that aren't missed.
+func (b *Broker) Subscribe(ctx context.Context, imageID int64) (*Subscription, error) {
+	sub := b.rdb.Subscribe(ctx, channel(imageID))
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return &Subscription{sub: sub, ch: sub.Channel()}, nil
+}
+
+// Subscription is a stream of the events of one image
+type Subscription struct {
+	sub *redis.PubSub
+	ch  <-chan *redis.Message
+}
+
+// Events returns the raw JSON of every event, the channel is closed with
+// the subscription
+func (s *Subscription) Events() <-chan *redis.Message {
+	return s.ch
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() error {
+	return s.sub.Close()
+}
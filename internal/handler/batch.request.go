@@ -0,0 +1,523 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imagepp/internal/db"
+	Job "imagepp/internal/jobs"
+	"imagepp/internal/scheduler"
+	"imagepp/pkg/helpers"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultIngestMaxObjects bounds the items a prefix batch lists when
+	// it doesn't set max_objects
+	defaultIngestMaxObjects = 10000
+)
+
+type BatchHandler struct {
+	log         zerolog.Logger
+	dbpool      *pgxpool.Pool
+	queries     *db.Queries
+	scheduler   *scheduler.Client
+	maxInFlight int32
+	logoBuckets []string
+	outBuckets  []string
+}
+
+// NewBatchHandler creates a batch handler. maxInFlight is the default and
+// the largest max_in_flight a batch may ask for.
+func NewBatchHandler(log zerolog.Logger, dbpool *pgxpool.Pool, queries *db.Queries, scheduler *scheduler.Client, maxInFlight int32, logoBuckets, outBuckets []string) *BatchHandler {
+	return &BatchHandler{
+		log:         log,
+		dbpool:      dbpool,
+		queries:     queries,
+		scheduler:   scheduler,
+		maxInFlight: maxInFlight,
+		logoBuckets: logoBuckets,
+		outBuckets:  outBuckets,
+	}
+}
+
+// CreateBatchRequest runs one pipeline over many source keys of a bucket,
+// given as items or listed from a prefix. The pipeline fields are those of
+// ProcessImageRequest; every key becomes an image of its own.
+type CreateBatchRequest struct {
+	Email        string       `json:"email" validate:"required,email"`
+	BucketName   string       `json:"bucket_name" validate:"required"`
+	Operations   []Operation  `json:"operations" validate:"required_without_all=Outputs Preset,excluded_with=Preset,omitempty,min=1,dive"`
+	Metadata     string       `json:"metadata,omitempty" validate:"omitempty,oneof=strip keep icc_copyright strip_gps"`
+	ColorProfile string       `json:"color_profile,omitempty" validate:"omitempty,oneof=srgb display-p3 adobe-rgb"`
+	Outputs      []Output     `json:"outputs,omitempty" validate:"omitempty,max=20,unique=Name,dive"`
+	Destination  *Destination `json:"destination,omitempty"`
+	SkipCache    bool         `json:"skip_cache,omitempty"`
+
+	Preset    string                    `json:"preset,omitempty" validate:"omitempty,max=100"`
+	Overrides map[string]map[string]any `json:"overrides,omitempty" validate:"excluded_without=Preset"`
+
+	Items  []BatchItem   `json:"items,omitempty" validate:"required_without=Source,excluded_with=Source,omitempty,min=1,max=1000,dive"`
+	Source *PrefixSource `json:"source,omitempty"`
+
+	// MaxInFlight bounds the items pending or processing at once, the
+	// rest wait in status queued
+	MaxInFlight int32 `json:"max_in_flight,omitempty" validate:"omitempty,min=1"`
+
+	// CallbackURL is POSTed the batch.completed event once every item is
+	// finished. Items don't call it, webhooks still hear about each image.
+	CallbackURL    string `json:"callback_url,omitempty" validate:"omitempty,http_url,max=2048"`
+	CallbackSecret string `json:"callback_secret,omitempty" validate:"required_with=CallbackURL,excluded_without=CallbackURL,omitempty,min=16,max=256"`
+}
+
+// BatchItem is one source key of a batch. Overrides patch the params of the
+// shared operations by type, for this item only.
+type BatchItem struct {
+	ImageKey  string                    `json:"image_key" validate:"required,max=1024"`
+	Overrides map[string]map[string]any `json:"overrides,omitempty"`
+}
+
+// PrefixSource lists the items of a batch from the objects under a prefix.
+// Objects that were processed before with the same pipeline are skipped
+// unless skip_cache is set.
+type PrefixSource struct {
+	Prefix        string     `json:"prefix" validate:"required,max=1024"`
+	Extensions    []string   `json:"extensions,omitempty" validate:"omitempty,max=20,dive,min=1,max=10,alphanum"`
+	MinSize       int64      `json:"min_size,omitempty" validate:"omitempty,min=0"`
+	MaxSize       int64      `json:"max_size,omitempty" validate:"omitempty,gtefield=MinSize"`
+	ModifiedSince *time.Time `json:"modified_since,omitempty"`
+	MaxObjects    int32      `json:"max_objects,omitempty" validate:"omitempty,min=1,max=100000"`
+}
+
+// pipeline returns the image request shared by every item
+func (req CreateBatchRequest) pipeline() ProcessImageRequest {
+	return ProcessImageRequest{
+		Email:        req.Email,
+		BucketName:   req.BucketName,
+		Operations:   req.Operations,
+		Metadata:     req.Metadata,
+		ColorProfile: req.ColorProfile,
+		Outputs:      req.Outputs,
+		Destination:  req.Destination,
+		SkipCache:    req.SkipCache,
+		Preset:       req.Preset,
+		Overrides:    req.Overrides,
+	}
+}
+
+type BatchItemResponse struct {
+	ImageID  int64  `json:"image_id"`
+	ImageKey string `json:"image_key"`
+}
+
+// BatchResponse describes a batch. Counts has the number of items in each
+// status; items are queued until the batch releases them.
+type BatchResponse struct {
+	BatchID     int64               `json:"batch_id"`
+	Status      string              `json:"status"`
+	TotalItems  int32               `json:"total_items"`
+	MaxInFlight int32               `json:"max_in_flight"`
+	Counts      map[string]int32    `json:"counts"`
+	Items       []BatchItemResponse `json:"items,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+	CompletedAt *time.Time          `json:"completed_at,omitempty"`
+
+	// Prefix batches are "listing" until every object was looked at
+	SourcePrefix string `json:"source_prefix,omitempty"`
+	SkippedItems int32  `json:"skipped_items,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+	ListingError string `json:"listing_error,omitempty"`
+}
+
+// batchItemStatuses are always listed in Counts, zero or not
+var batchItemStatuses = []string{"queued", "pending", "processing", "completed", "failed", "cancelled"}
+
+func batchResponse(b db.Batch, counts map[string]int32) BatchResponse {
+	resp := BatchResponse{
+		BatchID:     int64(b.ID),
+		Status:      b.Status,
+		TotalItems:  b.TotalItems,
+		MaxInFlight: b.MaxInFlight,
+		Counts:      make(map[string]int32, len(batchItemStatuses)),
+		CreatedAt:   b.CreatedAt.Time,
+
+		SourcePrefix: b.SourcePrefix.String,
+		SkippedItems: b.SkippedItems,
+		Truncated:    b.Truncated,
+		ListingError: b.ListingError.String,
+	}
+	for _, status := range batchItemStatuses {
+		resp.Counts[status] = counts[status]
+	}
+	if b.CompletedAt.Valid {
+		resp.CompletedAt = &b.CompletedAt.Time
+	}
+	return resp
+}
+
+// itemRequests builds the image request of every item, per-item overrides
+// applied to the shared operations
+func itemRequests(shared ProcessImageRequest, items []BatchItem) ([]ProcessImageRequest, error) {
+	reqs := make([]ProcessImageRequest, len(items))
+	for i, item := range items {
+		req := shared
+		req.ImageKey = item.ImageKey
+		if len(item.Overrides) > 0 {
+			ops, err := applyOverrides(shared.Operations, item.Overrides)
+			if err != nil {
+				return nil, fmt.Errorf("items[%d]: %w", i, err)
+			}
+			req.Operations = ops
+			if err := validateOperations(fmt.Sprintf("items[%d].operations", i), ops); err != nil {
+				return nil, err
+			}
+		}
+		reqs[i] = req
+	}
+	return reqs, nil
+}
+
+// validateBatchDestination keeps items of a batch from writing to the same
+// keys, unless the batch has a single item
+func validateBatchDestination(req ProcessImageRequest, single bool) error {
+	if single || req.Destination == nil || req.Destination.KeyTemplate == "" {
+		return nil
+	}
+	tmpl := req.Destination.KeyTemplate
+	for _, unique := range []string{"{image_id}", "{orig_basename}", "{hash}"} {
+		if strings.Contains(tmpl, unique) {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination.key_template: must contain {image_id}, {orig_basename} or {hash} in a batch")
+}
+
+// CreateBatch creates an image for every item and queues the first
+// max_in_flight of them; workers release the rest as items finish
+func (h *BatchHandler) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req CreateBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		h.log.Error().Err(err).Msg("Validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	maxInFlight := h.maxInFlight
+	if req.MaxInFlight > 0 {
+		if req.MaxInFlight > h.maxInFlight {
+			helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: max_in_flight can be at most "+strconv.Itoa(int(h.maxInFlight)))
+			return
+		}
+		maxInFlight = req.MaxInFlight
+	}
+
+	shared := req.pipeline()
+	var preset *db.Preset
+	if shared.Preset != "" {
+		var err error
+		preset, err = resolvePreset(ctx, h.queries, &shared)
+		if err != nil {
+			if errors.Is(err, errUnknownPreset) || errors.Is(err, errInvalidOverride) {
+				helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+				return
+			}
+			h.log.Error().Err(err).Str("preset", shared.Preset).Msg("Failed to resolve preset")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+
+	if err := validateRequestOperations(shared); err != nil {
+		h.log.Error().Err(err).Msg("Operation validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateDestination(shared, h.outBuckets); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateBatchDestination(shared, req.Source == nil && len(req.Items) == 1); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateCallbackURL(ctx, "callback_url", req.CallbackURL); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	items, err := itemRequests(shared, req.Items)
+	if err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	// Only items with overrides can differ from the shared operations
+	lists := requestOperationLists(shared)
+	for i, item := range items {
+		if len(req.Items[i].Overrides) > 0 {
+			lists = append(lists, item.Operations)
+		}
+	}
+	if err := validateLogoBuckets(shared.BucketName, h.logoBuckets, lists...); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateFonts(ctx, h.queries, lists...); err != nil {
+		if errors.Is(err, errUnknownFont) {
+			helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+			return
+		}
+		h.log.Error().Err(err).Msg("Database error checking fonts")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	user, err := getOrCreateUser(ctx, h.log, h.queries, req.Email)
+	if err != nil {
+		h.log.Error().Err(err).Str("email", req.Email).Msg("Failed to get or create user")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	var presetID, presetVersion pgtype.Int4
+	if preset != nil {
+		presetID = pgtype.Int4{Int32: preset.ID, Valid: true}
+		presetVersion = pgtype.Int4{Int32: preset.Version, Valid: true}
+	}
+
+	if req.Source != nil {
+		h.createPrefixBatch(ctx, w, user.ID, req, buildJob(shared, 0, user.ID), maxInFlight, preset)
+		return
+	}
+
+	batch, images, entries, err := h.createBatch(ctx, user.ID, req, items, maxInFlight, presetID, presetVersion)
+	if err != nil {
+		h.log.Error().Err(err).Int32("user_id", user.ID).Msg("Failed to create batch")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create batch")
+		return
+	}
+	h.log.Info().
+		Int32("batch_id", batch.ID).
+		Int32("user_id", user.ID).
+		Int("items", len(images)).
+		Int32("max_in_flight", maxInFlight).
+		Msg("Batch created")
+
+	for _, entry := range entries {
+		if err := Job.DispatchOutboxEntry(ctx, h.queries, h.scheduler, entry); err != nil {
+			h.log.Warn().Err(err).Int32("batch_id", batch.ID).Msg("Failed to enqueue batch item, leaving it to the outbox relay")
+		}
+	}
+
+	queued := int32(len(images) - len(entries))
+	resp := batchResponse(batch, map[string]int32{"pending": int32(len(entries)), "queued": queued})
+	for _, image := range images {
+		resp.Items = append(resp.Items, BatchItemResponse{ImageID: int64(image.ID), ImageKey: image.ImageKey})
+	}
+	helpers.RespondWithJSON(w, http.StatusAccepted, resp)
+}
+
+// createBatch writes the batch and its images in one transaction. The first
+// maxInFlight images are pending with a task in the outbox, the others are
+// queued with their job stored for the worker to release.
+func (h *BatchHandler) createBatch(ctx context.Context, userID int32, req CreateBatchRequest, items []ProcessImageRequest, maxInFlight int32, presetID, presetVersion pgtype.Int4) (db.Batch, []db.Image, []db.JobOutbox, error) {
+	var batch db.Batch
+	images := make([]db.Image, 0, len(items))
+	var entries []db.JobOutbox
+	err := pgx.BeginFunc(ctx, h.dbpool, func(tx pgx.Tx) error {
+		qtx := h.queries.WithTx(tx)
+		now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+		var err error
+		batch, err = qtx.CreateBatch(ctx, db.CreateBatchParams{
+			UserID:         userID,
+			Status:         "processing",
+			TotalItems:     int32(len(items)),
+			MaxInFlight:    maxInFlight,
+			CallbackUrl:    pgtype.Text{String: req.CallbackURL, Valid: req.CallbackURL != ""},
+			CallbackSecret: pgtype.Text{String: req.CallbackSecret, Valid: req.CallbackSecret != ""},
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create batch: %w", err)
+		}
+
+		for i, item := range items {
+			release := int32(i) < maxInFlight
+			status := "queued"
+			if release {
+				status = "pending"
+			}
+			params := db.CreateImageParams{
+				UserID:        pgtype.Int4{Int32: userID, Valid: true},
+				BucketName:    item.BucketName,
+				ImageKey:      item.ImageKey,
+				Status:        pgtype.Text{String: status, Valid: true},
+				CreatedAt:     now,
+				UpdatedAt:     now,
+				PresetID:      presetID,
+				PresetVersion: presetVersion,
+				Revision:      1,
+				BatchID:       pgtype.Int4{Int32: batch.ID, Valid: true},
+
+				PipelineVersion: pgtype.Int4{Int32: Job.PipelineVersion, Valid: true},
+			}
+			image, err := qtx.CreateImage(ctx, params)
+			if err != nil {
+				return fmt.Errorf("failed to create image record: %w", err)
+			}
+			images = append(images, image)
+
+			job := buildJob(item, image.ID, userID)
+			var payload []byte
+			if release {
+				entry, err := Job.CreateImageOutboxEntry(ctx, qtx, job, image.Attempt)
+				if err != nil {
+					return fmt.Errorf("failed to create outbox entry: %w", err)
+				}
+				entries = append(entries, entry)
+				payload = entry.Payload
+			} else if payload, err = json.Marshal(job); err != nil {
+				return fmt.Errorf("failed to encode job: %w", err)
+			}
+			if err := qtx.SetImageJobPayload(ctx, db.SetImageJobPayloadParams{
+				ID:         image.ID,
+				JobPayload: payload,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return batch, images, entries, err
+}
+
+// createPrefixBatch creates a batch in status listing with the coordinator
+// task that lists its items
+func (h *BatchHandler) createPrefixBatch(ctx context.Context, w http.ResponseWriter, userID int32, req CreateBatchRequest, job Job.Job, maxInFlight int32, preset *db.Preset) {
+	ingest := Job.BatchIngest{
+		Prefix:        req.Source.Prefix,
+		Extensions:    Job.DefaultIngestExtensions,
+		MinSize:       req.Source.MinSize,
+		MaxSize:       req.Source.MaxSize,
+		ModifiedSince: req.Source.ModifiedSince,
+		MaxObjects:    req.Source.MaxObjects,
+		Job:           job,
+	}
+	if len(req.Source.Extensions) > 0 {
+		ingest.Extensions = make([]string, len(req.Source.Extensions))
+		for i, ext := range req.Source.Extensions {
+			ingest.Extensions[i] = strings.ToLower(ext)
+		}
+	}
+	if ingest.MaxObjects == 0 {
+		ingest.MaxObjects = defaultIngestMaxObjects
+	}
+	if preset != nil {
+		ingest.PresetID = preset.ID
+		ingest.PresetVersion = preset.Version
+	}
+
+	var batch db.Batch
+	var entry db.JobOutbox
+	err := pgx.BeginFunc(ctx, h.dbpool, func(tx pgx.Tx) error {
+		qtx := h.queries.WithTx(tx)
+		now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+		var err error
+		batch, err = qtx.CreateBatch(ctx, db.CreateBatchParams{
+			UserID:         userID,
+			Status:         "listing",
+			MaxInFlight:    maxInFlight,
+			CallbackUrl:    pgtype.Text{String: req.CallbackURL, Valid: req.CallbackURL != ""},
+			CallbackSecret: pgtype.Text{String: req.CallbackSecret, Valid: req.CallbackSecret != ""},
+			CreatedAt:      now,
+			UpdatedAt:      now,
+			SourcePrefix:   pgtype.Text{String: req.Source.Prefix, Valid: true},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create batch: %w", err)
+		}
+		ingest.BatchID = int64(batch.ID)
+		entry, err = Job.CreateBatchIngestOutboxEntry(ctx, qtx, ingest)
+		if err != nil {
+			return fmt.Errorf("failed to create outbox entry: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		h.log.Error().Err(err).Int32("user_id", userID).Msg("Failed to create batch")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create batch")
+		return
+	}
+	h.log.Info().
+		Int32("batch_id", batch.ID).
+		Int32("user_id", userID).
+		Str("prefix", req.Source.Prefix).
+		Int32("max_in_flight", maxInFlight).
+		Msg("Prefix batch created")
+
+	if err := Job.DispatchOutboxEntry(ctx, h.queries, h.scheduler, entry); err != nil {
+		h.log.Warn().Err(err).Int32("batch_id", batch.ID).Msg("Failed to enqueue batch listing, leaving it to the outbox relay")
+	}
+
+	helpers.RespondWithJSON(w, http.StatusAccepted, batchResponse(batch, nil))
+}
+
+// GetBatch returns the status of a batch and how many of its items are in
+// each status
+func (h *BatchHandler) GetBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil || id < 1 {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid batch id")
+		return
+	}
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email query parameter is required")
+		return
+	}
+
+	batch, err := h.queries.GetBatchByOwner(ctx, db.GetBatchByOwnerParams{ID: int32(id), Email: email})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			helpers.RespondWithError(w, http.StatusNotFound, "Batch not found")
+			return
+		}
+		h.log.Error().Err(err).Int64("batch_id", id).Msg("Failed to load batch")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	rows, err := h.queries.CountBatchImagesByStatus(ctx, pgtype.Int4{Int32: batch.ID, Valid: true})
+	if err != nil {
+		h.log.Error().Err(err).Int64("batch_id", id).Msg("Failed to count batch items")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	counts := make(map[string]int32, len(rows))
+	for _, row := range rows {
+		counts[row.Status.String] = row.Count
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, batchResponse(batch, counts))
+}
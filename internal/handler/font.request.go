@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"imagepp/internal/db"
+	"imagepp/internal/services"
+	"imagepp/pkg/helpers"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+)
+
+type FontHandler struct {
+	log     zerolog.Logger
+	queries *db.Queries
+	buckets []string
+}
+
+// NewFontHandler creates a font handler. buckets are the only buckets fonts
+// can be registered from.
+func NewFontHandler(log zerolog.Logger, queries *db.Queries, buckets []string) *FontHandler {
+	return &FontHandler{
+		log:     log,
+		queries: queries,
+		buckets: buckets,
+	}
+}
+
+type RegisterFontRequest struct {
+	Email      string `json:"email" validate:"required,email"`
+	Name       string `json:"name" validate:"required,max=100,excludesall=/\\ "`
+	BucketName string `json:"bucket_name" validate:"required"`
+	FontKey    string `json:"font_key" validate:"required"`
+}
+
+type FontResponse struct {
+	Name       string `json:"name"`
+	Bundled    bool   `json:"bundled"`
+	BucketName string `json:"bucket_name,omitempty"`
+	FontKey    string `json:"font_key,omitempty"`
+}
+
+// RegisterFont makes a TTF/OTF file from storage available to watermarks by
+// name. The user who registered a name can register it again to replace the
+// file; workers pick up the new file by its entity tag.
+func (h *FontHandler) RegisterFont(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req RegisterFontRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		h.log.Error().Err(err).Msg("Validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	if services.IsBundledFont(req.Name) {
+		helpers.RespondWithError(w, http.StatusConflict, "Font name is reserved for a bundled font")
+		return
+	}
+	if !slices.Contains(h.buckets, req.BucketName) {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: bucket_name is not a font bucket")
+		return
+	}
+
+	// Reject files the worker would fail to parse before they are referenced by jobs
+	s3Svc, err := services.NewS3Service(ctx, req.BucketName)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to create S3 service")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Storage unavailable")
+		return
+	}
+	etag, err := s3Svc.ETag(ctx, req.FontKey)
+	if err != nil {
+		h.log.Error().Err(err).Str("font_key", req.FontKey).Msg("Failed to look up font")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Font file not found in storage")
+		return
+	}
+	data, err := s3Svc.Download(ctx, req.FontKey)
+	if err != nil {
+		h.log.Error().Err(err).Str("font_key", req.FontKey).Msg("Failed to download font")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Font file not found in storage")
+		return
+	}
+	if err := services.ParseFont(data); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Not a valid TTF/OTF font: "+err.Error())
+		return
+	}
+
+	user, err := getOrCreateUser(ctx, h.log, h.queries, req.Email)
+	if err != nil {
+		h.log.Error().Err(err).Str("email", req.Email).Msg("Failed to get or create user")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+	font, err := h.queries.UpsertFont(ctx, db.UpsertFontParams{
+		UserID:     user.ID,
+		Name:       req.Name,
+		BucketName: req.BucketName,
+		FontKey:    req.FontKey,
+		Etag:       etag,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			helpers.RespondWithError(w, http.StatusConflict, "Font name is registered by another user")
+			return
+		}
+		h.log.Error().Err(err).Msg("Failed to create font record")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to register font")
+		return
+	}
+	h.log.Info().Str("font", font.Name).Str("font_key", font.FontKey).Str("etag", font.Etag).Msg("Font registered")
+
+	code := http.StatusCreated
+	if !font.CreatedAt.Time.Equal(font.UpdatedAt.Time) {
+		code = http.StatusOK
+	}
+	helpers.RespondWithJSON(w, code, FontResponse{
+		Name:       font.Name,
+		BucketName: font.BucketName,
+		FontKey:    font.FontKey,
+	})
+}
+
+// ListFonts returns the bundled fonts followed by the registered ones
+func (h *FontHandler) ListFonts(w http.ResponseWriter, r *http.Request) {
+	custom, err := h.queries.ListFonts(r.Context())
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list fonts")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	bundled := services.BundledFonts()
+	fonts := make([]FontResponse, 0, len(bundled)+len(custom))
+	for _, name := range bundled {
+		fonts = append(fonts, FontResponse{Name: name, Bundled: true})
+	}
+	for _, f := range custom {
+		fonts = append(fonts, FontResponse{
+			Name:       f.Name,
+			BucketName: f.BucketName,
+			FontKey:    f.FontKey,
+		})
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, fonts)
+}
+
+// DeleteFont removes a font registered by the user given by the email query
+// parameter. Jobs already queued with it fail.
+func (h *FontHandler) DeleteFont(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email is required")
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	n, err := h.queries.DeleteFont(r.Context(), db.DeleteFontParams{
+		Name:  name,
+		Email: email,
+	})
+	if err != nil {
+		h.log.Error().Err(err).Str("font", name).Msg("Failed to delete font")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to delete font")
+		return
+	}
+	if n == 0 {
+		helpers.RespondWithError(w, http.StatusNotFound, "Font not found")
+		return
+	}
+	h.log.Info().Str("font", name).Msg("Font deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
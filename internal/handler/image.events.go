@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imagepp/internal/events"
+	"imagepp/pkg/helpers"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sseHeartbeat is how often a comment is sent on an idle stream, so proxies
+// don't close it
+const sseHeartbeat = 15 * time.Second
+
+// StreamEvents streams the status transitions and pipeline progress of an
+// image as server-sent events, for the user given by the email query
+// parameter. The stream starts with the current state and ends once the
+// image reaches a final status.
+func (h *ImageHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := imageIDParam(r)
+	if !ok {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid image id")
+		return
+	}
+
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email query parameter is required")
+		return
+	}
+
+	if _, err := h.loadOwnedImage(ctx, id, email); err != nil {
+		if errors.Is(err, errImageNotFound) {
+			helpers.RespondWithError(w, http.StatusNotFound, "Image not found")
+			return
+		}
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to load image")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// Subscribe before reading the current state, so no transition falls
+	// between the two
+	sub, err := h.events.Subscribe(ctx, int64(id))
+	if err != nil {
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to subscribe to image events")
+		helpers.RespondWithError(w, http.StatusServiceUnavailable, "Event stream unavailable")
+		return
+	}
+	defer sub.Close()
+
+	image, err := h.queries.GetImageByID(ctx, id)
+	if err != nil {
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to load image")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream lasts as long as the job, not the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		h.log.Warn().Err(err).Msg("Failed to clear write deadline for event stream")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	current := events.Event{
+		Type:    events.TypeStatus,
+		ImageID: int64(image.ID),
+		Status:  image.Status.String,
+		At:      image.UpdatedAt.Time,
+	}
+	terminal := events.Terminal(current.Status)
+	if terminal {
+		current.FailureReason = image.FailureReason.String
+	}
+	if err := writeEvent(w, rc, current); err != nil || terminal {
+		return
+	}
+	// An unfinished image with a failure reason is waiting for asynq to
+	// run its next attempt
+	if image.FailureReason.Valid {
+		retry := events.Event{
+			Type:          events.TypeRetry,
+			ImageID:       int64(image.ID),
+			FailureReason: image.FailureReason.String,
+			At:            image.UpdatedAt.Time,
+		}
+		if err := writeEvent(w, rc, retry); err != nil {
+			return
+		}
+	}
+	if current.Status == "processing" {
+		last, err := h.events.LastProgress(ctx, int64(id))
+		if err != nil {
+			h.log.Warn().Err(err).Int32("image_id", id).Msg("Failed to load image progress")
+		} else if last != nil {
+			if err := writeEvent(w, rc, *last); err != nil {
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case msg, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			var e events.Event
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				h.log.Warn().Err(err).Int32("image_id", id).Msg("Dropping malformed image event")
+				continue
+			}
+			if err := writeEvent(w, rc, e); err != nil {
+				return
+			}
+			if e.Type == events.TypeStatus && events.Terminal(e.Status) {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes one server-sent event named after the event type
+func writeEvent(w io.Writer, rc *http.ResponseController, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -1,61 +1,399 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"imagepp/internal/db"
+	"imagepp/internal/events"
 	Job "imagepp/internal/jobs"
 	"imagepp/internal/scheduler"
+	"imagepp/internal/services"
 	"imagepp/pkg/helpers"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/validator/v10"
+	"github.com/hibiken/asynq"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog"
 )
 
 var validate = validator.New()
 
 type ImageHandler struct {
-	log       zerolog.Logger
-	queries   *db.Queries
-	scheduler *scheduler.Client
+	log         zerolog.Logger
+	dbpool      *pgxpool.Pool
+	queries     *db.Queries
+	scheduler   *scheduler.Client
+	events      *events.Broker
+	logoBuckets []string
+	outBuckets  []string
 }
 
-func NewImageHandler(log zerolog.Logger, queries *db.Queries, scheduler *scheduler.Client) *ImageHandler {
+// NewImageHandler creates an image handler. logoBuckets are the buckets
+// overlays may read logos from and outBuckets those outputs may be written
+// to, besides the job's own.
+func NewImageHandler(log zerolog.Logger, dbpool *pgxpool.Pool, queries *db.Queries, scheduler *scheduler.Client, broker *events.Broker, logoBuckets, outBuckets []string) *ImageHandler {
 	return &ImageHandler{
-		log:       log,
-		queries:   queries,
-		scheduler: scheduler,
+		log:         log,
+		dbpool:      dbpool,
+		queries:     queries,
+		scheduler:   scheduler,
+		events:      broker,
+		logoBuckets: logoBuckets,
+		outBuckets:  outBuckets,
 	}
 }
 
 type ProcessImageRequest struct {
-	Email      string      `json:"email" validate:"required,email"`
-	BucketName string      `json:"bucket_name" validate:"required"`
-	ImageKey   string      `json:"image_key" validate:"required"`
-	Operations []Operation `json:"operations" validate:"required,min=1"`
+	Email        string       `json:"email" validate:"required,email"`
+	BucketName   string       `json:"bucket_name" validate:"required"`
+	ImageKey     string       `json:"image_key" validate:"required"`
+	Operations   []Operation  `json:"operations" validate:"required_without_all=Outputs Preset,excluded_with=Preset,omitempty,min=1,dive"`
+	Metadata     string       `json:"metadata,omitempty" validate:"omitempty,oneof=strip keep icc_copyright strip_gps"`
+	ColorProfile string       `json:"color_profile,omitempty" validate:"omitempty,oneof=srgb display-p3 adobe-rgb"`
+	Outputs      []Output     `json:"outputs,omitempty" validate:"omitempty,max=20,unique=Name,dive"`
+	Destination  *Destination `json:"destination,omitempty"`
+
+	// SkipCache reprocesses even when an earlier image had the same source
+	// and operations, e.g. after a logo or font was replaced in storage
+	SkipCache bool `json:"skip_cache,omitempty"`
+
+	// Preset replaces Operations with the operations of a stored preset,
+	// Overrides patches the params of its operations by type
+	Preset    string                    `json:"preset,omitempty" validate:"omitempty,max=100"`
+	Overrides map[string]map[string]any `json:"overrides,omitempty" validate:"excluded_without=Preset"`
+
+	// CallbackURL is POSTed the image.completed or image.failed event,
+	// signed with CallbackSecret like registered webhooks
+	CallbackURL    string `json:"callback_url,omitempty" validate:"omitempty,http_url,max=2048"`
+	CallbackSecret string `json:"callback_secret,omitempty" validate:"required_with=CallbackURL,excluded_without=CallbackURL,omitempty,min=16,max=256"`
+}
+
+// Output is a named variant built from the shared operations, followed by
+// its own operations (typically a compress with its own size and format)
+type Output struct {
+	Name       string      `json:"name" validate:"required,max=100,excludesall=/\\ "`
+	Operations []Operation `json:"operations,omitempty" validate:"omitempty,dive"`
+}
+
+// Destination overrides where outputs are written. BucketName must be the
+// source bucket or a configured output bucket. KeyTemplate must start with
+// users/{user_id}/ or processed/{image_id} and may use {user_id},
+// {image_id}, {variant}, {width}, {height}, {hash}, {orig_basename} and
+// {ext}.
+type Destination struct {
+	BucketName  string `json:"bucket_name,omitempty" validate:"omitempty,min=3,max=63"`
+	KeyTemplate string `json:"key_template,omitempty" validate:"omitempty,max=1024"`
 }
 
+// Operation is one step of a pipeline. Params is required even for
+// operations whose params are all optional, those take {}.
 type Operation struct {
-	Type   string         `json:"type" validate:"required,oneof=compress watermark"`
+	Type   string         `json:"type" validate:"required,oneof=compress watermark overlay adjust sharpen blur redact trim border round_corners flatten"`
 	Params map[string]any `json:"params" validate:"required"`
 }
 
 type CompressParams struct {
-	Quality   int    `json:"quality" validate:"required,min=1,max=100"`
-	Format    string `json:"format" validate:"required,oneof=jpeg png"`
+	Quality   int    `json:"quality" validate:"omitempty,min=1,max=100"`
+	Format    string `json:"format" validate:"omitempty,oneof=jpeg png webp"`
 	MaxWidth  int    `json:"max_width,omitempty" validate:"omitempty,min=1"`
 	MaxHeight int    `json:"max_height,omitempty" validate:"omitempty,min=1"`
+
+	AutoSharpen bool `json:"auto_sharpen,omitempty"`
 }
 
 type WatermarkParams struct {
 	Text     string  `json:"text" validate:"required"`
-	Position string  `json:"position" validate:"required,oneof=top-left top-right bottom-left bottom-right center"`
-	Opacity  float64 `json:"opacity" validate:"required,min=0,max=1"`
+	Position string  `json:"position,omitempty" validate:"required_unless=Mode tile,omitempty,oneof=top-left top-right bottom-left bottom-right center"`
+	Opacity  float64 `json:"opacity" validate:"omitempty,min=0,max=1"`
 	FontSize int     `json:"font_size,omitempty" validate:"omitempty,min=1"`
+	Font     string  `json:"font,omitempty" validate:"omitempty,max=100"`
 	Color    string  `json:"color,omitempty" validate:"omitempty"`
+
+	Mode         string  `json:"mode,omitempty" validate:"omitempty,oneof=single tile"`
+	Angle        float64 `json:"angle,omitempty" validate:"omitempty,min=-360,max=360"`
+	Spacing      int     `json:"spacing,omitempty" validate:"omitempty,min=0"`
+	Align        string  `json:"align,omitempty" validate:"omitempty,oneof=left center right"`
+	WrapWidth    float64 `json:"wrap_width,omitempty" validate:"omitempty,gt=0,max=1"`
+	LineHeight   float64 `json:"line_height,omitempty" validate:"omitempty,gt=0,max=5"`
+	StrokeWidth  int     `json:"stroke_width,omitempty" validate:"omitempty,min=0,max=20"`
+	StrokeColor  string  `json:"stroke_color,omitempty" validate:"omitempty"`
+	ShadowOffset int     `json:"shadow_offset,omitempty" validate:"omitempty,min=-50,max=50"`
+	ShadowColor  string  `json:"shadow_color,omitempty" validate:"omitempty"`
+}
+
+type OverlayParams struct {
+	LogoKey    string  `json:"logo_key" validate:"required"`
+	LogoBucket string  `json:"logo_bucket,omitempty" validate:"omitempty"`
+	Position   string  `json:"position,omitempty" validate:"omitempty,oneof=top-left top-right bottom-left bottom-right center"`
+	Scale      float64 `json:"scale,omitempty" validate:"omitempty,gt=0,max=1"`
+	Opacity    float64 `json:"opacity,omitempty" validate:"omitempty,min=0,max=1"`
+	Margin     int     `json:"margin,omitempty" validate:"omitempty,min=0"`
+}
+
+type AdjustParams struct {
+	Brightness float64 `json:"brightness,omitempty" validate:"omitempty,min=-100,max=100"`
+	Contrast   float64 `json:"contrast,omitempty" validate:"omitempty,min=-100,max=100"`
+	Saturation float64 `json:"saturation,omitempty" validate:"omitempty,min=-100,max=500"`
+	Gamma      float64 `json:"gamma,omitempty" validate:"omitempty,gt=0,max=10"`
+	Hue        float64 `json:"hue,omitempty" validate:"omitempty,min=-180,max=180"`
+	Preset     string  `json:"preset,omitempty" validate:"omitempty,oneof=grayscale sepia invert"`
+}
+
+type SharpenParams struct {
+	Radius    float64 `json:"radius" validate:"required,gt=0,max=50"`
+	Amount    float64 `json:"amount" validate:"required,gt=0,max=5"`
+	Threshold int     `json:"threshold,omitempty" validate:"omitempty,min=0,max=255"`
+}
+
+type BlurParams struct {
+	Sigma float64 `json:"sigma" validate:"required,gt=0,max=100"`
+}
+
+type RedactParams struct {
+	Regions []RedactRegion `json:"regions" validate:"required,min=1,max=100,dive"`
+}
+
+type RedactRegion struct {
+	X         int     `json:"x" validate:"min=0"`
+	Y         int     `json:"y" validate:"min=0"`
+	Width     int     `json:"width" validate:"required,min=1"`
+	Height    int     `json:"height" validate:"required,min=1"`
+	Mode      string  `json:"mode" validate:"required,oneof=fill blur pixelate"`
+	Color     string  `json:"color,omitempty" validate:"omitempty"`
+	Sigma     float64 `json:"sigma,omitempty" validate:"omitempty,gt=0,max=100"`
+	BlockSize int     `json:"block_size,omitempty" validate:"omitempty,min=2,max=512"`
+}
+
+type TrimParams struct {
+	Color        string `json:"color,omitempty" validate:"omitempty"`
+	Tolerance    int    `json:"tolerance,omitempty" validate:"omitempty,min=0,max=255"`
+	Padding      int    `json:"padding,omitempty" validate:"omitempty,min=0,max=1000"`
+	PaddingColor string `json:"padding_color,omitempty" validate:"omitempty"`
+}
+
+type BorderParams struct {
+	Width int    `json:"width" validate:"required,min=1,max=1000"`
+	Color string `json:"color,omitempty" validate:"omitempty"`
+}
+
+type RoundCornersParams struct {
+	Radius     int    `json:"radius" validate:"required,min=1"`
+	Background string `json:"background,omitempty" validate:"omitempty"`
+}
+
+type FlattenParams struct {
+	Background string `json:"background,omitempty" validate:"omitempty"`
+}
+
+// operationParams returns the struct an operation's params are validated against
+var operationParams = map[string]func() any{
+	"compress":      func() any { return &CompressParams{} },
+	"watermark":     func() any { return &WatermarkParams{} },
+	"overlay":       func() any { return &OverlayParams{} },
+	"adjust":        func() any { return &AdjustParams{} },
+	"sharpen":       func() any { return &SharpenParams{} },
+	"blur":          func() any { return &BlurParams{} },
+	"redact":        func() any { return &RedactParams{} },
+	"trim":          func() any { return &TrimParams{} },
+	"border":        func() any { return &BorderParams{} },
+	"flatten":       func() any { return &FlattenParams{} },
+	"round_corners": func() any { return &RoundCornersParams{} },
+}
+
+// validateOperations checks every operation's params against its schema
+func validateOperations(path string, ops []Operation) error {
+	for i, op := range ops {
+		newParams, ok := operationParams[op.Type]
+		if !ok {
+			return fmt.Errorf("%s[%d]: unknown type %q", path, i, op.Type)
+		}
+
+		raw, err := json.Marshal(op.Params)
+		if err != nil {
+			return fmt.Errorf("%s[%d]: %w", path, i, err)
+		}
+		params := newParams()
+		if err := json.Unmarshal(raw, params); err != nil {
+			return fmt.Errorf("%s[%d] (%s): invalid params: %w", path, i, op.Type, err)
+		}
+		if err := validate.Struct(params); err != nil {
+			return fmt.Errorf("%s[%d] (%s): %w", path, i, op.Type, err)
+		}
+	}
+	return nil
+}
+
+// validateRequestOperations validates the shared operations and those of every output
+func validateRequestOperations(req ProcessImageRequest) error {
+	if err := validateOperations("operations", req.Operations); err != nil {
+		return err
+	}
+	for i, out := range req.Outputs {
+		if err := validateOperations(fmt.Sprintf("outputs[%d].operations", i), out.Operations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDestination checks that outputs go to the job's bucket or an
+// allowed output bucket, that the key template renders to a safe key and
+// that outputs of the same job can't overwrite each other
+func validateDestination(req ProcessImageRequest, allowed []string) error {
+	if req.Destination == nil {
+		return nil
+	}
+	if !services.OutputBucketAllowed(req.Destination.BucketName, req.BucketName, allowed) {
+		return fmt.Errorf("destination.bucket_name: %q must be the job's bucket or an allowed output bucket", req.Destination.BucketName)
+	}
+	if req.Destination.KeyTemplate == "" {
+		return nil
+	}
+
+	tmpl := req.Destination.KeyTemplate
+	if err := services.ValidateKeyTemplate(tmpl); err != nil {
+		return fmt.Errorf("destination.key_template: %w", err)
+	}
+	if len(req.Outputs) > 1 && !strings.Contains(tmpl, "{variant}") && !strings.Contains(tmpl, "{hash}") {
+		return fmt.Errorf("destination.key_template: must contain {variant} or {hash} when there are several outputs")
+	}
+	return nil
+}
+
+// validateCallbackURL rejects callback and webhook URLs that point into
+// the workers' network, see services.ValidateWebhookURL
+func validateCallbackURL(ctx context.Context, field, rawURL string) error {
+	if rawURL == "" {
+		return nil
+	}
+	if err := services.ValidateWebhookURL(ctx, rawURL); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	return nil
+}
+
+// errUnknownFont is returned by validateFonts for fonts that are neither bundled nor registered
+var errUnknownFont = errors.New("unknown font")
+
+// requestOperationLists returns the shared operations followed by those of every output
+func requestOperationLists(req ProcessImageRequest) [][]Operation {
+	lists := [][]Operation{req.Operations}
+	for _, out := range req.Outputs {
+		lists = append(lists, out.Operations)
+	}
+	return lists
+}
+
+// validateLogoBuckets keeps overlays from reading logos out of buckets
+// other than the job's own and the configured logo buckets
+func validateLogoBuckets(bucket string, allowed []string, lists ...[]Operation) error {
+	for _, ops := range lists {
+		for _, op := range ops {
+			if op.Type != "overlay" {
+				continue
+			}
+			logoBucket, _ := op.Params["logo_bucket"].(string)
+			if !services.LogoBucketAllowed(logoBucket, bucket, allowed) {
+				return fmt.Errorf("overlay: logo_bucket %q must be the job's bucket or an allowed logo bucket", logoBucket)
+			}
+		}
+	}
+	return nil
+}
+
+// validateFonts checks that every font referenced by a watermark can be loaded by the worker
+func validateFonts(ctx context.Context, queries *db.Queries, lists ...[]Operation) error {
+	for _, ops := range lists {
+		for _, op := range ops {
+			if op.Type != "watermark" {
+				continue
+			}
+			name, _ := op.Params["font"].(string)
+			if name == "" || services.IsBundledFont(name) {
+				continue
+			}
+			if _, err := queries.GetFontByName(ctx, name); err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					return fmt.Errorf("watermark: %w %q", errUnknownFont, name)
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toJobOperations converts validated operations to the job payload format
+func toJobOperations(ops []Operation) []map[string]any {
+	operations := make([]map[string]any, len(ops))
+	for i, op := range ops {
+		operations[i] = map[string]any{
+			"type":   op.Type,
+			"params": op.Params,
+		}
+	}
+	return operations
+}
+
+// toJobOutputs converts validated outputs to the job payload format
+func toJobOutputs(outs []Output) []Job.Output {
+	var outputs []Job.Output
+	for _, out := range outs {
+		outputs = append(outputs, Job.Output{
+			Name:       out.Name,
+			Operations: toJobOperations(out.Operations),
+		})
+	}
+	return outputs
+}
+
+// buildJob converts a validated request to the worker's job payload
+func buildJob(req ProcessImageRequest, imageID, userID int32) Job.Job {
+	job := Job.Job{
+		ImageID:      int64(imageID),
+		UserID:       int64(userID),
+		BucketName:   req.BucketName,
+		ImageKey:     req.ImageKey,
+		Operations:   toJobOperations(req.Operations),
+		Metadata:     req.Metadata,
+		ColorProfile: req.ColorProfile,
+		Outputs:      toJobOutputs(req.Outputs),
+		SkipCache:    req.SkipCache,
+	}
+	if req.Destination != nil {
+		job.Destination = &Job.Destination{
+			BucketName:  req.Destination.BucketName,
+			KeyTemplate: req.Destination.KeyTemplate,
+		}
+	}
+	return job
+}
+
+// getOrCreateUser returns the user with the given email, creating it on first use
+func getOrCreateUser(ctx context.Context, log zerolog.Logger, queries *db.Queries, email string) (db.User, error) {
+	user, err := queries.GetUserByEmail(ctx, email)
+	if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+		return user, err
+	}
+
+	user, err = queries.CreateUser(ctx, db.CreateUserParams{
+		Email:     email,
+		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+	if err != nil {
+		return user, err
+	}
+	log.Info().Int32("user_id", user.ID).Str("email", user.Email).Msg("New User Created")
+	return user, nil
 }
 
 func (h *ImageHandler) ProcessImage(w http.ResponseWriter, r *http.Request) {
@@ -75,30 +413,70 @@ func (h *ImageHandler) ProcessImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user exists or create new one
-	var user db.User
-	var err error
-	user, err = h.queries.GetUserByEmail(ctx, req.Email)
-	if err == pgx.ErrNoRows {
-		user, err = h.queries.CreateUser(ctx, db.CreateUserParams{
-			Email:     req.Email,
-			CreatedAt: pgtype.Timestamp{Time: time.Now()},
-		})
-
+	var preset *db.Preset
+	if req.Preset != "" {
+		var err error
+		preset, err = resolvePreset(ctx, h.queries, &req)
 		if err != nil {
-			h.log.Error().Err(err).Str("email", req.Email).Msg("Failed to create user")
-			helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create user")
+			if errors.Is(err, errUnknownPreset) || errors.Is(err, errInvalidOverride) {
+				helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+				return
+			}
+			h.log.Error().Err(err).Str("preset", req.Preset).Msg("Failed to resolve preset")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
 			return
 		}
-		h.log.Info().Int32("user_id", user.ID).Str("email", user.Email).Msg("New User Created")
-	} else if err != nil {
-		h.log.Error().Err(err).Str("email", req.Email).Msg("Database error getting user")
+	}
+
+	if err := validateRequestOperations(req); err != nil {
+		h.log.Error().Err(err).Msg("Operation validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	if err := validateDestination(req, h.outBuckets); err != nil {
+		h.log.Error().Err(err).Msg("Destination validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	if err := validateCallbackURL(ctx, "callback_url", req.CallbackURL); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	if err := validateLogoBuckets(req.BucketName, h.logoBuckets, requestOperationLists(req)...); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	if err := validateFonts(ctx, h.queries, requestOperationLists(req)...); err != nil {
+		if errors.Is(err, errUnknownFont) {
+			helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+			return
+		}
+		h.log.Error().Err(err).Msg("Database error checking fonts")
 		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
 
-	// TODO: Create image record
-	image, err := h.queries.CreateImage(ctx, db.CreateImageParams{
+	// Check if user exists or create new one
+	user, err := getOrCreateUser(ctx, h.log, h.queries, req.Email)
+	if err != nil {
+		h.log.Error().Err(err).Str("email", req.Email).Msg("Failed to get or create user")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// The image keeps the preset version it was built from, later edits
+	// to the preset don't change what this job ran
+	var presetID, presetVersion pgtype.Int4
+	if preset != nil {
+		presetID = pgtype.Int4{Int32: preset.ID, Valid: true}
+		presetVersion = pgtype.Int4{Int32: preset.Version, Valid: true}
+	}
+
+	image, entry, err := h.createImageJob(ctx, req, db.CreateImageParams{
 		UserID:     pgtype.Int4{Int32: user.ID, Valid: true},
 		BucketName: req.BucketName,
 		ImageKey:   req.ImageKey,
@@ -106,8 +484,13 @@ func (h *ImageHandler) ProcessImage(w http.ResponseWriter, r *http.Request) {
 			String: "pending",
 			Valid:  true,
 		},
-		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
-		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+		CreatedAt:      pgtype.Timestamp{Time: time.Now(), Valid: true},
+		UpdatedAt:      pgtype.Timestamp{Time: time.Now(), Valid: true},
+		PresetID:       presetID,
+		PresetVersion:  presetVersion,
+		Revision:       1,
+		CallbackUrl:    pgtype.Text{String: req.CallbackURL, Valid: req.CallbackURL != ""},
+		CallbackSecret: pgtype.Text{String: req.CallbackSecret, Valid: req.CallbackSecret != ""},
 	})
 	if err != nil {
 		h.log.Error().Err(err).Msg("Failed to create image record")
@@ -120,34 +503,267 @@ func (h *ImageHandler) ProcessImage(w http.ResponseWriter, r *http.Request) {
 		Str("image_key", req.ImageKey).
 		Msg("Image record created")
 
-	// TODO: Enqueue job to scheduler
-	operations := make([]map[string]any, len(req.Operations))
-	for i, op := range req.Operations {
-		operations[i] = map[string]any{
-			"type":   op.Type,
-			"params": op.Params,
-		}
-	}
+	h.dispatch(ctx, image.ID, entry)
 
-	jobs := Job.Job{
+	helpers.RespondWithJSON(w, http.StatusAccepted, helpers.StatusResponse{
 		ImageID:    int64(image.ID),
 		UserID:     int64(user.ID),
 		BucketName: req.BucketName,
 		ImageKey:   req.ImageKey,
-		Operations: operations,
+		Status:     "processing",
+
+		Preset:        req.Preset,
+		PresetVersion: presetVersion.Int32,
+	})
+}
+
+// createImageJob writes the image row and its task together, a Redis outage
+// leaves the task in the outbox instead of stranding a pending row
+func (h *ImageHandler) createImageJob(ctx context.Context, req ProcessImageRequest, params db.CreateImageParams) (db.Image, db.JobOutbox, error) {
+	params.PipelineVersion = pgtype.Int4{Int32: Job.PipelineVersion, Valid: true}
+
+	var image db.Image
+	var entry db.JobOutbox
+	err := pgx.BeginFunc(ctx, h.dbpool, func(tx pgx.Tx) error {
+		qtx := h.queries.WithTx(tx)
+		if params.ParentImageID.Valid {
+			revision, err := nextRevision(ctx, qtx, params.ParentImageID.Int32)
+			if err != nil {
+				return err
+			}
+			params.Revision = revision
+		}
+
+		var err error
+		image, err = qtx.CreateImage(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to create image record: %w", err)
+		}
+		entry, err = Job.CreateImageOutboxEntry(ctx, qtx, buildJob(req, image.ID, params.UserID.Int32), image.Attempt)
+		if err != nil {
+			return fmt.Errorf("failed to create outbox entry: %w", err)
+		}
+		// Kept on the image so it can be retried once the task is gone
+		return qtx.SetImageJobPayload(ctx, db.SetImageJobPayloadParams{
+			ID:         image.ID,
+			JobPayload: entry.Payload,
+		})
+	})
+	return image, entry, err
+}
+
+// nextRevision numbers a new revision of an image after the highest
+// revision of its chain. Revising an older revision, or two revisions at
+// once, would otherwise reuse a number; the chain's first image is locked
+// until the transaction ends.
+func nextRevision(ctx context.Context, qtx *db.Queries, parentID int32) (int32, error) {
+	rootID, err := qtx.LockImageChain(ctx, parentID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock revision chain: %w", err)
 	}
+	revision, err := qtx.NextImageRevision(ctx, rootID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to number revision: %w", err)
+	}
+	return revision, nil
+}
+
+// dispatch enqueues a committed outbox entry right away, the outbox relay
+// picks the task up if this fails
+func (h *ImageHandler) dispatch(ctx context.Context, imageID int32, entry db.JobOutbox) {
+	if err := Job.DispatchOutboxEntry(ctx, h.queries, h.scheduler, entry); err != nil {
+		h.log.Warn().Err(err).Int32("image_id", imageID).Msg("Failed to enqueue image job, leaving it to the outbox relay")
+	}
+}
 
-	if err := Job.EnqueueImageJob(ctx, h.scheduler, jobs); err != nil {
-		h.log.Error().Err(err).Msg("Failed to enqueue image job")
-		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to queue job")
+// publishStatus tells event stream clients about a status change made by
+// the API. Events are best effort, the change is already committed.
+func (h *ImageHandler) publishStatus(ctx context.Context, imageID int32, status string) {
+	err := h.events.Publish(ctx, events.Event{Type: events.TypeStatus, ImageID: int64(imageID), Status: status})
+	if err != nil {
+		h.log.Warn().Err(err).Int32("image_id", imageID).Msg("Failed to publish image event")
+	}
+}
+
+type CancelImageRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// errImageNotFound is returned by loadOwnedImage for missing images and
+// images owned by someone else, which are indistinguishable to the caller
+var errImageNotFound = errors.New("image not found")
+
+// loadOwnedImage returns the image with the given id if it belongs to email
+func (h *ImageHandler) loadOwnedImage(ctx context.Context, id int32, email string) (db.Image, error) {
+	image, err := h.queries.GetImageByID(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return db.Image{}, errImageNotFound
+	}
+	if err != nil {
+		return db.Image{}, err
+	}
+
+	user, err := h.queries.GetUserByEmail(ctx, email)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && image.UserID.Int32 != user.ID) {
+		return db.Image{}, errImageNotFound
+	}
+	if err != nil {
+		return db.Image{}, err
+	}
+	return image, nil
+}
+
+// imageIDParam parses the {id} URL parameter
+func imageIDParam(r *http.Request) (int32, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil || id < 1 {
+		return 0, false
+	}
+	return int32(id), true
+}
+
+// CancelImage stops a pending or running job. Queued tasks are removed and
+// the image is cancelled right away; running tasks are signalled and the
+// worker records the cancellation at its next step, so the response is 202.
+func (h *ImageHandler) CancelImage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := imageIDParam(r)
+	if !ok {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid image id")
 		return
 	}
 
-	helpers.RespondWithJSON(w, http.StatusAccepted, helpers.StatusResponse{
+	var req CancelImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	image, err := h.loadOwnedImage(ctx, id, req.Email)
+	if err != nil {
+		if errors.Is(err, errImageNotFound) {
+			helpers.RespondWithError(w, http.StatusNotFound, "Image not found")
+			return
+		}
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to load image")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// The flag makes the worker skip or abandon the job even if the task
+	// slips past the inspector below
+	now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+	if _, err := h.queries.RequestImageCancel(ctx, db.RequestImageCancelParams{ID: id, UpdatedAt: now}); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			helpers.RespondWithError(w, http.StatusConflict, "Image is already "+image.Status.String)
+			return
+		}
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to request cancellation")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	taskID := Job.ImageTaskID(int64(id), image.Attempt)
+	status := "cancelled"
+
+	// A task still in the outbox never reaches the queue
+	taken, err := h.queries.CancelOutboxEntry(ctx, db.CancelOutboxEntryParams{TaskID: taskID, DispatchedAt: now})
+	if err != nil {
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to cancel outbox entry")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if taken == 0 {
+		status, err = h.cancelTask(ctx, taskID)
+		if err != nil {
+			h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to cancel task")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to cancel task")
+			return
+		}
+	}
+
+	code := http.StatusAccepted
+	if status == "cancelled" {
+		code = http.StatusOK
+		n, err := h.queries.CancelImage(ctx, db.CancelImageParams{ID: id, UpdatedAt: now})
+		if err != nil {
+			h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to record cancellation")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if n == 0 {
+			status = "finished"
+		} else {
+			h.publishStatus(ctx, id, status)
+		}
+	}
+	if status == "finished" {
+		// The worker recorded its outcome before the cancel got to it
+		current, err := h.queries.GetImageByID(ctx, id)
+		if err != nil {
+			h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to load image")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		helpers.RespondWithError(w, http.StatusConflict, "Image is already "+current.Status.String)
+		return
+	}
+	h.log.Info().Int32("image_id", id).Str("status", status).Msg("Image cancellation requested")
+
+	helpers.RespondWithJSON(w, code, helpers.StatusResponse{
 		ImageID:    int64(image.ID),
-		UserID:     int64(user.ID),
-		BucketName: req.BucketName,
-		ImageKey:   req.ImageKey,
-		Status:     "processing",
+		UserID:     int64(image.UserID.Int32),
+		BucketName: image.BucketName,
+		ImageKey:   image.ImageKey,
+		Status:     status,
+		CreatedAt:  image.CreatedAt.Time,
+		UpdatedAt:  now.Time,
 	})
 }
+
+// cancelTask removes a queued task or signals a running one. It returns
+// "cancelled" when the task won't run, "cancelling" when a worker still
+// has to notice and "finished" when the task already ran to the end. A
+// task asynq doesn't know was lost or already cleaned up, CancelImage only
+// matches the former.
+func (h *ImageHandler) cancelTask(ctx context.Context, taskID string) (string, error) {
+	queue := "critical"
+	if entry, err := h.queries.GetOutboxEntryByTaskID(ctx, taskID); err == nil {
+		queue = entry.Queue
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	info, err := h.scheduler.TaskInfo(queue, taskID)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return "cancelled", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch info.State {
+	case asynq.TaskStateCompleted, asynq.TaskStateArchived:
+		return "finished", nil
+	case asynq.TaskStateActive:
+		// Running, signalled below
+	default:
+		err := h.scheduler.DeleteTask(queue, taskID)
+		if err == nil || errors.Is(err, asynq.ErrTaskNotFound) {
+			return "cancelled", nil
+		}
+		// Became active since the lookup, fall through to signalling it
+	}
+	if err := h.scheduler.CancelProcessing(taskID); err != nil {
+		return "", err
+	}
+	return "cancelling", nil
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imagepp/internal/db"
+	Job "imagepp/internal/jobs"
+	"imagepp/pkg/helpers"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// RetryImageRequest retries an image with its stored job. Giving operations
+// or outputs instead creates a new revision of the image with those, linked
+// to the original through parent_image_id. SkipCache is kept from the
+// stored job when not given.
+type RetryImageRequest struct {
+	Email      string      `json:"email" validate:"required,email"`
+	Operations []Operation `json:"operations,omitempty" validate:"omitempty,min=1,dive"`
+	Outputs    []Output    `json:"outputs,omitempty" validate:"omitempty,max=20,unique=Name,dive"`
+	SkipCache  *bool       `json:"skip_cache,omitempty"`
+}
+
+// fromJobOperations converts stored job operations back to request operations
+func fromJobOperations(ops []map[string]any) []Operation {
+	operations := make([]Operation, 0, len(ops))
+	for _, op := range ops {
+		opType, _ := op["type"].(string)
+		params, _ := op["params"].(map[string]any)
+		operations = append(operations, Operation{Type: opType, Params: params})
+	}
+	return operations
+}
+
+// requestFromJob rebuilds the request a stored job was created from
+func requestFromJob(email string, job Job.Job) ProcessImageRequest {
+	req := ProcessImageRequest{
+		Email:        email,
+		BucketName:   job.BucketName,
+		ImageKey:     job.ImageKey,
+		Operations:   fromJobOperations(job.Operations),
+		Metadata:     job.Metadata,
+		ColorProfile: job.ColorProfile,
+		SkipCache:    job.SkipCache,
+	}
+	for _, out := range job.Outputs {
+		req.Outputs = append(req.Outputs, Output{
+			Name:       out.Name,
+			Operations: fromJobOperations(out.Operations),
+		})
+	}
+	if job.Destination != nil {
+		req.Destination = &Destination{
+			BucketName:  job.Destination.BucketName,
+			KeyTemplate: job.Destination.KeyTemplate,
+		}
+	}
+	return req
+}
+
+// RetryImage re-enqueues a failed or cancelled image with the job it was
+// submitted with, or reprocesses any finished image with new operations as
+// a new revision
+func (h *ImageHandler) RetryImage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, ok := imageIDParam(r)
+	if !ok {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid image id")
+		return
+	}
+
+	var req RetryImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		h.log.Error().Err(err).Msg("Validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	image, err := h.loadOwnedImage(ctx, id, req.Email)
+	if err != nil {
+		if errors.Is(err, errImageNotFound) {
+			helpers.RespondWithError(w, http.StatusNotFound, "Image not found")
+			return
+		}
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to load image")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if image.JobPayload == nil {
+		helpers.RespondWithError(w, http.StatusConflict, "Image was submitted before jobs were stored and can't be retried")
+		return
+	}
+
+	var job Job.Job
+	if err := json.Unmarshal(image.JobPayload, &job); err != nil {
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to decode stored job")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to read stored job")
+		return
+	}
+
+	if len(req.Operations) == 0 && len(req.Outputs) == 0 {
+		h.retryAttempt(ctx, w, image, job, req.SkipCache)
+		return
+	}
+	h.createRevision(ctx, w, image, job, req)
+}
+
+// retryAttempt starts a new attempt of the same image row
+func (h *ImageHandler) retryAttempt(ctx context.Context, w http.ResponseWriter, image db.Image, job Job.Job, skipCache *bool) {
+	if skipCache != nil {
+		job.SkipCache = *skipCache
+	}
+	status := image.Status.String
+
+	var entry db.JobOutbox
+	err := pgx.BeginFunc(ctx, h.dbpool, func(tx pgx.Tx) error {
+		qtx := h.queries.WithTx(tx)
+		retried, err := qtx.RetryImage(ctx, db.RetryImageParams{
+			ID:              image.ID,
+			PipelineVersion: pgtype.Int4{Int32: Job.PipelineVersion, Valid: true},
+			UpdatedAt:       pgtype.Timestamp{Time: time.Now(), Valid: true},
+		})
+		if err != nil {
+			return err
+		}
+		image = retried
+		entry, err = Job.CreateImageOutboxEntry(ctx, qtx, job, image.Attempt)
+		if err != nil {
+			return fmt.Errorf("failed to create outbox entry: %w", err)
+		}
+		return qtx.SetImageJobPayload(ctx, db.SetImageJobPayloadParams{
+			ID:         image.ID,
+			JobPayload: entry.Payload,
+		})
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			helpers.RespondWithError(w, http.StatusConflict, "Only failed or cancelled images can be retried, image is "+status)
+			return
+		}
+		h.log.Error().Err(err).Int32("image_id", image.ID).Msg("Failed to retry image")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to retry image")
+		return
+	}
+	h.log.Info().Int32("image_id", image.ID).Int32("attempt", image.Attempt).Msg("Image retry queued")
+	h.publishStatus(ctx, image.ID, "pending")
+
+	h.dispatch(ctx, image.ID, entry)
+
+	helpers.RespondWithJSON(w, http.StatusAccepted, helpers.StatusResponse{
+		ImageID:       int64(image.ID),
+		UserID:        int64(image.UserID.Int32),
+		BucketName:    image.BucketName,
+		ImageKey:      image.ImageKey,
+		Status:        "processing",
+		CreatedAt:     image.CreatedAt.Time,
+		UpdatedAt:     image.UpdatedAt.Time,
+		ParentImageID: int64(image.ParentImageID.Int32),
+		Revision:      image.Revision,
+		Attempt:       image.Attempt,
+	})
+}
+
+// createRevision processes the source of a finished image again with new
+// operations or outputs, as a new image linked to the original
+func (h *ImageHandler) createRevision(ctx context.Context, w http.ResponseWriter, parent db.Image, job Job.Job, retry RetryImageRequest) {
+	switch parent.Status.String {
+	case "completed", "failed", "cancelled":
+	default:
+		helpers.RespondWithError(w, http.StatusConflict, "Image is still "+parent.Status.String+", cancel it before reprocessing")
+		return
+	}
+
+	// Settings not given in the retry carry over from the original job
+	req := requestFromJob(retry.Email, job)
+	if len(retry.Operations) > 0 {
+		req.Operations = retry.Operations
+	}
+	if len(retry.Outputs) > 0 {
+		req.Outputs = retry.Outputs
+	}
+	if retry.SkipCache != nil {
+		req.SkipCache = *retry.SkipCache
+	}
+
+	if err := validateRequestOperations(req); err != nil {
+		h.log.Error().Err(err).Msg("Operation validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateDestination(req, h.outBuckets); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateLogoBuckets(req.BucketName, h.logoBuckets, requestOperationLists(req)...); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateFonts(ctx, h.queries, requestOperationLists(req)...); err != nil {
+		if errors.Is(err, errUnknownFont) {
+			helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+			return
+		}
+		h.log.Error().Err(err).Msg("Database error checking fonts")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// A revision runs its own operations, it no longer matches a preset
+	// version. createImageJob numbers it after the chain's last revision.
+	image, entry, err := h.createImageJob(ctx, req, db.CreateImageParams{
+		UserID:         parent.UserID,
+		BucketName:     parent.BucketName,
+		ImageKey:       parent.ImageKey,
+		Status:         pgtype.Text{String: "pending", Valid: true},
+		CreatedAt:      pgtype.Timestamp{Time: time.Now(), Valid: true},
+		UpdatedAt:      pgtype.Timestamp{Time: time.Now(), Valid: true},
+		ParentImageID:  pgtype.Int4{Int32: parent.ID, Valid: true},
+		CallbackUrl:    parent.CallbackUrl,
+		CallbackSecret: parent.CallbackSecret,
+	})
+	if err != nil {
+		h.log.Error().Err(err).Int32("parent_image_id", parent.ID).Msg("Failed to create image revision")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create image record")
+		return
+	}
+	h.log.Info().
+		Int32("image_id", image.ID).
+		Int32("parent_image_id", parent.ID).
+		Int32("revision", image.Revision).
+		Msg("Image revision created")
+
+	h.dispatch(ctx, image.ID, entry)
+
+	helpers.RespondWithJSON(w, http.StatusAccepted, helpers.StatusResponse{
+		ImageID:       int64(image.ID),
+		UserID:        int64(image.UserID.Int32),
+		BucketName:    image.BucketName,
+		ImageKey:      image.ImageKey,
+		Status:        "processing",
+		CreatedAt:     image.CreatedAt.Time,
+		UpdatedAt:     image.UpdatedAt.Time,
+		ParentImageID: int64(parent.ID),
+		Revision:      image.Revision,
+		Attempt:       image.Attempt,
+	})
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"errors"
+	"imagepp/internal/db"
+	"imagepp/pkg/helpers"
+	"net/http"
+)
+
+// imageStatus converts an image row and its output rows to their API representation
+func imageStatus(image db.Image, outputs []db.ImageOutput) helpers.StatusResponse {
+	status := helpers.StatusResponse{
+		ImageID:    int64(image.ID),
+		UserID:     int64(image.UserID.Int32),
+		BucketName: image.BucketName,
+		ImageKey:   image.ImageKey,
+		Status:     image.Status.String,
+		CreatedAt:  image.CreatedAt.Time,
+		UpdatedAt:  image.UpdatedAt.Time,
+
+		PresetVersion: image.PresetVersion.Int32,
+
+		ParentImageID: int64(image.ParentImageID.Int32),
+		Revision:      image.Revision,
+		Attempt:       image.Attempt,
+
+		CacheHit:          image.CacheHit,
+		CachedFromImageID: int64(image.CachedFromImageID.Int32),
+
+		Operations:      image.Operations,
+		Outputs:         image.Outputs,
+		PipelineVersion: image.PipelineVersion.Int32,
+		FailureReason:   image.FailureReason.String,
+
+		BatchID: int64(image.BatchID.Int32),
+	}
+	for _, out := range outputs {
+		status.Results = append(status.Results, helpers.OutputResult{
+			Variant:    out.Variant,
+			BucketName: out.BucketName,
+			Key:        out.OutputKey,
+			Format:     out.Format,
+			Width:      out.Width,
+			Height:     out.Height,
+			SizeBytes:  out.SizeBytes,
+		})
+	}
+	return status
+}
+
+// GetStatus returns an image with the operations it was submitted with and
+// the outputs written for it, for the user given by the email query parameter
+func (h *ImageHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageIDParam(r)
+	if !ok {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid image id")
+		return
+	}
+
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email query parameter is required")
+		return
+	}
+
+	image, err := h.loadOwnedImage(r.Context(), id, email)
+	if err != nil {
+		if errors.Is(err, errImageNotFound) {
+			helpers.RespondWithError(w, http.StatusNotFound, "Image not found")
+			return
+		}
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to load image")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	outputs, err := h.queries.GetImageOutputsByImageID(r.Context(), image.ID)
+	if err != nil {
+		h.log.Error().Err(err).Int32("image_id", id).Msg("Failed to load image outputs")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, imageStatus(image, outputs))
+}
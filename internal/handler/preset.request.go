@@ -0,0 +1,429 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imagepp/internal/db"
+	"imagepp/pkg/helpers"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+type PresetHandler struct {
+	log     zerolog.Logger
+	dbpool  *pgxpool.Pool
+	queries *db.Queries
+}
+
+func NewPresetHandler(log zerolog.Logger, dbpool *pgxpool.Pool, queries *db.Queries) *PresetHandler {
+	return &PresetHandler{
+		log:     log,
+		dbpool:  dbpool,
+		queries: queries,
+	}
+}
+
+type CreatePresetRequest struct {
+	Email      string      `json:"email" validate:"required,email"`
+	Name       string      `json:"name" validate:"required,max=100,excludesall=/\\ "`
+	Operations []Operation `json:"operations" validate:"required,min=1,dive"`
+}
+
+type UpdatePresetRequest struct {
+	Email      string      `json:"email" validate:"required,email"`
+	Operations []Operation `json:"operations" validate:"required,min=1,dive"`
+}
+
+type PresetResponse struct {
+	Name       string      `json:"name"`
+	Version    int32       `json:"version"`
+	Operations []Operation `json:"operations"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
+
+var (
+	// errUnknownPreset is returned by resolvePreset when the owner has no live preset by that name
+	errUnknownPreset = errors.New("unknown preset")
+	// errInvalidOverride is returned by applyOverrides for types the operations don't use
+	errInvalidOverride = errors.New("invalid override")
+)
+
+// presetResponse decodes a stored preset, operations were validated before they were saved
+func presetResponse(p db.Preset) (PresetResponse, error) {
+	var ops []Operation
+	if err := json.Unmarshal(p.Operations, &ops); err != nil {
+		return PresetResponse{}, fmt.Errorf("preset %q has corrupt operations: %w", p.Name, err)
+	}
+	return PresetResponse{
+		Name:       p.Name,
+		Version:    p.Version,
+		Operations: ops,
+		CreatedAt:  p.CreatedAt.Time,
+		UpdatedAt:  p.UpdatedAt.Time,
+	}, nil
+}
+
+// applyOverrides patches the params of every operation of a given type.
+// A null value removes the param so the operation falls back to its default.
+func applyOverrides(ops []Operation, overrides map[string]map[string]any) ([]Operation, error) {
+	patched := make([]Operation, len(ops))
+	used := make(map[string]bool, len(overrides))
+	for i, op := range ops {
+		patched[i] = Operation{Type: op.Type, Params: maps.Clone(op.Params)}
+		patch, ok := overrides[op.Type]
+		if !ok {
+			continue
+		}
+		used[op.Type] = true
+		if patched[i].Params == nil {
+			patched[i].Params = make(map[string]any, len(patch))
+		}
+		for k, v := range patch {
+			if v == nil {
+				delete(patched[i].Params, k)
+				continue
+			}
+			patched[i].Params[k] = v
+		}
+	}
+
+	for opType := range overrides {
+		if !used[opType] {
+			return nil, fmt.Errorf("%w: no %q operation to override", errInvalidOverride, opType)
+		}
+	}
+	return patched, nil
+}
+
+// resolvePreset replaces the request's operations with those of the named
+// preset, overrides applied, and returns the preset so the version can be recorded
+func resolvePreset(ctx context.Context, queries *db.Queries, req *ProcessImageRequest) (*db.Preset, error) {
+	preset, err := queries.GetPresetByOwner(ctx, db.GetPresetByOwnerParams{
+		Email: req.Email,
+		Name:  req.Preset,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w %q", errUnknownPreset, req.Preset)
+		}
+		return nil, err
+	}
+
+	var ops []Operation
+	if err := json.Unmarshal(preset.Operations, &ops); err != nil {
+		return nil, fmt.Errorf("preset %q has corrupt operations: %w", preset.Name, err)
+	}
+	ops, err = applyOverrides(ops, req.Overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Operations = ops
+	return &preset, nil
+}
+
+// validatePresetOperations applies the same checks as image requests so a
+// preset can't be saved in a state that every job using it would reject
+func (h *PresetHandler) validatePresetOperations(ctx context.Context, ops []Operation) (int, error) {
+	if err := validateOperations("operations", ops); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := validateFonts(ctx, h.queries, ops); err != nil {
+		if errors.Is(err, errUnknownFont) {
+			return http.StatusBadRequest, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// CreatePreset stores a named pipeline for the user as version 1
+func (h *PresetHandler) CreatePreset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req CreatePresetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		h.log.Error().Err(err).Msg("Validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if code, err := h.validatePresetOperations(ctx, req.Operations); err != nil {
+		if code == http.StatusBadRequest {
+			helpers.RespondWithError(w, code, "Validation failed: "+err.Error())
+			return
+		}
+		h.log.Error().Err(err).Msg("Database error checking fonts")
+		helpers.RespondWithError(w, code, "Database error")
+		return
+	}
+
+	operations, err := json.Marshal(req.Operations)
+	if err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid operations: "+err.Error())
+		return
+	}
+
+	user, err := getOrCreateUser(ctx, h.log, h.queries, req.Email)
+	if err != nil {
+		h.log.Error().Err(err).Str("email", req.Email).Msg("Failed to get or create user")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+	var preset db.Preset
+	err = pgx.BeginFunc(ctx, h.dbpool, func(tx pgx.Tx) error {
+		qtx := h.queries.WithTx(tx)
+		var err error
+		preset, err = qtx.CreatePreset(ctx, db.CreatePresetParams{
+			UserID:     user.ID,
+			Name:       req.Name,
+			Operations: operations,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+		return qtx.CreatePresetVersion(ctx, db.CreatePresetVersionParams{
+			PresetID:   preset.ID,
+			Version:    preset.Version,
+			Operations: operations,
+			CreatedAt:  now,
+		})
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			helpers.RespondWithError(w, http.StatusConflict, "Preset already exists")
+			return
+		}
+		h.log.Error().Err(err).Str("preset", req.Name).Msg("Failed to create preset")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create preset")
+		return
+	}
+	h.log.Info().Int32("preset_id", preset.ID).Int32("user_id", user.ID).Str("preset", preset.Name).Msg("Preset created")
+
+	resp, err := presetResponse(preset)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode preset")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to read preset")
+		return
+	}
+	helpers.RespondWithJSON(w, http.StatusCreated, resp)
+}
+
+// ListPresets returns the live presets of the user given by the email query parameter
+func (h *PresetHandler) ListPresets(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email query parameter is required")
+		return
+	}
+
+	rows, err := h.queries.ListPresetsByOwner(r.Context(), email)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list presets")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	presets := make([]PresetResponse, 0, len(rows))
+	for _, p := range rows {
+		resp, err := presetResponse(p)
+		if err != nil {
+			h.log.Error().Err(err).Msg("Failed to decode preset")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to read presets")
+			return
+		}
+		presets = append(presets, resp)
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, presets)
+}
+
+// GetPreset returns the current version of a preset, or an earlier one with ?version=N
+func (h *PresetHandler) GetPreset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	preset, ok := h.lookupPreset(w, r, r.URL.Query().Get("email"))
+	if !ok {
+		return
+	}
+
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || version < 1 {
+			helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: version must be a positive integer")
+			return
+		}
+		pv, err := h.queries.GetPresetVersion(ctx, db.GetPresetVersionParams{
+			PresetID: preset.ID,
+			Version:  int32(version),
+		})
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				helpers.RespondWithError(w, http.StatusNotFound, "Preset version not found")
+				return
+			}
+			h.log.Error().Err(err).Msg("Failed to get preset version")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		preset.Version = pv.Version
+		preset.Operations = pv.Operations
+		preset.UpdatedAt = pv.CreatedAt
+	}
+
+	resp, err := presetResponse(preset)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode preset")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to read preset")
+		return
+	}
+	helpers.RespondWithJSON(w, http.StatusOK, resp)
+}
+
+// UpdatePreset replaces a preset's operations as a new version. Images
+// processed earlier keep pointing at the version they used.
+func (h *PresetHandler) UpdatePreset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req UpdatePresetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		h.log.Error().Err(err).Msg("Validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if code, err := h.validatePresetOperations(ctx, req.Operations); err != nil {
+		if code == http.StatusBadRequest {
+			helpers.RespondWithError(w, code, "Validation failed: "+err.Error())
+			return
+		}
+		h.log.Error().Err(err).Msg("Database error checking fonts")
+		helpers.RespondWithError(w, code, "Database error")
+		return
+	}
+
+	operations, err := json.Marshal(req.Operations)
+	if err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid operations: "+err.Error())
+		return
+	}
+
+	current, ok := h.lookupPreset(w, r, req.Email)
+	if !ok {
+		return
+	}
+
+	now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+	var preset db.Preset
+	err = pgx.BeginFunc(ctx, h.dbpool, func(tx pgx.Tx) error {
+		qtx := h.queries.WithTx(tx)
+		var err error
+		preset, err = qtx.UpdatePresetOperations(ctx, db.UpdatePresetOperationsParams{
+			ID:         current.ID,
+			Operations: operations,
+			UpdatedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+		return qtx.CreatePresetVersion(ctx, db.CreatePresetVersionParams{
+			PresetID:   preset.ID,
+			Version:    preset.Version,
+			Operations: operations,
+			CreatedAt:  now,
+		})
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Deleted between the lookup and the update
+			helpers.RespondWithError(w, http.StatusNotFound, "Preset not found")
+			return
+		}
+		h.log.Error().Err(err).Int32("preset_id", current.ID).Msg("Failed to update preset")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to update preset")
+		return
+	}
+	h.log.Info().Int32("preset_id", preset.ID).Int32("version", preset.Version).Msg("Preset updated")
+
+	resp, err := presetResponse(preset)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode preset")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to read preset")
+		return
+	}
+	helpers.RespondWithJSON(w, http.StatusOK, resp)
+}
+
+// DeletePreset retires a preset. Its versions are kept for the images that used them.
+func (h *PresetHandler) DeletePreset(w http.ResponseWriter, r *http.Request) {
+	preset, ok := h.lookupPreset(w, r, r.URL.Query().Get("email"))
+	if !ok {
+		return
+	}
+
+	err := h.queries.DeletePreset(r.Context(), db.DeletePresetParams{
+		ID:        preset.ID,
+		DeletedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Int32("preset_id", preset.ID).Msg("Failed to delete preset")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to delete preset")
+		return
+	}
+	h.log.Info().Int32("preset_id", preset.ID).Str("preset", preset.Name).Msg("Preset deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookupPreset loads the live preset named in the URL for the given owner,
+// writing the error response itself when it can't
+func (h *PresetHandler) lookupPreset(w http.ResponseWriter, r *http.Request, email string) (db.Preset, bool) {
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email is required")
+		return db.Preset{}, false
+	}
+
+	preset, err := h.queries.GetPresetByOwner(r.Context(), db.GetPresetByOwnerParams{
+		Email: email,
+		Name:  chi.URLParam(r, "name"),
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			helpers.RespondWithError(w, http.StatusNotFound, "Preset not found")
+			return db.Preset{}, false
+		}
+		h.log.Error().Err(err).Msg("Failed to get preset")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return db.Preset{}, false
+	}
+	return preset, true
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"imagepp/internal/config"
 	"imagepp/internal/db"
+	"imagepp/internal/events"
 	custommiddleware "imagepp/internal/middleware"
 	"imagepp/internal/scheduler"
 	"net/http"
@@ -30,10 +31,32 @@ func NewRouter(log zerolog.Logger, cfg *config.Config, dbpool *pgxpool.Pool, red
 	r.Get("/health", health.Check)
 
 	// Image processing routes
-	imageHandler := NewImageHandler(log, queries, scheduler)
+	imageHandler := NewImageHandler(log, dbpool, queries, scheduler, events.NewBroker(redis), cfg.LogoBuckets, cfg.OutputBuckets)
+	fontHandler := NewFontHandler(log, queries, cfg.FontBuckets)
+	presetHandler := NewPresetHandler(log, dbpool, queries)
+	webhookHandler := NewWebhookHandler(log, dbpool, queries, scheduler)
+	batchHandler := NewBatchHandler(log, dbpool, queries, scheduler, cfg.BatchMaxInFlight, cfg.LogoBuckets, cfg.OutputBuckets)
 	r.Route("/api", func(r chi.Router) {
-		r.Post("/image", imageHandler.ProcessImage)
-		//r.Get("/image-status", imageHandler.GetStatus)
+		r.With(custommiddleware.Idempotency(log, queries, cfg.IdempotencyTTL)).Post("/image", imageHandler.ProcessImage)
+		r.Get("/image/{id}", imageHandler.GetStatus)
+		r.Get("/image/{id}/events", imageHandler.StreamEvents)
+		r.Post("/image/{id}/cancel", imageHandler.CancelImage)
+		r.Post("/image/{id}/retry", imageHandler.RetryImage)
+		r.With(custommiddleware.Idempotency(log, queries, cfg.IdempotencyTTL)).Post("/batches", batchHandler.CreateBatch)
+		r.Get("/batches/{id}", batchHandler.GetBatch)
+		r.Post("/fonts", fontHandler.RegisterFont)
+		r.Get("/fonts", fontHandler.ListFonts)
+		r.Delete("/fonts/{name}", fontHandler.DeleteFont)
+		r.Post("/presets", presetHandler.CreatePreset)
+		r.Get("/presets", presetHandler.ListPresets)
+		r.Get("/presets/{name}", presetHandler.GetPreset)
+		r.Put("/presets/{name}", presetHandler.UpdatePreset)
+		r.Delete("/presets/{name}", presetHandler.DeletePreset)
+		r.Post("/webhooks", webhookHandler.CreateWebhook)
+		r.Get("/webhooks", webhookHandler.ListWebhooks)
+		r.Delete("/webhooks/{id}", webhookHandler.DeleteWebhook)
+		r.Get("/webhooks/deliveries", webhookHandler.ListDeliveries)
+		r.Post("/webhooks/deliveries/{id}/redeliver", webhookHandler.RedeliverWebhook)
 		//r.Get("/user/{email}/images", imageHandler.GetUserImages)
 	})
 
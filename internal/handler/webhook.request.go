@@ -0,0 +1,379 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"imagepp/internal/db"
+	Job "imagepp/internal/jobs"
+	"imagepp/internal/scheduler"
+	"imagepp/pkg/helpers"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// maxWebhooksPerUser bounds the deliveries queued for every image event
+	maxWebhooksPerUser = 10
+	// maxListedDeliveries is how many of the latest deliveries are listed
+	maxListedDeliveries = 100
+)
+
+type WebhookHandler struct {
+	log       zerolog.Logger
+	dbpool    *pgxpool.Pool
+	queries   *db.Queries
+	scheduler *scheduler.Client
+}
+
+func NewWebhookHandler(log zerolog.Logger, dbpool *pgxpool.Pool, queries *db.Queries, scheduler *scheduler.Client) *WebhookHandler {
+	return &WebhookHandler{
+		log:       log,
+		dbpool:    dbpool,
+		queries:   queries,
+		scheduler: scheduler,
+	}
+}
+
+// CreateWebhookRequest registers an endpoint for every image event of the
+// user. A secret is generated when none is given.
+type CreateWebhookRequest struct {
+	Email  string `json:"email" validate:"required,email"`
+	URL    string `json:"url" validate:"required,http_url,max=2048"`
+	Secret string `json:"secret,omitempty" validate:"omitempty,min=16,max=256"`
+}
+
+type RedeliverWebhookRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// WebhookResponse describes a webhook. The secret is only returned when the
+// webhook is created.
+type WebhookResponse struct {
+	ID        int32     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDeliveryResponse struct {
+	ID             int64           `json:"id"`
+	ImageID        int32           `json:"image_id,omitempty"`
+	BatchID        int32           `json:"batch_id,omitempty"`
+	Source         string          `json:"source"`
+	WebhookID      int32           `json:"webhook_id,omitempty"`
+	Event          string          `json:"event"`
+	URL            string          `json:"url"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int32           `json:"attempts"`
+	ResponseStatus int32           `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	RedeliveryOf   int64           `json:"redelivery_of,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+func webhookDeliveryResponse(d db.WebhookDelivery) WebhookDeliveryResponse {
+	resp := WebhookDeliveryResponse{
+		ID:             d.ID,
+		ImageID:        d.ImageID.Int32,
+		BatchID:        d.BatchID.Int32,
+		Source:         d.Source,
+		WebhookID:      d.WebhookID.Int32,
+		Event:          d.Event,
+		URL:            d.Url,
+		Payload:        d.Payload,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		ResponseStatus: d.ResponseStatus.Int32,
+		LastError:      d.LastError.String,
+		RedeliveryOf:   d.RedeliveryOf.Int64,
+		CreatedAt:      d.CreatedAt.Time,
+	}
+	if d.DeliveredAt.Valid {
+		resp.DeliveredAt = &d.DeliveredAt.Time
+	}
+	return resp
+}
+
+// newWebhookSecret returns 32 random bytes, hex encoded
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateWebhook registers an endpoint that is sent image.completed and
+// image.failed events for all of the user's images
+func (h *WebhookHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		h.log.Error().Err(err).Msg("Validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+	if err := validateCallbackURL(ctx, "url", req.URL); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	user, err := getOrCreateUser(ctx, h.log, h.queries, req.Email)
+	if err != nil {
+		h.log.Error().Err(err).Str("email", req.Email).Msg("Failed to get or create user")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	existing, err := h.queries.ListWebhooksByUserID(ctx, user.ID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list webhooks")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		helpers.RespondWithError(w, http.StatusConflict, "Webhook limit reached, delete one first")
+		return
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = newWebhookSecret(); err != nil {
+			h.log.Error().Err(err).Msg("Failed to generate webhook secret")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create webhook")
+			return
+		}
+	}
+
+	webhook, err := h.queries.CreateWebhook(ctx, db.CreateWebhookParams{
+		UserID:    user.ID,
+		Url:       req.URL,
+		Secret:    secret,
+		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to create webhook")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+	h.log.Info().Int32("webhook_id", webhook.ID).Int32("user_id", user.ID).Msg("Webhook created")
+
+	helpers.RespondWithJSON(w, http.StatusCreated, WebhookResponse{
+		ID:        webhook.ID,
+		URL:       webhook.Url,
+		Secret:    webhook.Secret,
+		CreatedAt: webhook.CreatedAt.Time,
+	})
+}
+
+// ListWebhooks returns the webhooks of the user given by the email query parameter
+func (h *WebhookHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email query parameter is required")
+		return
+	}
+
+	rows, err := h.queries.ListWebhooksByOwner(r.Context(), email)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list webhooks")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	webhooks := make([]WebhookResponse, 0, len(rows))
+	for _, wh := range rows {
+		webhooks = append(webhooks, WebhookResponse{
+			ID:        wh.ID,
+			URL:       wh.Url,
+			CreatedAt: wh.CreatedAt.Time,
+		})
+	}
+	helpers.RespondWithJSON(w, http.StatusOK, webhooks)
+}
+
+// DeleteWebhook removes a webhook. Its pending deliveries fail on their next attempt.
+func (h *WebhookHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil || id < 1 {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid webhook id")
+		return
+	}
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email is required")
+		return
+	}
+
+	n, err := h.queries.DeleteWebhook(r.Context(), db.DeleteWebhookParams{
+		ID:    int32(id),
+		Email: email,
+	})
+	if err != nil {
+		h.log.Error().Err(err).Int64("webhook_id", id).Msg("Failed to delete webhook")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+	if n == 0 {
+		helpers.RespondWithError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	h.log.Info().Int64("webhook_id", id).Msg("Webhook deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveries returns the latest deliveries of the user given by the
+// email query parameter, optionally only those of ?image_id=N
+func (h *WebhookHandler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if err := validate.Var(email, "required,email"); err != nil {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: email query parameter is required")
+		return
+	}
+
+	var imageID int64
+	if v := r.URL.Query().Get("image_id"); v != "" {
+		var err error
+		imageID, err = strconv.ParseInt(v, 10, 32)
+		if err != nil || imageID < 1 {
+			helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: image_id must be a positive integer")
+			return
+		}
+	}
+
+	rows, err := h.queries.ListWebhookDeliveriesByOwner(r.Context(), db.ListWebhookDeliveriesByOwnerParams{
+		Email:         email,
+		ImageID:       int32(imageID),
+		MaxDeliveries: maxListedDeliveries,
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list webhook deliveries")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	deliveries := make([]WebhookDeliveryResponse, 0, len(rows))
+	for _, d := range rows {
+		deliveries = append(deliveries, webhookDeliveryResponse(d))
+	}
+	helpers.RespondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// RedeliverWebhook sends the body of a finished delivery again as a new
+// delivery. Webhook deliveries go to the webhook's current URL.
+func (h *WebhookHandler) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid delivery id")
+		return
+	}
+
+	var req RedeliverWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.log.Error().Err(err).Msg("Failed to decode request")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validate.Struct(req); err != nil {
+		h.log.Error().Err(err).Msg("Validation failed")
+		helpers.RespondWithError(w, http.StatusBadRequest, "Validation failed: "+err.Error())
+		return
+	}
+
+	original, err := h.queries.GetWebhookDeliveryByOwner(ctx, db.GetWebhookDeliveryByOwnerParams{
+		ID:    id,
+		Email: req.Email,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			helpers.RespondWithError(w, http.StatusNotFound, "Delivery not found")
+			return
+		}
+		h.log.Error().Err(err).Int64("delivery_id", id).Msg("Failed to load delivery")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if original.Status == "pending" {
+		helpers.RespondWithError(w, http.StatusConflict, "Delivery is still being attempted")
+		return
+	}
+
+	url := original.Url
+	if original.Source == Job.WebhookSourceWebhook {
+		if !original.WebhookID.Valid {
+			helpers.RespondWithError(w, http.StatusConflict, "Webhook was deleted")
+			return
+		}
+		webhook, err := h.queries.GetWebhookByID(ctx, original.WebhookID.Int32)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				helpers.RespondWithError(w, http.StatusConflict, "Webhook was deleted")
+				return
+			}
+			h.log.Error().Err(err).Int64("delivery_id", id).Msg("Failed to load webhook")
+			helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		url = webhook.Url
+	}
+
+	var delivery db.WebhookDelivery
+	var entry db.JobOutbox
+	err = pgx.BeginFunc(ctx, h.dbpool, func(tx pgx.Tx) error {
+		qtx := h.queries.WithTx(tx)
+		var err error
+		delivery, err = qtx.CreateWebhookDelivery(ctx, db.CreateWebhookDeliveryParams{
+			UserID:       original.UserID,
+			ImageID:      original.ImageID,
+			BatchID:      original.BatchID,
+			Source:       original.Source,
+			WebhookID:    original.WebhookID,
+			Event:        original.Event,
+			Url:          url,
+			Payload:      original.Payload,
+			RedeliveryOf: pgtype.Int8{Int64: original.ID, Valid: true},
+			CreatedAt:    pgtype.Timestamp{Time: time.Now(), Valid: true},
+		})
+		if err != nil {
+			return err
+		}
+		entry, err = Job.CreateWebhookOutboxEntry(ctx, qtx, delivery.ID)
+		return err
+	})
+	if err != nil {
+		h.log.Error().Err(err).Int64("delivery_id", id).Msg("Failed to create redelivery")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Failed to create redelivery")
+		return
+	}
+	h.log.Info().Int64("delivery_id", delivery.ID).Int64("redelivery_of", original.ID).Msg("Webhook redelivery queued")
+
+	if err := Job.DispatchOutboxEntry(ctx, h.queries, h.scheduler, entry); err != nil {
+		h.log.Warn().Err(err).Int64("delivery_id", delivery.ID).Msg("Failed to enqueue redelivery, leaving it to the outbox relay")
+	}
+
+	helpers.RespondWithJSON(w, http.StatusAccepted, webhookDeliveryResponse(delivery))
+}
@@ -0,0 +1,57 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"imagepp/internal/db"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const TypeBatchIngest = "batch:ingest"
+
+// DefaultIngestExtensions are the extensions ingested when a prefix batch
+// doesn't list any, the formats the worker can decode
+var DefaultIngestExtensions = []string{"jpg", "jpeg", "png", "gif", "bmp", "tif", "tiff", "webp"}
+
+// BatchIngest is the payload of the coordinator task that lists the objects
+// under a prefix and adds them to a batch. Where the listing got to is kept
+// on the batch, so a retried task resumes instead of starting over.
+type BatchIngest struct {
+	BatchID       int64      `json:"batch_id"`
+	Prefix        string     `json:"prefix"`
+	Extensions    []string   `json:"extensions"` // lowercase, without the dot
+	MinSize       int64      `json:"min_size,omitempty"`
+	MaxSize       int64      `json:"max_size,omitempty"`
+	ModifiedSince *time.Time `json:"modified_since,omitempty"`
+	MaxObjects    int32      `json:"max_objects"`
+
+	// Job is the job of every item, ImageID and ImageKey are set per object
+	Job           Job   `json:"job"`
+	PresetID      int32 `json:"preset_id,omitempty"`
+	PresetVersion int32 `json:"preset_version,omitempty"`
+}
+
+// BatchIngestTaskID is the asynq task ID of a batch's coordinator task
+func BatchIngestTaskID(batchID int64) string {
+	return fmt.Sprintf("batch:%d:ingest", batchID)
+}
+
+// CreateBatchIngestOutboxEntry records the coordinator task of a batch.
+// Call it in the transaction that creates the batch.
+func CreateBatchIngestOutboxEntry(ctx context.Context, queries *db.Queries, p BatchIngest) (db.JobOutbox, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return db.JobOutbox{}, err
+	}
+	return queries.CreateOutboxEntry(ctx, db.CreateOutboxEntryParams{
+		TaskType:  TypeBatchIngest,
+		TaskID:    BatchIngestTaskID(p.BatchID),
+		Queue:     "default",
+		Payload:   payload,
+		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+}
@@ -1,42 +1,92 @@
 package jobs
 
-import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"time"
-
-	"imagepp/internal/scheduler"
-
-	"github.com/hibiken/asynq"
-)
+import "time"
 
 const (
-	TypeImageProcess = "process:image"
+	TypeImageProcess    = "process:image"
+	TypeReapStuckImages = "maintenance:reap_stuck_images"
 )
 
+// PipelineVersion identifies how the worker interprets operations. Bump it
+// when a change to the pipeline makes the same operations produce different
+// outputs; it is recorded on every image and part of the result cache key.
+const PipelineVersion = 1
+
+// DefaultOutput names the single output of a job that declares no variants
+const DefaultOutput = "default"
+
+// Output is a named variant produced from the shared result of a job's
+// operations, with its own tail of operations and encode settings
+type Output struct {
+	Name       string           `json:"name"`
+	Operations []map[string]any `json:"operations,omitempty"`
+}
+
+// Destination is where outputs are written. An empty bucket means the
+// source bucket, an empty template the historical processed/ keys.
+type Destination struct {
+	BucketName  string `json:"bucket_name,omitempty"`
+	KeyTemplate string `json:"key_template,omitempty"`
+}
+
 type Job struct {
-	ImageID    int64            `json:"image_id"`
-	UserID     int64            `json:"user_id"`
-	BucketName string           `json:"bucket_name"`
-	ImageKey   string           `json:"image_key"`
-	Operations []map[string]any `json:"operations"`
-}
-
-func EnqueueImageJob(ctx context.Context, client any, job Job) error {
-	payload, err := json.Marshal(job)
-	if err != nil {
-		return err
-	}
-
-	switch c := client.(type) {
-	case *scheduler.Client:
-		return c.Enqueue(ctx, TypeImageProcess, payload,
-			asynq.MaxRetry(3),
-			asynq.Timeout(10*time.Minute),
-			asynq.Queue("critical"),
-		)
-	default:
-		return fmt.Errorf("unsupported client type: %T", client)
-	}
+	ImageID      int64            `json:"image_id"`
+	UserID       int64            `json:"user_id"`
+	BucketName   string           `json:"bucket_name"`
+	ImageKey     string           `json:"image_key"`
+	Operations   []map[string]any `json:"operations"`
+	Metadata     string           `json:"metadata,omitempty"`
+	ColorProfile string           `json:"color_profile,omitempty"`
+	Outputs      []Output         `json:"outputs,omitempty"`
+	Destination  *Destination     `json:"destination,omitempty"`
+	SkipCache    bool             `json:"skip_cache,omitempty"`
+}
+
+// TaskProgress is the task result while an image job runs. It is rewritten
+// after every step of the pipeline.
+type TaskProgress struct {
+	State      string `json:"state"` // always "running"
+	ImageID    int64  `json:"image_id"`
+	StepIndex  int    `json:"step_index"` // 1-based index of the step that just finished
+	TotalSteps int    `json:"total_steps"`
+	Step       string `json:"step"` // decode, operation or output
+	Operation  string `json:"operation,omitempty"`
+	Output     string `json:"output,omitempty"`
+	ElapsedMs  int64  `json:"elapsed_ms"`
+}
+
+// TaskResult is the task result of a completed image job
+type TaskResult struct {
+	State    string         `json:"state"` // always "completed"
+	ImageID  int64          `json:"image_id"`
+	CacheHit bool           `json:"cache_hit"`
+	Outputs  []ResultOutput `json:"outputs"`
+	TotalMs  int64          `json:"total_ms"`
+	Steps    []StepTiming   `json:"steps,omitempty"`
+}
+
+// ResultOutput describes one output written for an image
+type ResultOutput struct {
+	Variant    string `json:"variant"`
+	BucketName string `json:"bucket_name"`
+	Key        string `json:"key"`
+	Format     string `json:"format"`
+	Width      int32  `json:"width"`
+	Height     int32  `json:"height"`
+	SizeBytes  int64  `json:"size_bytes"`
+}
+
+// StepTiming is how long one step of an image job took
+type StepTiming struct {
+	Step       string `json:"step"`
+	Operation  string `json:"operation,omitempty"`
+	Output     string `json:"output,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// ReapStuckImages is the payload of the periodic reaper task. Images are
+// considered stuck once they stayed in a status longer than its threshold.
+type ReapStuckImages struct {
+	PendingAfter    time.Duration `json:"pending_after"`
+	ProcessingAfter time.Duration `json:"processing_after"`
 }
@@ -0,0 +1,166 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"imagepp/internal/db"
+	"imagepp/internal/scheduler"
+
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+const (
+	outboxBatchSize = 100
+	// outboxMaxBackoff caps the delay between attempts, so entries go out
+	// shortly after Redis comes back
+	outboxMaxBackoff = time.Minute
+	// outboxRetention is how long dispatched entries are kept for debugging
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// taskOptions are the asynq options for each task type relayed through the outbox
+var taskOptions = map[string][]asynq.Option{
+	TypeImageProcess: {
+		asynq.MaxRetry(3),
+		asynq.Timeout(10 * time.Minute),
+		// Completed tasks keep their TaskResult around for the inspector
+		asynq.Retention(24 * time.Hour),
+	},
+	TypeWebhookDeliver: {
+		asynq.MaxRetry(webhookMaxRetry),
+		asynq.Timeout(time.Minute),
+	},
+	// A retried listing resumes where the last attempt stopped
+	TypeBatchIngest: {
+		asynq.MaxRetry(5),
+		asynq.Timeout(30 * time.Minute),
+	},
+}
+
+// ImageTaskID is the asynq task ID of an attempt at processing an image.
+// Every manual retry is a new attempt, asynq keeps archived tasks by ID.
+func ImageTaskID(imageID int64, attempt int32) string {
+	if attempt <= 1 {
+		return fmt.Sprintf("image:%d", imageID)
+	}
+	return fmt.Sprintf("image:%d:%d", imageID, attempt)
+}
+
+// CreateImageOutboxEntry records the processing task of an image attempt.
+// Call it in the transaction that creates or updates the image row.
+func CreateImageOutboxEntry(ctx context.Context, queries *db.Queries, job Job, attempt int32) (db.JobOutbox, error) {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return db.JobOutbox{}, err
+	}
+	return queries.CreateOutboxEntry(ctx, db.CreateOutboxEntryParams{
+		TaskType:  TypeImageProcess,
+		TaskID:    ImageTaskID(job.ImageID, attempt),
+		Queue:     "critical",
+		Payload:   payload,
+		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+}
+
+// DispatchOutboxEntry enqueues an outbox entry and marks it dispatched.
+// Enqueueing is keyed by the entry's task ID, so an entry dispatched twice
+// (by the API right after commit and by a relay) runs once.
+func DispatchOutboxEntry(ctx context.Context, queries *db.Queries, client *scheduler.Client, entry db.JobOutbox) error {
+	opts := append([]asynq.Option{
+		asynq.TaskID(entry.TaskID),
+		asynq.Queue(entry.Queue),
+	}, taskOptions[entry.TaskType]...)
+
+	err := client.Enqueue(ctx, entry.TaskType, entry.Payload, opts...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue outbox entry %d: %w", entry.ID, err)
+	}
+
+	return queries.MarkOutboxDispatched(ctx, db.MarkOutboxDispatchedParams{
+		ID:           entry.ID,
+		DispatchedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+}
+
+// RunOutboxRelay dispatches pending outbox entries every interval until ctx
+// is done. Failed entries are retried with exponential backoff.
+func RunOutboxRelay(ctx context.Context, log zerolog.Logger, dbpool *pgxpool.Pool, client *scheduler.Client, interval time.Duration) {
+	queries := db.New(dbpool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPurge := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := relayOutboxBatch(ctx, dbpool, queries, client)
+		if err != nil {
+			log.Error().Err(err).Msg("Outbox relay failed")
+		} else if n > 0 {
+			log.Info().Int("dispatched", n).Msg("Relayed outbox entries")
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			lastPurge = time.Now()
+			cutoff := pgtype.Timestamp{Time: time.Now().Add(-outboxRetention), Valid: true}
+			if _, err := queries.DeleteDispatchedOutboxEntries(ctx, cutoff); err != nil {
+				log.Error().Err(err).Msg("Failed to purge dispatched outbox entries")
+			}
+		}
+	}
+}
+
+// relayOutboxBatch dispatches one batch of due entries and returns how many
+// went out. It stops at the first failure: when Redis is down every other
+// entry would fail the same way.
+func relayOutboxBatch(ctx context.Context, dbpool *pgxpool.Pool, queries *db.Queries, client *scheduler.Client) (int, error) {
+	dispatched := 0
+	var dispatchErr error
+	err := pgx.BeginFunc(ctx, dbpool, func(tx pgx.Tx) error {
+		qtx := queries.WithTx(tx)
+		entries, err := qtx.LockPendingOutboxEntries(ctx, db.LockPendingOutboxEntriesParams{
+			NextAttemptAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+			Limit:         outboxBatchSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if dispatchErr = DispatchOutboxEntry(ctx, qtx, client, entry); dispatchErr != nil {
+				// Returning nil commits the failure so its backoff applies
+				return qtx.RecordOutboxFailure(ctx, db.RecordOutboxFailureParams{
+					ID:            entry.ID,
+					LastError:     pgtype.Text{String: dispatchErr.Error(), Valid: true},
+					NextAttemptAt: pgtype.Timestamp{Time: time.Now().Add(outboxBackoff(entry.Attempts)), Valid: true},
+				})
+			}
+			dispatched++
+		}
+		return nil
+	})
+	if err != nil {
+		return dispatched, err
+	}
+	return dispatched, dispatchErr
+}
+
+// outboxBackoff returns the delay before the next attempt of an entry
+func outboxBackoff(attempts int32) time.Duration {
+	if attempts > 6 {
+		return outboxMaxBackoff
+	}
+	return min(time.Second<<attempts, outboxMaxBackoff)
+}
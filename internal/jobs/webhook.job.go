@@ -0,0 +1,101 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"imagepp/internal/db"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const TypeWebhookDeliver = "webhook:deliver"
+
+// Events sent to callbacks and webhooks
+const (
+	EventImageCompleted = "image.completed"
+	EventImageFailed    = "image.failed"
+	EventBatchCompleted = "batch.completed"
+)
+
+// Where a delivery goes: the callback_url of its image or batch, or a
+// registered webhook
+const (
+	WebhookSourceCallback = "callback"
+	WebhookSourceWebhook  = "webhook"
+)
+
+const (
+	// webhookMaxRetry and the delays of WebhookRetryDelay give an endpoint
+	// about four hours to come back
+	webhookMaxRetry      = 8
+	webhookBaseDelay     = 30 * time.Second
+	webhookMaxRetryDelay = 2 * time.Hour
+)
+
+// WebhookDelivery is the payload of a delivery task. The body and target are
+// kept on the delivery row, so a redelivery is a new row and a new task.
+type WebhookDelivery struct {
+	DeliveryID int64 `json:"delivery_id"`
+}
+
+// WebhookEvent is the JSON body POSTed to callbacks and webhooks
+type WebhookEvent struct {
+	Event         string         `json:"event"`
+	OccurredAt    time.Time      `json:"occurred_at"`
+	ImageID       int64          `json:"image_id"`
+	BucketName    string         `json:"bucket_name"`
+	ImageKey      string         `json:"image_key"`
+	Status        string         `json:"status"`
+	FailureReason string         `json:"failure_reason,omitempty"`
+	Outputs       []ResultOutput `json:"outputs,omitempty"`
+}
+
+// BatchEvent is the body of batch events, Counts has the number of items
+// in each final status
+type BatchEvent struct {
+	Event      string           `json:"event"`
+	OccurredAt time.Time        `json:"occurred_at"`
+	BatchID    int64            `json:"batch_id"`
+	Status     string           `json:"status"`
+	TotalItems int32            `json:"total_items"`
+	Counts     map[string]int32 `json:"counts"`
+
+	// Prefix batches: objects skipped because they were processed before,
+	// and whether listing stopped at max_objects or on an error
+	SkippedItems int32  `json:"skipped_items,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+	ListingError string `json:"listing_error,omitempty"`
+}
+
+// WebhookTaskID is the asynq task ID of a delivery
+func WebhookTaskID(deliveryID int64) string {
+	return fmt.Sprintf("webhook:%d", deliveryID)
+}
+
+// WebhookRetryDelay returns the delay before retry n of a delivery, doubling
+// from 30s
+func WebhookRetryDelay(n int) time.Duration {
+	if n > 8 {
+		return webhookMaxRetryDelay
+	}
+	return min(webhookBaseDelay<<n, webhookMaxRetryDelay)
+}
+
+// CreateWebhookOutboxEntry records the task of a delivery. Call it in the
+// transaction that creates the delivery.
+func CreateWebhookOutboxEntry(ctx context.Context, queries *db.Queries, deliveryID int64) (db.JobOutbox, error) {
+	payload, err := json.Marshal(WebhookDelivery{DeliveryID: deliveryID})
+	if err != nil {
+		return db.JobOutbox{}, err
+	}
+	return queries.CreateOutboxEntry(ctx, db.CreateOutboxEntryParams{
+		TaskType:  TypeWebhookDeliver,
+		TaskID:    WebhookTaskID(deliveryID),
+		Queue:     "default",
+		Payload:   payload,
+		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+}
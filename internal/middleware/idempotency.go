@@ -0,0 +1,216 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+
+	"imagepp/internal/db"
+	"imagepp/pkg/helpers"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marks responses replayed from an earlier request
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodySize   = 1 << 20
+
+	// idempotencyClaimLease is how long a claim without a stored response
+	// holds its key. Requests finish well within it; a claim older than that
+	// was left by a process that died mid-request.
+	idempotencyClaimLease = 5 * time.Minute
+)
+
+// Idempotency makes retries of a request carrying an Idempotency-Key header
+// safe. The first successful response is stored for ttl and replayed to
+// retries with the same body. Reusing a key with a different body, or while
+// the first request is still running, is rejected with 409.
+//
+// Keys are scoped to the method, path and caller (the email of the JSON
+// body), so clients that happen to pick the same key never see each other's
+// responses. Failed requests release their key so that the client can retry
+// them.
+func Idempotency(log zerolog.Logger, queries *db.Queries, ttl time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				helpers.RespondWithError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+			if err != nil {
+				helpers.RespondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			sum := sha256.Sum256(body)
+			hash := hex.EncodeToString(sum[:])
+			scope := idempotencyScope(r, body)
+			now := time.Now()
+
+			// The outcome is recorded even if the client gives up waiting,
+			// that is exactly the case the key protects against
+			ctx := context.WithoutCancel(r.Context())
+
+			claimed, err := queries.ClaimIdempotencyKey(ctx, db.ClaimIdempotencyKeyParams{
+				Scope:       scope,
+				Key:         key,
+				RequestHash: hash,
+				CreatedAt:   pgtype.Timestamp{Time: now, Valid: true},
+				ExpiresAt:   pgtype.Timestamp{Time: now.Add(ttl), Valid: true},
+
+				ClaimedBefore: pgtype.Timestamp{Time: now.Add(-idempotencyClaimLease), Valid: true},
+			})
+			if err != nil {
+				log.Error().Err(err).Str("idempotency_key", key).Msg("Failed to claim idempotency key")
+				helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+				return
+			}
+			if claimed == 0 {
+				replayIdempotentResponse(ctx, w, log, queries, scope, key, hash)
+				return
+			}
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				if err := queries.ReleaseIdempotencyKey(ctx, db.ReleaseIdempotencyKeyParams{
+					Scope: scope,
+					Key:   key,
+				}); err != nil {
+					log.Error().Err(err).Str("idempotency_key", key).Msg("Failed to release idempotency key")
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+
+			if rec.status < 200 || rec.status >= 300 {
+				return
+			}
+			if err := queries.CompleteIdempotencyKey(ctx, db.CompleteIdempotencyKeyParams{
+				Scope:        scope,
+				Key:          key,
+				StatusCode:   pgtype.Int4{Int32: int32(rec.status), Valid: true},
+				ResponseBody: rec.body.Bytes(),
+			}); err != nil {
+				// Leave the key claimed, releasing it would let a retry
+				// create a duplicate of the request that just succeeded
+				log.Error().Err(err).Str("idempotency_key", key).Msg("Failed to store idempotent response")
+			}
+			completed = true
+		})
+	}
+}
+
+// idempotencyScope identifies the endpoint and the caller a key belongs to.
+// Callers are identified by the email of the request body; the email is
+// hashed to keep the scope within its column.
+func idempotencyScope(r *http.Request, body []byte) string {
+	var caller struct {
+		Email string `json:"email"`
+	}
+	// A body that isn't JSON is rejected by the handler, it gets a scope
+	// of its own here
+	_ = json.Unmarshal(body, &caller)
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(caller.Email))))
+	return r.Method + " " + r.URL.Path + " " + hex.EncodeToString(sum[:])
+}
+
+// replayIdempotentResponse answers a request whose key was already claimed
+func replayIdempotentResponse(ctx context.Context, w http.ResponseWriter, log zerolog.Logger, queries *db.Queries, scope, key, hash string) {
+	existing, err := queries.GetIdempotencyKey(ctx, db.GetIdempotencyKeyParams{
+		Scope: scope,
+		Key:   key,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Released by a failed request between our claim and this read
+			helpers.RespondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress, retry later")
+			return
+		}
+		log.Error().Err(err).Str("idempotency_key", key).Msg("Failed to load idempotency key")
+		helpers.RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	switch {
+	case existing.RequestHash != hash:
+		helpers.RespondWithError(w, http.StatusConflict, "Idempotency-Key was already used with a different request body")
+	case !existing.StatusCode.Valid:
+		helpers.RespondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress, retry later")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(IdempotentReplayedHeader, "true")
+		w.WriteHeader(int(existing.StatusCode.Int32))
+		w.Write(existing.ResponseBody)
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// PurgeExpiredIdempotencyKeys deletes expired keys every interval until ctx
+// is done. Expired keys are also reclaimed on use, this only bounds the table.
+func PurgeExpiredIdempotencyKeys(ctx context.Context, log zerolog.Logger, queries *db.Queries, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := queries.DeleteExpiredIdempotencyKeys(ctx, pgtype.Timestamp{Time: time.Now(), Valid: true})
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to purge expired idempotency keys")
+				continue
+			}
+			if n > 0 {
+				log.Info().Int64("deleted", n).Msg("Purged expired idempotency keys")
+			}
+		}
+	}
+}
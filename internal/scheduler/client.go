@@ -8,18 +8,24 @@ import (
 
 // Client wraps asynq.Client for task scheduling
 type Client struct {
-	client *asynq.Client
+	client    *asynq.Client
+	inspector *asynq.Inspector
 }
 
 // NewClient creates a new scheduler client
 func NewClient(redisOpt asynq.RedisClientOpt) *Client {
 	return &Client{
-		client: asynq.NewClient(redisOpt),
+		client:    asynq.NewClient(redisOpt),
+		inspector: asynq.NewInspector(redisOpt),
 	}
 }
 
 // Close closes the client connection
 func (c *Client) Close() error {
+	if err := c.inspector.Close(); err != nil {
+		c.client.Close()
+		return err
+	}
 	return c.client.Close()
 }
 
@@ -29,3 +35,19 @@ func (c *Client) Enqueue(ctx context.Context, taskType string, payload []byte, o
 	_, err := c.client.EnqueueContext(ctx, task, opts...)
 	return err
 }
+
+// TaskInfo returns the state of a task. It returns asynq.ErrTaskNotFound or
+// asynq.ErrQueueNotFound for tasks that are no longer known to asynq.
+func (c *Client) TaskInfo(queue, taskID string) (*asynq.TaskInfo, error) {
+	return c.inspector.GetTaskInfo(queue, taskID)
+}
+
+// DeleteTask removes a task that is not running
+func (c *Client) DeleteTask(queue, taskID string) error {
+	return c.inspector.DeleteTask(queue, taskID)
+}
+
+// CancelProcessing signals the worker running a task to cancel its context
+func (c *Client) CancelProcessing(taskID string) error {
+	return c.inspector.CancelProcessing(taskID)
+}
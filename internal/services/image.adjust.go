@@ -0,0 +1,145 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// AdjustParams defines tonal and color adjustments. Zero values leave the
+// image unchanged; percentages follow the imaging package conventions.
+type AdjustParams struct {
+	Brightness float64 // -100..100
+	Contrast   float64 // -100..100
+	Saturation float64 // -100..500
+	Gamma      float64 // 1 is neutral, <1 darkens, >1 lightens
+	Hue        float64 // shift in degrees, -180..180
+	Preset     string  // grayscale, sepia or invert, applied last
+}
+
+// ApplyAdjust applies the adjustments in a fixed order: brightness,
+// contrast, saturation, gamma, hue, then the preset
+func ApplyAdjust(img image.Image, params AdjustParams) image.Image {
+	if params.Brightness != 0 {
+		img = imaging.AdjustBrightness(img, params.Brightness)
+	}
+	if params.Contrast != 0 {
+		img = imaging.AdjustContrast(img, params.Contrast)
+	}
+	if params.Saturation != 0 {
+		img = imaging.AdjustSaturation(img, params.Saturation)
+	}
+	if params.Gamma > 0 && params.Gamma != 1 {
+		img = imaging.AdjustGamma(img, params.Gamma)
+	}
+	if params.Hue != 0 {
+		img = adjustHue(img, params.Hue)
+	}
+
+	switch params.Preset {
+	case "grayscale":
+		img = imaging.Grayscale(img)
+	case "sepia":
+		img = sepia(img)
+	case "invert":
+		img = imaging.Invert(img)
+	}
+
+	return img
+}
+
+// adjustHue rotates the hue of every pixel, imaging v1.6 has no AdjustHue
+func adjustHue(img image.Image, degrees float64) image.Image {
+	shift := degrees / 360
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		h, s, l := rgbToHSL(c.R, c.G, c.B)
+		h = math.Mod(h+shift+1, 1)
+		r, g, b := hslToRGB(h, s, l)
+		return color.NRGBA{r, g, b, c.A}
+	})
+}
+
+// sepia applies the classic sepia tone matrix
+func sepia(img image.Image) image.Image {
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		return color.NRGBA{
+			R: clampUint8(0.393*r + 0.769*g + 0.189*b),
+			G: clampUint8(0.349*r + 0.686*g + 0.168*b),
+			B: clampUint8(0.272*r + 0.534*g + 0.131*b),
+			A: c.A,
+		}
+	})
+}
+
+func rgbToHSL(r8, g8, b8 uint8) (h, s, l float64) {
+	r, g, b := float64(r8)/255, float64(g8)/255, float64(b8)/255
+	maxC := math.Max(r, math.Max(g, b))
+	minC := math.Min(r, math.Min(g, b))
+	l = (maxC + minC) / 2
+	if maxC == minC {
+		return 0, 0, l
+	}
+
+	d := maxC - minC
+	if l > 0.5 {
+		s = d / (2 - maxC - minC)
+	} else {
+		s = d / (maxC + minC)
+	}
+	switch maxC {
+	case r:
+		h = (g - b) / d
+		if g < b {
+			h += 6
+		}
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h / 6, s, l
+}
+
+func hslToRGB(h, s, l float64) (r, g, b uint8) {
+	if s == 0 {
+		v := clampUint8(l * 255)
+		return v, v, v
+	}
+
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	return clampUint8(hueToRGB(p, q, h+1.0/3) * 255),
+		clampUint8(hueToRGB(p, q, h) * 255),
+		clampUint8(hueToRGB(p, q, h-1.0/3) * 255)
+}
+
+func hueToRGB(p, q, t float64) float64 {
+	if t < 0 {
+		t++
+	}
+	if t > 1 {
+		t--
+	}
+	switch {
+	case t < 1.0/6:
+		return p + (q-p)*6*t
+	case t < 1.0/2:
+		return q
+	case t < 2.0/3:
+		return p + (q-p)*(2.0/3-t)*6
+	default:
+		return p
+	}
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
@@ -5,7 +5,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -73,3 +76,71 @@ func (s *S3Service) Upload(ctx context.Context, key string, data []byte) error {
 	}
 	return nil
 }
+
+// ETag returns the entity tag of an object without downloading it
+func (s *S3Service) ETag(ctx context.Context, key string) (string, error) {
+	result, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to head object: %w", err)
+	}
+	return strings.Trim(aws.ToString(result.ETag), `"`), nil
+}
+
+// Copy copies an object into this service's bucket without passing the
+// bytes through the worker. The source may be in another bucket.
+func (s *S3Service) Copy(ctx context.Context, srcBucket, srcKey, key string) error {
+	segments := strings.Split(srcKey, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	source := srcBucket + "/" + strings.Join(segments, "/")
+
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     &s.bucket,
+		Key:        &key,
+		CopySource: &source,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy object: %w", err)
+	}
+	return nil
+}
+
+// ObjectInfo describes a listed object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// List returns up to maxKeys objects under prefix in key order, starting
+// after the key startAfter, and whether more objects follow
+func (s *S3Service) List(ctx context.Context, prefix, startAfter string, maxKeys int32) ([]ObjectInfo, bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  &s.bucket,
+		Prefix:  &prefix,
+		MaxKeys: &maxKeys,
+	}
+	if startAfter != "" {
+		input.StartAfter = &startAfter
+	}
+	result, err := s.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	objects := make([]ObjectInfo, 0, len(result.Contents))
+	for _, obj := range result.Contents {
+		objects = append(objects, ObjectInfo{
+			Key:          aws.ToString(obj.Key),
+			Size:         aws.ToInt64(obj.Size),
+			ETag:         strings.Trim(aws.ToString(obj.ETag), `"`),
+			LastModified: aws.ToTime(obj.LastModified),
+		})
+	}
+	return objects, aws.ToBool(result.IsTruncated), nil
+}
@@ -0,0 +1,535 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Color profiles the pipeline can convert to
+const (
+	ColorProfileSRGB      = "srgb"
+	ColorProfileDisplayP3 = "display-p3"
+	ColorProfileAdobeRGB  = "adobe-rgb"
+)
+
+// ErrUnsupportedProfile is returned for ICC profiles that are not RGB
+// matrix/TRC profiles (LUT based, CMYK, grayscale, ...)
+var ErrUnsupportedProfile = errors.New("unsupported ICC profile")
+
+// toneCurve maps encoded channel values to linear light and back, both in [0, 1]
+type toneCurve interface {
+	toLinear(v float64) float64
+	fromLinear(v float64) float64
+}
+
+// colorSpace is an RGB matrix/TRC color space relative to the D50 PCS
+type colorSpace struct {
+	name  string
+	toXYZ [3][3]float64
+	trc   [3]toneCurve
+}
+
+var (
+	// D50 is the ICC profile connection space white point
+	whiteD50 = [3]float64{0.9642, 1.0, 0.8249}
+	whiteD65 = [2]float64{0.3127, 0.3290}
+
+	srgbTRC     = srgbCurve{}
+	adobeRGBTRC = gammaCurve(563.0 / 256.0)
+
+	targetSpaces = map[string]*colorSpace{
+		ColorProfileSRGB:      newColorSpace("sRGB", [3][2]float64{{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}}, srgbTRC),
+		ColorProfileDisplayP3: newColorSpace("Display P3", [3][2]float64{{0.680, 0.320}, {0.265, 0.690}, {0.150, 0.060}}, srgbTRC),
+		ColorProfileAdobeRGB:  newColorSpace("Adobe RGB (1998)", [3][2]float64{{0.64, 0.33}, {0.21, 0.71}, {0.15, 0.06}}, adobeRGBTRC),
+	}
+)
+
+// ConvertColorProfile converts pixels described by the source ICC profile to
+// the target color space and returns the ICC profile to embed in the output.
+// Sources without a profile are treated as sRGB.
+func ConvertColorProfile(img image.Image, srcICC []byte, target string) (image.Image, []byte, error) {
+	dst, ok := targetSpaces[target]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown target color profile %q", target)
+	}
+
+	src := targetSpaces[ColorProfileSRGB]
+	if len(srcICC) > 0 {
+		parsed, err := parseICCProfile(srcICC)
+		if err != nil {
+			return nil, nil, err
+		}
+		src = parsed
+	}
+
+	profile := buildICCProfile(dst)
+	if src.equivalent(dst) {
+		return img, profile, nil
+	}
+
+	return convertPixels(img, src, dst), profile, nil
+}
+
+func convertPixels(img image.Image, src, dst *colorSpace) image.Image {
+	out := imaging.Clone(img)
+
+	// source values are 8-bit, so linearisation is a table lookup
+	var toLinear [3][256]float64
+	for c := range 3 {
+		for v := range 256 {
+			toLinear[c][v] = src.trc[c].toLinear(float64(v) / 255)
+		}
+	}
+
+	// linear -> encoded through a finer table to keep shadows smooth
+	const steps = 4096
+	var fromLinear [3][steps + 1]uint8
+	for c := range 3 {
+		for i := range steps + 1 {
+			v := dst.trc[c].fromLinear(float64(i) / steps)
+			fromLinear[c][i] = uint8(math.Round(clamp01(v) * 255))
+		}
+	}
+
+	m := mul3(invert3(dst.toXYZ), src.toXYZ)
+
+	pix := out.Pix
+	for i := 0; i+3 < len(pix); i += 4 {
+		r := toLinear[0][pix[i]]
+		g := toLinear[1][pix[i+1]]
+		b := toLinear[2][pix[i+2]]
+
+		lin := [3]float64{
+			m[0][0]*r + m[0][1]*g + m[0][2]*b,
+			m[1][0]*r + m[1][1]*g + m[1][2]*b,
+			m[2][0]*r + m[2][1]*g + m[2][2]*b,
+		}
+		for c := range 3 {
+			pix[i+c] = fromLinear[c][int(math.Round(clamp01(lin[c])*steps))]
+		}
+	}
+
+	return out
+}
+
+func (cs *colorSpace) equivalent(other *colorSpace) bool {
+	const eps = 0.002
+	for i := range 3 {
+		for j := range 3 {
+			if math.Abs(cs.toXYZ[i][j]-other.toXYZ[i][j]) > eps {
+				return false
+			}
+		}
+		for _, v := range []float64{0.05, 0.25, 0.5, 0.75} {
+			if math.Abs(cs.trc[i].toLinear(v)-other.trc[i].toLinear(v)) > eps {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// newColorSpace builds a D50-adapted color space from D65 primaries
+func newColorSpace(name string, primaries [3][2]float64, trc toneCurve) *colorSpace {
+	var p [3][3]float64
+	for i, xy := range primaries {
+		p[0][i] = xy[0] / xy[1]
+		p[1][i] = 1
+		p[2][i] = (1 - xy[0] - xy[1]) / xy[1]
+	}
+
+	w := [3]float64{whiteD65[0] / whiteD65[1], 1, (1 - whiteD65[0] - whiteD65[1]) / whiteD65[1]}
+	s := mulVec3(invert3(p), w)
+	for i := range 3 {
+		for j := range 3 {
+			p[i][j] *= s[j]
+		}
+	}
+
+	return &colorSpace{
+		name:  name,
+		toXYZ: mul3(bradford(w, whiteD50), p),
+		trc:   [3]toneCurve{trc, trc, trc},
+	}
+}
+
+// bradford returns the chromatic adaptation matrix between two XYZ whites
+func bradford(from, to [3]float64) [3][3]float64 {
+	b := [3][3]float64{
+		{0.8951, 0.2664, -0.1614},
+		{-0.7502, 1.7135, 0.0367},
+		{0.0389, -0.0685, 1.0296},
+	}
+	src := mulVec3(b, from)
+	dst := mulVec3(b, to)
+	var scale [3][3]float64
+	for i := range 3 {
+		scale[i][i] = dst[i] / src[i]
+	}
+	return mul3(invert3(b), mul3(scale, b))
+}
+
+// srgbCurve is the piecewise sRGB transfer function
+type srgbCurve struct{}
+
+func (srgbCurve) toLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func (srgbCurve) fromLinear(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// gammaCurve is a pure power function
+type gammaCurve float64
+
+func (g gammaCurve) toLinear(v float64) float64   { return math.Pow(v, float64(g)) }
+func (g gammaCurve) fromLinear(v float64) float64 { return math.Pow(v, 1/float64(g)) }
+
+// paraCurve is an ICC parametricCurveType
+type paraCurve struct {
+	fn                  uint16
+	g, a, b, c, d, e, f float64
+}
+
+func (p paraCurve) toLinear(x float64) float64 {
+	switch p.fn {
+	case 0:
+		return math.Pow(x, p.g)
+	case 1:
+		if x >= -p.b/p.a {
+			return math.Pow(p.a*x+p.b, p.g)
+		}
+		return 0
+	case 2:
+		if x >= -p.b/p.a {
+			return math.Pow(p.a*x+p.b, p.g) + p.c
+		}
+		return p.c
+	case 3:
+		if x >= p.d {
+			return math.Pow(p.a*x+p.b, p.g)
+		}
+		return p.c * x
+	default:
+		if x >= p.d {
+			return math.Pow(p.a*x+p.b, p.g) + p.e
+		}
+		return p.c*x + p.f
+	}
+}
+
+func (p paraCurve) fromLinear(y float64) float64 {
+	return invertCurve(p, y)
+}
+
+// tableCurve is an ICC curveType with sampled values
+type tableCurve []float64
+
+func (t tableCurve) toLinear(x float64) float64 {
+	pos := clamp01(x) * float64(len(t)-1)
+	i := int(pos)
+	if i >= len(t)-1 {
+		return t[len(t)-1]
+	}
+	frac := pos - float64(i)
+	return t[i]*(1-frac) + t[i+1]*frac
+}
+
+func (t tableCurve) fromLinear(y float64) float64 {
+	return invertCurve(t, y)
+}
+
+// invertCurve inverts a monotonic curve by bisection
+func invertCurve(c toneCurve, y float64) float64 {
+	lo, hi := 0.0, 1.0
+	for range 32 {
+		mid := (lo + hi) / 2
+		if c.toLinear(mid) < y {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// parseICCProfile reads the colorants and tone curves of an RGB display profile
+func parseICCProfile(data []byte) (*colorSpace, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("%w: malformed header", ErrUnsupportedProfile)
+	}
+	if cs := string(data[16:20]); cs != "RGB " {
+		return nil, fmt.Errorf("%w: color space %q", ErrUnsupportedProfile, cs)
+	}
+	if pcs := string(data[20:24]); pcs != "XYZ " {
+		return nil, fmt.Errorf("%w: connection space %q", ErrUnsupportedProfile, pcs)
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := range count {
+		pos := 132 + i*12
+		if pos+12 > len(data) {
+			break
+		}
+		offset := int(binary.BigEndian.Uint32(data[pos+4:]))
+		size := int(binary.BigEndian.Uint32(data[pos+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			continue
+		}
+		tags[string(data[pos:pos+4])] = data[offset : offset+size]
+	}
+
+	cs := &colorSpace{name: iccDescription(tags["desc"])}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, ok := parseXYZTag(tags[sig])
+		if !ok {
+			return nil, fmt.Errorf("%w: missing %s colorant", ErrUnsupportedProfile, sig)
+		}
+		for row := range 3 {
+			cs.toXYZ[row][i] = xyz[row]
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, ok := parseCurveTag(tags[sig])
+		if !ok {
+			return nil, fmt.Errorf("%w: missing %s tone curve", ErrUnsupportedProfile, sig)
+		}
+		cs.trc[i] = curve
+	}
+
+	return cs, nil
+}
+
+func parseXYZTag(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+func parseCurveTag(tag []byte) (toneCurve, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return gammaCurve(1), true
+		case n == 1 && len(tag) >= 14:
+			return gammaCurve(float64(binary.BigEndian.Uint16(tag[12:])) / 256), true
+		case len(tag) >= 12+2*n:
+			table := make(tableCurve, n)
+			for i := range n {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return table, true
+		}
+	case "para":
+		fn := binary.BigEndian.Uint16(tag[8:])
+		params := []int{1, 3, 4, 5, 7}
+		if int(fn) >= len(params) || len(tag) < 12+4*params[fn] {
+			return nil, false
+		}
+		v := make([]float64, 7)
+		for i := range params[fn] {
+			v[i] = s15Fixed16(tag[12+4*i:])
+		}
+		return paraCurve{fn: fn, g: v[0], a: v[1], b: v[2], c: v[3], d: v[4], e: v[5], f: v[6]}, true
+	}
+	return nil, false
+}
+
+// iccDescription reads a v2 textDescriptionType or the first v4 mluc record
+func iccDescription(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+n <= len(tag) {
+			return string(bytes.TrimRight(tag[12:12+n], "\x00"))
+		}
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+n > len(tag) {
+			return ""
+		}
+		// UTF-16BE, the profile names we care about are ASCII
+		var b []byte
+		for i := offset; i+1 < offset+n; i += 2 {
+			b = append(b, tag[i+1])
+		}
+		return string(b)
+	}
+	return ""
+}
+
+// buildICCProfile writes a v2 matrix/TRC display profile for a color space
+func buildICCProfile(cs *colorSpace) []byte {
+	type tag struct {
+		sig  string
+		data []byte
+	}
+
+	var tags []tag
+	tags = append(tags,
+		tag{"desc", descTag(cs.name)},
+		tag{"cprt", textTag("No copyright, use freely")},
+		tag{"wtpt", xyzTag(whiteD50)},
+	)
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tags = append(tags, tag{sig, xyzTag([3]float64{cs.toXYZ[0][i], cs.toXYZ[1][i], cs.toXYZ[2][i]})})
+	}
+	trc := curveTag(cs.trc[0])
+	for _, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, tag{sig, trc})
+	}
+
+	// tag data follows the header and tag table; identical payloads are shared
+	headerSize := 128 + 4 + 12*len(tags)
+	var body bytes.Buffer
+	offsets := map[string]int{}
+	table := make([]byte, 0, 4+12*len(tags))
+	table = binary.BigEndian.AppendUint32(table, uint32(len(tags)))
+	for _, t := range tags {
+		offset, ok := offsets[string(t.data)]
+		if !ok {
+			offset = headerSize + body.Len()
+			offsets[string(t.data)] = offset
+			body.Write(t.data)
+			for body.Len()%4 != 0 {
+				body.WriteByte(0)
+			}
+		}
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(headerSize+body.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000) // version 2.1
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	binary.BigEndian.PutUint16(header[24:], 2026) // creation date, January 1st
+	binary.BigEndian.PutUint16(header[26:], 1)
+	binary.BigEndian.PutUint16(header[28:], 1)
+	copy(header[36:], "acsp")
+	copy(header[68:], xyzNumbers(whiteD50))
+
+	out := make([]byte, 0, headerSize+body.Len())
+	out = append(out, header...)
+	out = append(out, table...)
+	return append(out, body.Bytes()...)
+}
+
+func descTag(text string) []byte {
+	b := []byte("desc\x00\x00\x00\x00")
+	b = binary.BigEndian.AppendUint32(b, uint32(len(text)+1))
+	b = append(b, text...)
+	b = append(b, 0)
+	// empty Unicode and ScriptCode descriptions
+	b = append(b, make([]byte, 4+4+2+1+67)...)
+	return b
+}
+
+func textTag(text string) []byte {
+	b := []byte("text\x00\x00\x00\x00")
+	b = append(b, text...)
+	return append(b, 0)
+}
+
+func xyzTag(xyz [3]float64) []byte {
+	return append([]byte("XYZ \x00\x00\x00\x00"), xyzNumbers(xyz)...)
+}
+
+func xyzNumbers(xyz [3]float64) []byte {
+	b := make([]byte, 0, 12)
+	for _, v := range xyz {
+		b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(v*65536))))
+	}
+	return b
+}
+
+func curveTag(c toneCurve) []byte {
+	b := []byte("curv\x00\x00\x00\x00")
+	if g, ok := c.(gammaCurve); ok {
+		b = binary.BigEndian.AppendUint32(b, 1)
+		return binary.BigEndian.AppendUint16(b, uint16(math.Round(float64(g)*256)))
+	}
+
+	const n = 1024
+	b = binary.BigEndian.AppendUint32(b, n)
+	for i := range n {
+		v := c.toLinear(float64(i) / (n - 1))
+		b = binary.BigEndian.AppendUint16(b, uint16(math.Round(clamp01(v)*65535)))
+	}
+	return b
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := range 3 {
+		for j := range 3 {
+			for k := range 3 {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func mulVec3(m [3][3]float64, v [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	inv := [3][3]float64{
+		{m[1][1]*m[2][2] - m[1][2]*m[2][1], m[0][2]*m[2][1] - m[0][1]*m[2][2], m[0][1]*m[1][2] - m[0][2]*m[1][1]},
+		{m[1][2]*m[2][0] - m[1][0]*m[2][2], m[0][0]*m[2][2] - m[0][2]*m[2][0], m[0][2]*m[1][0] - m[0][0]*m[1][2]},
+		{m[1][0]*m[2][1] - m[1][1]*m[2][0], m[0][1]*m[2][0] - m[0][0]*m[2][1], m[0][0]*m[1][1] - m[0][1]*m[1][0]},
+	}
+	for i := range 3 {
+		for j := range 3 {
+			inv[i][j] /= det
+		}
+	}
+	return inv
+}
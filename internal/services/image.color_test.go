@@ -0,0 +1,153 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestICCProfileRoundTrip(t *testing.T) {
+	for name, cs := range targetSpaces {
+		t.Run(name, func(t *testing.T) {
+			profile := buildICCProfile(cs)
+			if got := int(binary.BigEndian.Uint32(profile)); got != len(profile) {
+				t.Errorf("header size = %d, profile is %d bytes", got, len(profile))
+			}
+
+			parsed, err := parseICCProfile(profile)
+			if err != nil {
+				t.Fatalf("parseICCProfile: %v", err)
+			}
+			if parsed.name != cs.name {
+				t.Errorf("name = %q, want %q", parsed.name, cs.name)
+			}
+			if !parsed.equivalent(cs) {
+				t.Errorf("parsed color space %+v is not equivalent to %+v", parsed.toXYZ, cs.toXYZ)
+			}
+			// a rebuilt profile is byte for byte the same
+			if rebuilt := buildICCProfile(parsed); string(rebuilt) != string(profile) {
+				t.Error("rebuilding the parsed profile changed it")
+			}
+		})
+	}
+}
+
+func TestParseICCProfileRejects(t *testing.T) {
+	valid := buildICCProfile(targetSpaces[ColorProfileSRGB])
+	withHeader := func(offset int, value string) []byte {
+		b := append([]byte(nil), valid...)
+		copy(b[offset:], value)
+		return b
+	}
+	withoutTags := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint32(withoutTags[128:], 3) // desc, cprt and wtpt only
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", valid[:100]},
+		{"no signature", withHeader(36, "xxxx")},
+		{"cmyk", withHeader(16, "CMYK")},
+		{"grayscale", withHeader(16, "GRAY")},
+		{"lab connection space", withHeader(20, "Lab ")},
+		{"missing colorants", withoutTags},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseICCProfile(tt.data); !errors.Is(err, ErrUnsupportedProfile) {
+				t.Errorf("parseICCProfile = %v, want ErrUnsupportedProfile", err)
+			}
+		})
+	}
+}
+
+func TestParseICCProfileOutOfRangeTags(t *testing.T) {
+	profile := buildICCProfile(targetSpaces[ColorProfileSRGB])
+	// point rXYZ past the end, it must be skipped rather than sliced
+	for pos := 132; pos+12 <= len(profile); pos += 12 {
+		if string(profile[pos:pos+4]) == "rXYZ" {
+			binary.BigEndian.PutUint32(profile[pos+4:], 0xfffffff0)
+		}
+	}
+	if _, err := parseICCProfile(profile); !errors.Is(err, ErrUnsupportedProfile) {
+		t.Errorf("parseICCProfile = %v, want ErrUnsupportedProfile", err)
+	}
+}
+
+func TestParseCurveTag(t *testing.T) {
+	para := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		para = binary.BigEndian.AppendUint32(para, uint32(int32(math.Round(v*65536))))
+	}
+
+	tests := []struct {
+		name string
+		tag  []byte
+		want toneCurve
+	}{
+		{"gamma", curveTag(gammaCurve(2.2)), gammaCurve(2.2)},
+		{"table", curveTag(srgbTRC), srgbTRC},
+		{"parametric", para, srgbTRC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			curve, ok := parseCurveTag(tt.tag)
+			if !ok {
+				t.Fatal("parseCurveTag failed")
+			}
+			for _, v := range []float64{0, 0.02, 0.25, 0.5, 0.75, 1} {
+				if got, want := curve.toLinear(v), tt.want.toLinear(v); math.Abs(got-want) > 0.001 {
+					t.Errorf("toLinear(%v) = %v, want %v", v, got, want)
+				}
+				if got := curve.toLinear(curve.fromLinear(v)); math.Abs(got-v) > 0.001 {
+					t.Errorf("toLinear(fromLinear(%v)) = %v", v, got)
+				}
+			}
+		})
+	}
+
+	if _, ok := parseCurveTag(para[:20]); ok {
+		t.Error("parsed a truncated parametric curve")
+	}
+}
+
+func TestConvertColorProfile(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	img.Set(1, 0, color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+
+	out, profile, err := ConvertColorProfile(img, nil, ColorProfileSRGB)
+	if err != nil {
+		t.Fatalf("ConvertColorProfile: %v", err)
+	}
+	if out != image.Image(img) {
+		t.Error("sRGB to sRGB converted the pixels")
+	}
+	if _, err := parseICCProfile(profile); err != nil {
+		t.Errorf("embedded profile does not parse: %v", err)
+	}
+
+	out, _, err = ConvertColorProfile(img, nil, ColorProfileDisplayP3)
+	if err != nil {
+		t.Fatalf("ConvertColorProfile: %v", err)
+	}
+	red := color.NRGBAModel.Convert(out.At(0, 0)).(color.NRGBA)
+	if red.R >= 255 || red.G == 0 {
+		t.Errorf("sRGB red in Display P3 = %v, want it inside the gamut", red)
+	}
+	gray := color.NRGBAModel.Convert(out.At(1, 0)).(color.NRGBA)
+	if gray.R != gray.G || gray.G != gray.B {
+		t.Errorf("gray in Display P3 = %v, want it neutral", gray)
+	}
+
+	cmyk := buildICCProfile(targetSpaces[ColorProfileSRGB])
+	copy(cmyk[16:], "CMYK")
+	if _, _, err := ConvertColorProfile(img, cmyk, ColorProfileSRGB); !errors.Is(err, ErrUnsupportedProfile) {
+		t.Errorf("ConvertColorProfile from CMYK = %v, want ErrUnsupportedProfile", err)
+	}
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// BorderParams defines a solid border drawn around the image
+type BorderParams struct {
+	Width int
+	Color string // hex color, black when empty
+}
+
+// RoundCornersParams defines rounded corner parameters
+type RoundCornersParams struct {
+	Radius     int
+	Background string // corner fill color, transparent when empty
+}
+
+// ApplyBorder grows the canvas by Width on every side and fills it with
+// Color. Only the added margin is colored, the image keeps its alpha.
+func ApplyBorder(img image.Image, params BorderParams) image.Image {
+	if params.Width <= 0 {
+		return img
+	}
+
+	c := color.RGBA{0, 0, 0, 255}
+	if params.Color != "" {
+		c = parseColor(params.Color)
+	}
+
+	bounds := img.Bounds()
+	w := params.Width
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()+2*w, bounds.Dy()+2*w))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	// The image replaces the fill, transparent pixels stay transparent
+	// instead of showing the border color through
+	draw.Draw(dst, image.Rect(w, w, w+bounds.Dx(), w+bounds.Dy()), img, bounds.Min, draw.Src)
+
+	return dst
+}
+
+// ApplyRoundCorners makes the corners transparent outside a quarter circle
+// of Radius, anti-aliasing the edge. With a Background the corners are
+// filled with that color instead.
+func ApplyRoundCorners(img image.Image, params RoundCornersParams) image.Image {
+	dst := imaging.Clone(img)
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+	radius := float64(min(params.Radius, width/2, height/2))
+	if radius <= 0 {
+		return dst
+	}
+
+	r := int(math.Ceil(radius))
+	for y := range r {
+		for x := range r {
+			// distance from the pixel center to the circle center
+			d := math.Hypot(radius-float64(x)-0.5, radius-float64(y)-0.5)
+			coverage := math.Max(0, math.Min(1, radius-d+0.5))
+			if coverage >= 1 {
+				continue
+			}
+			for _, p := range [][2]int{{x, y}, {width - 1 - x, y}, {x, height - 1 - y}, {width - 1 - x, height - 1 - y}} {
+				i := dst.PixOffset(p[0], p[1])
+				dst.Pix[i+3] = uint8(math.Round(float64(dst.Pix[i+3]) * coverage))
+			}
+		}
+	}
+
+	if params.Background == "" {
+		return dst
+	}
+	return ApplyFlatten(dst, params.Background)
+}
+
+// ApplyFlatten composites the image over a solid background, removing alpha.
+// An empty background means white.
+func ApplyFlatten(img image.Image, background string) image.Image {
+	c := color.RGBA{255, 255, 255, 255}
+	if background != "" {
+		c = parseColor(background)
+	}
+
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+
+	return dst
+}
+
+// isOpaque reports whether img is known to have no transparent pixels
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	opaqueRed   = color.NRGBA{R: 255, A: 255}
+	opaqueWhite = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	opaqueBlack = color.NRGBA{A: 255}
+)
+
+// filledImage returns a w x h image of a single color
+func filledImage(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func nrgbaAt(img image.Image, x, y int) color.NRGBA {
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func TestApplyBorder(t *testing.T) {
+	src := filledImage(4, 3, opaqueRed)
+	src.SetNRGBA(0, 0, color.NRGBA{})
+
+	tests := []struct {
+		name   string
+		params BorderParams
+		border color.NRGBA
+	}{
+		{"default black", BorderParams{Width: 2}, opaqueBlack},
+		{"color", BorderParams{Width: 1, Color: "#00ff00"}, color.NRGBA{G: 255, A: 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := ApplyBorder(src, tt.params)
+			w := tt.params.Width
+			if got, want := out.Bounds().Size(), image.Pt(4+2*w, 3+2*w); got != want {
+				t.Fatalf("size = %v, want %v", got, want)
+			}
+			if got := nrgbaAt(out, 0, 0); got != tt.border {
+				t.Errorf("border = %v, want %v", got, tt.border)
+			}
+			if got := nrgbaAt(out, w+3, w+2); got != opaqueRed {
+				t.Errorf("image pixel = %v, want %v", got, opaqueRed)
+			}
+			// the border color must not show through transparent pixels
+			if got := nrgbaAt(out, w, w); got.A != 0 {
+				t.Errorf("transparent pixel = %v, want it transparent", got)
+			}
+		})
+	}
+
+	if out := ApplyBorder(src, BorderParams{}); out != image.Image(src) {
+		t.Error("a zero width border changed the image")
+	}
+}
+
+func TestApplyRoundCorners(t *testing.T) {
+	tests := []struct {
+		name   string
+		w, h   int
+		params RoundCornersParams
+		corner color.NRGBA
+	}{
+		{"transparent corners", 10, 10, RoundCornersParams{Radius: 4}, color.NRGBA{}},
+		{"radius past half the width", 10, 6, RoundCornersParams{Radius: 100}, color.NRGBA{}},
+		{"background", 10, 10, RoundCornersParams{Radius: 4, Background: "#0000ff"}, color.NRGBA{B: 255, A: 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := ApplyRoundCorners(filledImage(tt.w, tt.h, opaqueRed), tt.params)
+			if got := out.Bounds().Size(); got != image.Pt(tt.w, tt.h) {
+				t.Fatalf("size = %v", got)
+			}
+			for _, p := range []image.Point{{0, 0}, {tt.w - 1, 0}, {0, tt.h - 1}, {tt.w - 1, tt.h - 1}} {
+				if got := nrgbaAt(out, p.X, p.Y); got.A != tt.corner.A || (got.A != 0 && got != tt.corner) {
+					t.Errorf("corner %v = %v, want %v", p, got, tt.corner)
+				}
+			}
+			// the center and the middle of the long edges stay untouched
+			for _, p := range []image.Point{{tt.w / 2, tt.h / 2}, {tt.w / 2, 0}, {tt.w / 2, tt.h - 1}} {
+				if got := nrgbaAt(out, p.X, p.Y); got != opaqueRed {
+					t.Errorf("edge %v = %v, want %v", p, got, opaqueRed)
+				}
+			}
+		})
+	}
+
+	// an edge pixel on the circle is partly covered
+	out := ApplyRoundCorners(filledImage(20, 20, opaqueRed), RoundCornersParams{Radius: 8})
+	if a := nrgbaAt(out, 1, 3).A; a == 0 || a == 255 {
+		t.Errorf("anti-aliased edge alpha = %d, want partial", a)
+	}
+
+	src := filledImage(1, 1, opaqueRed)
+	if got := nrgbaAt(ApplyRoundCorners(src, RoundCornersParams{Radius: 5}), 0, 0); got != opaqueRed {
+		t.Errorf("1x1 image = %v, want it unchanged", got)
+	}
+}
+
+func TestApplyFlatten(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	src.SetNRGBA(0, 0, opaqueRed)
+	src.SetNRGBA(1, 0, color.NRGBA{})
+	src.SetNRGBA(2, 0, color.NRGBA{R: 255, A: 128})
+
+	tests := []struct {
+		name       string
+		background string
+		clear      color.NRGBA
+		half       color.NRGBA
+	}{
+		{"default white", "", opaqueWhite, color.NRGBA{R: 255, G: 127, B: 127, A: 255}},
+		{"background", "#000000", opaqueBlack, color.NRGBA{R: 128, A: 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := ApplyFlatten(src, tt.background)
+			if got := nrgbaAt(out, 0, 0); got != opaqueRed {
+				t.Errorf("opaque pixel = %v, want %v", got, opaqueRed)
+			}
+			if got := nrgbaAt(out, 1, 0); got != tt.clear {
+				t.Errorf("transparent pixel = %v, want %v", got, tt.clear)
+			}
+			if got := nrgbaAt(out, 2, 0); !closeColor(got, tt.half, 1) {
+				t.Errorf("half transparent pixel = %v, want %v", got, tt.half)
+			}
+		})
+	}
+
+	// offset bounds are flattened from their own origin
+	offset := filledImage(4, 4, opaqueRed).SubImage(image.Rect(2, 2, 4, 4))
+	if out := ApplyFlatten(offset, ""); nrgbaAt(out, 0, 0) != opaqueRed || out.Bounds().Size() != image.Pt(2, 2) {
+		t.Errorf("flattened sub-image = %v at %v", nrgbaAt(out, 0, 0), out.Bounds())
+	}
+}
+
+// closeColor reports whether every channel of a and b is within tolerance
+func closeColor(a, b color.NRGBA, tolerance int) bool {
+	return absDiff(a.R, b.R) <= tolerance && absDiff(a.G, b.G) <= tolerance &&
+		absDiff(a.B, b.B) <= tolerance && absDiff(a.A, b.A) <= tolerance
+}
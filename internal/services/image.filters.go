@@ -0,0 +1,53 @@
+package services
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// SharpenParams defines unsharp mask parameters
+type SharpenParams struct {
+	Radius    float64 // gaussian sigma of the blurred copy, in pixels
+	Amount    float64 // strength, 1 adds back 100% of the difference
+	Threshold int     // minimum difference (0-255) before a pixel is sharpened
+}
+
+// autoSharpen is the mask applied after a downscale when requested,
+// tuned for web thumbnails
+var autoSharpen = SharpenParams{Radius: 0.6, Amount: 0.8, Threshold: 2}
+
+// ApplyBlur applies a gaussian blur
+func ApplyBlur(img image.Image, sigma float64) image.Image {
+	if sigma <= 0 {
+		return img
+	}
+	return imaging.Blur(img, sigma)
+}
+
+// ApplySharpen applies an unsharp mask: the difference between the image
+// and a blurred copy is scaled by Amount and added back where it exceeds
+// Threshold, so flat areas and noise are left alone
+func ApplySharpen(img image.Image, params SharpenParams) image.Image {
+	if params.Radius <= 0 || params.Amount <= 0 {
+		return img
+	}
+
+	src := imaging.Clone(img)
+	blurred := imaging.Blur(src, params.Radius)
+	threshold := float64(params.Threshold)
+
+	for i := 0; i+3 < len(src.Pix); i += 4 {
+		for c := range 3 {
+			orig := float64(src.Pix[i+c])
+			diff := orig - float64(blurred.Pix[i+c])
+			if math.Abs(diff) < threshold {
+				continue
+			}
+			src.Pix[i+c] = clampUint8(orig + params.Amount*diff)
+		}
+	}
+
+	return src
+}
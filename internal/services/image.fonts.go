@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/gofont/gosmallcaps"
+	"golang.org/x/image/font/opentype"
+)
+
+// DefaultFont is used by watermarks that don't name a font
+const DefaultFont = "go-regular"
+
+// bundledFonts are the Go fonts (BSD licensed), shipped with the binary so
+// watermarks don't depend on what is installed on the worker host
+var bundledFonts = map[string][]byte{
+	"go-regular":     goregular.TTF,
+	"go-bold":        gobold.TTF,
+	"go-italic":      goitalic.TTF,
+	"go-bold-italic": gobolditalic.TTF,
+	"go-medium":      gomedium.TTF,
+	"go-mono":        gomono.TTF,
+	"go-mono-bold":   gomonobold.TTF,
+	"go-smallcaps":   gosmallcaps.TTF,
+}
+
+// loadedFont is a parsed font and the version of the file it was parsed
+// from, empty for bundled fonts
+type loadedFont struct {
+	font    *opentype.Font
+	version string
+}
+
+var fonts = struct {
+	sync.RWMutex
+	parsed map[string]loadedFont
+}{parsed: make(map[string]loadedFont)}
+
+// BundledFonts returns the names of the fonts shipped with the binary
+func BundledFonts() []string {
+	names := make([]string, 0, len(bundledFonts))
+	for name := range bundledFonts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsBundledFont reports whether name is one of the fonts shipped with the binary
+func IsBundledFont(name string) bool {
+	_, ok := bundledFonts[name]
+	return ok
+}
+
+// HasFont reports whether a font can be used without loading it from
+// storage, i.e. it is bundled or this version of it is already loaded
+func HasFont(name, version string) bool {
+	if IsBundledFont(name) {
+		return true
+	}
+	fonts.RLock()
+	defer fonts.RUnlock()
+	loaded, ok := fonts.parsed[name]
+	return ok && loaded.version == version
+}
+
+// ParseFont checks that data is a TrueType or OpenType font
+func ParseFont(data []byte) error {
+	_, err := opentype.Parse(data)
+	return err
+}
+
+// RegisterFont parses a TTF/OTF file and makes it available under name,
+// replacing an earlier version. Bundled fonts cannot be replaced.
+func RegisterFont(name, version string, data []byte) error {
+	if IsBundledFont(name) {
+		return fmt.Errorf("font %q is bundled and cannot be replaced", name)
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse font %q: %w", name, err)
+	}
+
+	fonts.Lock()
+	defer fonts.Unlock()
+	fonts.parsed[name] = loadedFont{font: f, version: version}
+	return nil
+}
+
+// FontFace returns a face for a registered font. Faces are not safe for
+// concurrent use, so every caller gets its own.
+func FontFace(name string, size float64) (font.Face, error) {
+	if name == "" {
+		name = DefaultFont
+	}
+
+	f, err := lookupFont(name)
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create face for font %q: %w", name, err)
+	}
+	return face, nil
+}
+
+// lookupFont returns a parsed font, parsing bundled fonts on first use
+func lookupFont(name string) (*opentype.Font, error) {
+	fonts.RLock()
+	loaded, ok := fonts.parsed[name]
+	fonts.RUnlock()
+	if ok {
+		return loaded.font, nil
+	}
+
+	data, ok := bundledFonts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown font %q", name)
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bundled font %q: %w", name, err)
+	}
+
+	fonts.Lock()
+	defer fonts.Unlock()
+	fonts.parsed[name] = loadedFont{font: f}
+	return f, nil
+}
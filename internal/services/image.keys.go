@@ -0,0 +1,185 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxKeyLength is the S3 limit on object key length in bytes
+const maxKeyLength = 1024
+
+var (
+	ErrInvalidKeyTemplate = errors.New("invalid key template")
+	ErrUnsafeKey          = errors.New("unsafe object key")
+	ErrOverwritesSource   = errors.New("output key is the source object")
+	ErrKeyOutsideRoot     = errors.New("output key is outside the job's roots")
+)
+
+// keyTemplateRoots are the prefixes a key template must start with, so a
+// job can only write under its owner's or its own image's prefix
+var keyTemplateRoots = []string{"users/{user_id}/", "processed/{image_id}/", "processed/{image_id}."}
+
+// KeyVars are the values an output key template can refer to
+type KeyVars struct {
+	UserID       int64
+	ImageID      int64
+	Variant      string
+	Width        int
+	Height       int
+	Hash         string
+	OrigBasename string
+	Ext          string
+}
+
+// keyPlaceholders maps each supported placeholder to its value
+var keyPlaceholders = map[string]func(KeyVars) string{
+	"user_id":       func(v KeyVars) string { return strconv.FormatInt(v.UserID, 10) },
+	"image_id":      func(v KeyVars) string { return strconv.FormatInt(v.ImageID, 10) },
+	"variant":       func(v KeyVars) string { return v.Variant },
+	"width":         func(v KeyVars) string { return strconv.Itoa(v.Width) },
+	"height":        func(v KeyVars) string { return strconv.Itoa(v.Height) },
+	"hash":          func(v KeyVars) string { return v.Hash },
+	"orig_basename": func(v KeyVars) string { return v.OrigBasename },
+	"ext":           func(v KeyVars) string { return v.Ext },
+}
+
+// RenderKey expands the placeholders of a key template such as
+// "users/{user_id}/cdn/{orig_basename}-{width}w.{ext}" and checks that the
+// result is a safe object key under one of the job's roots
+func RenderKey(template string, v KeyVars) (string, error) {
+	var b strings.Builder
+	rest := template
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			b.WriteString(rest)
+			break
+		}
+		if rest[open] == '}' {
+			return "", fmt.Errorf("%w: unmatched '}'", ErrInvalidKeyTemplate)
+		}
+		b.WriteString(rest[:open])
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("%w: unterminated placeholder", ErrInvalidKeyTemplate)
+		}
+		name := rest[open+1 : open+end]
+		value, ok := keyPlaceholders[name]
+		if !ok {
+			return "", fmt.Errorf("%w: unknown placeholder {%s}", ErrInvalidKeyTemplate, name)
+		}
+		b.WriteString(value(v))
+		rest = rest[open+end+1:]
+	}
+
+	key := b.String()
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+	if err := ValidateOutputKey(key, v.UserID, v.ImageID); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// ValidateOutputKey checks that a key is under users/{user_id}/ or
+// processed/{image_id}, the only places a job may write its outputs
+func ValidateOutputKey(key string, userID, imageID int64) error {
+	roots := []string{
+		fmt.Sprintf("users/%d/", userID),
+		fmt.Sprintf("processed/%d/", imageID),
+		fmt.Sprintf("processed/%d.", imageID),
+	}
+	for _, root := range roots {
+		if strings.HasPrefix(key, root) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrKeyOutsideRoot, key)
+}
+
+// OutputBucketAllowed reports whether a job may write its outputs to
+// bucket: the job's own bucket, which an empty bucket means, or one of allowed
+func OutputBucketAllowed(bucket, jobBucket string, allowed []string) bool {
+	return bucket == "" || bucket == jobBucket || slices.Contains(allowed, bucket)
+}
+
+// ValidateKeyTemplate renders a template with sample values so that bad
+// templates are rejected when a job is submitted rather than when it runs.
+// The template itself must start with one of the job's roots, a literal
+// prefix could match the sample values but no real job.
+func ValidateKeyTemplate(template string) error {
+	if !slices.ContainsFunc(keyTemplateRoots, func(root string) bool { return strings.HasPrefix(template, root) }) {
+		return fmt.Errorf("%w: must start with %s", ErrInvalidKeyTemplate, strings.Join(keyTemplateRoots, ", "))
+	}
+	_, err := RenderKey(template, KeyVars{
+		UserID:       1,
+		ImageID:      1,
+		Variant:      "default",
+		Width:        1,
+		Height:       1,
+		Hash:         ContentHash(nil),
+		OrigBasename: "image",
+		Ext:          "jpg",
+	})
+	return err
+}
+
+// ValidateKey rejects keys that would escape their prefix, collide with
+// other keys after normalisation, or break CDN URLs
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: empty", ErrUnsafeKey)
+	case len(key) > maxKeyLength:
+		return fmt.Errorf("%w: longer than %d bytes", ErrUnsafeKey, maxKeyLength)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("%w: not valid UTF-8", ErrUnsafeKey)
+	case strings.HasPrefix(key, "/"):
+		return fmt.Errorf("%w: leading '/'", ErrUnsafeKey)
+	case strings.HasSuffix(key, "/"):
+		return fmt.Errorf("%w: trailing '/'", ErrUnsafeKey)
+	case strings.ContainsRune(key, '\\'):
+		return fmt.Errorf("%w: contains '\\'", ErrUnsafeKey)
+	}
+
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: contains control character %U", ErrUnsafeKey, r)
+		}
+	}
+	for _, segment := range strings.Split(key, "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("%w: empty path segment", ErrUnsafeKey)
+		case ".", "..":
+			return fmt.Errorf("%w: relative path segment %q", ErrUnsafeKey, segment)
+		}
+	}
+	return nil
+}
+
+// OrigBasename returns the file name of a source key without its extension
+func OrigBasename(key string) string {
+	base := path.Base(key)
+	if ext := path.Ext(base); ext != base {
+		base = strings.TrimSuffix(base, ext)
+	}
+	return base
+}
+
+// ContentHash returns a short content hash, stable across re-uploads of
+// identical bytes so it can be used for cache busting
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
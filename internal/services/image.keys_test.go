@@ -0,0 +1,130 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+var testKeyVars = KeyVars{
+	UserID:       7,
+	ImageID:      42,
+	Variant:      "thumb",
+	Width:        320,
+	Height:       200,
+	Hash:         "0123456789abcdef",
+	OrigBasename: "photo",
+	Ext:          "webp",
+}
+
+func TestRenderKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		vars     KeyVars
+		want     string
+		err      error
+	}{
+		{"user root", "users/{user_id}/cdn/{orig_basename}-{width}w.{ext}", testKeyVars, "users/7/cdn/photo-320w.webp", nil},
+		{"image root", "processed/{image_id}/{variant}-{width}x{height}.{ext}", testKeyVars, "processed/42/thumb-320x200.webp", nil},
+		{"image file", "processed/{image_id}.{hash}.{ext}", testKeyVars, "processed/42.0123456789abcdef.webp", nil},
+		{"parent segment", "users/{user_id}/../{user_id}/x.{ext}", testKeyVars, "", ErrUnsafeKey},
+		{"dot segment", "users/{user_id}/./x.{ext}", testKeyVars, "", ErrUnsafeKey},
+		{"leading slash", "/users/{user_id}/x.{ext}", testKeyVars, "", ErrUnsafeKey},
+		{"trailing slash", "users/{user_id}/", testKeyVars, "", ErrUnsafeKey},
+		{"empty placeholder value", "users/{user_id}/{variant}/x.{ext}", KeyVars{UserID: 7, Ext: "jpg"}, "", ErrUnsafeKey},
+		{"empty basename", "users/{user_id}/{orig_basename}", KeyVars{UserID: 7}, "", ErrUnsafeKey},
+		{"placeholder value with parent", "users/{user_id}/{orig_basename}/x", KeyVars{UserID: 7, OrigBasename: ".."}, "", ErrUnsafeKey},
+		{"empty placeholder name", "users/{user_id}/{}.{ext}", testKeyVars, "", ErrInvalidKeyTemplate},
+		{"unknown placeholder", "users/{user_id}/{name}.{ext}", testKeyVars, "", ErrInvalidKeyTemplate},
+		{"unterminated placeholder", "users/{user_id}/{ext", testKeyVars, "", ErrInvalidKeyTemplate},
+		{"unmatched brace", "users/{user_id}/ext}", testKeyVars, "", ErrInvalidKeyTemplate},
+		{"other user", "users/8/{variant}.{ext}", testKeyVars, "", ErrKeyOutsideRoot},
+		{"other image", "processed/41/{variant}.{ext}", testKeyVars, "", ErrKeyOutsideRoot},
+		{"image id prefix", "processed/4{image_id}.{ext}", testKeyVars, "", ErrKeyOutsideRoot},
+		{"outside roots", "logos/{variant}.{ext}", testKeyVars, "", ErrKeyOutsideRoot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderKey(tt.template, tt.vars)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("RenderKey(%q) error = %v, want %v", tt.template, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("RenderKey(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateKeyTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		err      error
+	}{
+		{"users/{user_id}/{orig_basename}-{width}w.{ext}", nil},
+		{"processed/{image_id}/{variant}.{ext}", nil},
+		{"processed/{image_id}.{ext}", nil},
+		// matches the sample values but no real job
+		{"users/1/{variant}.{ext}", ErrInvalidKeyTemplate},
+		{"processed/1.{ext}", ErrInvalidKeyTemplate},
+		{"cdn/{user_id}/{variant}.{ext}", ErrInvalidKeyTemplate},
+		{"", ErrInvalidKeyTemplate},
+		{"users/{user_id}/../../logos/x.{ext}", ErrUnsafeKey},
+		{"users/{user_id}//x.{ext}", ErrUnsafeKey},
+		{"users/{user_id}/{}.{ext}", ErrInvalidKeyTemplate},
+		{"users/{user_id}/{user}.{ext}", ErrInvalidKeyTemplate},
+	}
+	for _, tt := range tests {
+		if err := ValidateKeyTemplate(tt.template); !errors.Is(err, tt.err) {
+			t.Errorf("ValidateKeyTemplate(%q) = %v, want %v", tt.template, err, tt.err)
+		}
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"processed/1.jpg", true},
+		{"users/7/a b/ünïcode.png", true},
+		{"", false},
+		{"/processed/1.jpg", false},
+		{"processed/", false},
+		{"processed//1.jpg", false},
+		{"processed/../1.jpg", false},
+		{"..", false},
+		{"processed/./1.jpg", false},
+		{"processed\\1.jpg", false},
+		{"processed/1\n.jpg", false},
+		{"processed/\xff.jpg", false},
+		{string(make([]byte, maxKeyLength+1)), false},
+	}
+	for _, tt := range tests {
+		err := ValidateKey(tt.key)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateKey(%q) = %v, want ok %v", tt.key, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrUnsafeKey) {
+			t.Errorf("ValidateKey(%q) = %v, want ErrUnsafeKey", tt.key, err)
+		}
+	}
+}
+
+func TestOutputBucketAllowed(t *testing.T) {
+	allowed := []string{"cdn"}
+	tests := []struct {
+		bucket string
+		want   bool
+	}{
+		{"", true},
+		{"source", true},
+		{"cdn", true},
+		{"logos", false},
+	}
+	for _, tt := range tests {
+		if got := OutputBucketAllowed(tt.bucket, "source", allowed); got != tt.want {
+			t.Errorf("OutputBucketAllowed(%q) = %v, want %v", tt.bucket, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,724 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// Metadata policies accepted by the pipeline
+const (
+	MetadataStrip        = "strip"         // drop everything (default)
+	MetadataKeep         = "keep"          // keep EXIF, ICC and XMP
+	MetadataICCCopyright = "icc_copyright" // keep the ICC profile and the EXIF copyright only
+	MetadataStripGPS     = "strip_gps"     // keep everything except GPS data
+)
+
+// Metadata holds the metadata payloads extracted from a source image
+type Metadata struct {
+	EXIF []byte // TIFF structure, without the "Exif\x00\x00" header
+	ICC  []byte // complete ICC profile
+	XMP  []byte // XMP packet, without the namespace header
+}
+
+var (
+	jpegEXIFHeader = []byte("Exif\x00\x00")
+	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+
+	errInflatedTooLarge = errors.New("compressed metadata inflates past the limit")
+)
+
+// maxInflatedSize bounds compressed PNG ICC profiles and XMP packets, a few
+// KB of zlib can otherwise inflate to gigabytes
+const maxInflatedSize = 4 << 20
+
+// WebP extended format (VP8X) flags
+const (
+	webpFlagICC  = 0x20
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+const (
+	jpegMaxSegment = 65535 - 2 // segment payload limit, the length field counts itself
+	pngXMPKeyword  = "XML:com.adobe.xmp"
+
+	tiffTagCopyright   = 0x8298
+	tiffTagGPSIFD      = 0x8825
+	tiffTagThumbOffset = 0x0201
+	tiffTagThumbLength = 0x0202
+	tiffEntrySize      = 12
+	tiffTypeASCII      = 2
+	tiffHeaderSize     = 8
+	tiffMaxIFDEntries  = 1000
+	tiffNextIFDSize    = 4
+)
+
+// IsEmpty reports whether there is nothing to embed
+func (m *Metadata) IsEmpty() bool {
+	return m == nil || (len(m.EXIF) == 0 && len(m.ICC) == 0 && len(m.XMP) == 0)
+}
+
+// ExtractMetadata reads EXIF, ICC and XMP from a JPEG, PNG or WebP source.
+// Extraction is best-effort: malformed segments end the scan and whatever
+// was found before them is returned. Other formats yield empty metadata.
+func ExtractMetadata(data []byte) *Metadata {
+	switch {
+	case len(data) > 2 && data[0] == 0xFF && data[1] == 0xD8:
+		return extractJPEGMetadata(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return extractPNGMetadata(data)
+	case isWebP(data):
+		return extractWebPMetadata(data)
+	default:
+		return &Metadata{}
+	}
+}
+
+func extractJPEGMetadata(data []byte) *Metadata {
+	md := &Metadata{}
+	iccChunks := map[int][]byte{}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xFF { // fill byte
+			pos++
+			continue
+		}
+		if marker == 0xD9 || marker == 0xDA { // EOI or SOS, no metadata past this point
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { // standalone markers
+			pos += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		payload := data[pos+4 : pos+2+length]
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegEXIFHeader):
+			md.EXIF = bytes.Clone(payload[len(jpegEXIFHeader):])
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegXMPHeader):
+			md.XMP = bytes.Clone(payload[len(jpegXMPHeader):])
+		case marker == 0xE2 && bytes.HasPrefix(payload, jpegICCHeader) && len(payload) > len(jpegICCHeader)+2:
+			seq := int(payload[len(jpegICCHeader)])
+			iccChunks[seq] = payload[len(jpegICCHeader)+2:]
+		}
+
+		pos += 2 + length
+	}
+
+	if len(iccChunks) > 0 {
+		seqs := make([]int, 0, len(iccChunks))
+		for seq := range iccChunks {
+			seqs = append(seqs, seq)
+		}
+		sort.Ints(seqs)
+		var icc []byte
+		for _, seq := range seqs {
+			icc = append(icc, iccChunks[seq]...)
+		}
+		md.ICC = icc
+	}
+
+	return md
+}
+
+func extractPNGMetadata(data []byte) *Metadata {
+	md := &Metadata{}
+
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			break
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		chunk := data[pos+8 : pos+8+length]
+
+		switch chunkType {
+		case "iCCP":
+			// profile name, null separator, compression method, zlib stream
+			if i := bytes.IndexByte(chunk, 0); i >= 0 && i+2 <= len(chunk) {
+				if icc, err := inflate(chunk[i+2:]); err == nil {
+					md.ICC = icc
+				}
+			}
+		case "eXIf":
+			md.EXIF = bytes.Clone(chunk)
+		case "iTXt":
+			if xmp, ok := parsePNGXMP(chunk); ok {
+				md.XMP = xmp
+			}
+		case "IDAT", "IEND":
+			return md
+		}
+
+		pos += 12 + length
+	}
+
+	return md
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// webpChunk is a RIFF chunk of a WebP file
+type webpChunk struct {
+	fourCC string
+	data   []byte
+	raw    []byte // header, data and padding as stored
+}
+
+// webpChunks splits a WebP file into its chunks, stopping at the first
+// chunk that runs past the end
+func webpChunks(data []byte) []webpChunk {
+	var chunks []webpChunk
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size
+		if size < 0 || end > len(data) {
+			break
+		}
+		padded := min(end+size%2, len(data))
+		chunks = append(chunks, webpChunk{
+			fourCC: string(data[pos : pos+4]),
+			data:   data[pos+8 : end],
+			raw:    data[pos:padded],
+		})
+		pos = padded
+	}
+	return chunks
+}
+
+func extractWebPMetadata(data []byte) *Metadata {
+	md := &Metadata{}
+	for _, chunk := range webpChunks(data) {
+		switch chunk.fourCC {
+		case "ICCP":
+			md.ICC = bytes.Clone(chunk.data)
+		case "EXIF":
+			// the header isn't part of the chunk, but some writers add it
+			md.EXIF = bytes.Clone(bytes.TrimPrefix(chunk.data, jpegEXIFHeader))
+		case "XMP ":
+			md.XMP = bytes.Clone(chunk.data)
+		}
+	}
+	return md
+}
+
+// parsePNGXMP extracts an XMP packet from an iTXt chunk
+func parsePNGXMP(chunk []byte) ([]byte, bool) {
+	keyword, rest, ok := bytes.Cut(chunk, []byte{0})
+	if !ok || string(keyword) != pngXMPKeyword || len(rest) < 2 {
+		return nil, false
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+	// skip language tag and translated keyword
+	for range 2 {
+		if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+			return nil, false
+		}
+	}
+	if compressed {
+		text, err := inflate(rest)
+		if err != nil {
+			return nil, false
+		}
+		return text, true
+	}
+	return bytes.Clone(rest), true
+}
+
+// FilterMetadata applies a metadata policy and returns what should be
+// written into the encoded output. Any embedded EXIF thumbnail is dropped
+// since it would show the unprocessed source.
+func FilterMetadata(md *Metadata, policy string) *Metadata {
+	if md == nil {
+		return &Metadata{}
+	}
+
+	switch policy {
+	case MetadataKeep:
+		return &Metadata{
+			EXIF: dropEXIFThumbnail(md.EXIF),
+			ICC:  md.ICC,
+			XMP:  md.XMP,
+		}
+	case MetadataICCCopyright:
+		out := &Metadata{ICC: md.ICC}
+		if copyright := exifCopyright(md.EXIF); copyright != "" {
+			out.EXIF = buildCopyrightEXIF(copyright)
+		}
+		return out
+	case MetadataStripGPS:
+		return &Metadata{
+			EXIF: stripEXIFGPS(dropEXIFThumbnail(md.EXIF)),
+			ICC:  md.ICC,
+			XMP:  stripXMPGPS(md.XMP),
+		}
+	default:
+		return &Metadata{}
+	}
+}
+
+// EmbedMetadata inserts metadata into an image encoded by Compress
+func EmbedMetadata(encoded []byte, format string, md *Metadata) ([]byte, error) {
+	if md.IsEmpty() {
+		return encoded, nil
+	}
+
+	switch format {
+	case "png":
+		return embedPNGMetadata(encoded, md)
+	case "webp":
+		return embedWebPMetadata(encoded, md)
+	default:
+		return embedJPEGMetadata(encoded, md)
+	}
+}
+
+func embedJPEGMetadata(encoded []byte, md *Metadata) ([]byte, error) {
+	if len(encoded) < 2 || encoded[0] != 0xFF || encoded[1] != 0xD8 {
+		return nil, fmt.Errorf("embed metadata: output is not a JPEG stream")
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(encoded) + len(md.EXIF) + len(md.ICC) + len(md.XMP) + 64)
+	out.Write(encoded[:2])
+
+	// EXIF must directly follow SOI to be picked up by most readers
+	if len(md.EXIF) > 0 && len(jpegEXIFHeader)+len(md.EXIF) <= jpegMaxSegment {
+		writeJPEGSegment(&out, 0xE1, jpegEXIFHeader, md.EXIF)
+	}
+
+	if len(md.ICC) > 0 {
+		chunkSize := jpegMaxSegment - len(jpegICCHeader) - 2
+		count := (len(md.ICC) + chunkSize - 1) / chunkSize
+		if count <= 255 {
+			for i := range count {
+				end := min((i+1)*chunkSize, len(md.ICC))
+				header := append(bytes.Clone(jpegICCHeader), byte(i+1), byte(count))
+				writeJPEGSegment(&out, 0xE2, header, md.ICC[i*chunkSize:end])
+			}
+		}
+	}
+
+	// extended XMP is not supported, oversized packets are dropped
+	if len(md.XMP) > 0 && len(jpegXMPHeader)+len(md.XMP) <= jpegMaxSegment {
+		writeJPEGSegment(&out, 0xE1, jpegXMPHeader, md.XMP)
+	}
+
+	out.Write(encoded[2:])
+	return out.Bytes(), nil
+}
+
+func writeJPEGSegment(w *bytes.Buffer, marker byte, header, payload []byte) {
+	w.Write([]byte{0xFF, marker})
+	binary.Write(w, binary.BigEndian, uint16(2+len(header)+len(payload)))
+	w.Write(header)
+	w.Write(payload)
+}
+
+func embedPNGMetadata(encoded []byte, md *Metadata) ([]byte, error) {
+	// IHDR is always the first chunk: signature + length + type + 13 bytes + crc
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	if !bytes.HasPrefix(encoded, pngSignature) || len(encoded) < ihdrEnd {
+		return nil, fmt.Errorf("embed metadata: output is not a PNG stream")
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(encoded) + len(md.EXIF) + len(md.ICC) + len(md.XMP) + 64)
+	out.Write(encoded[:ihdrEnd])
+
+	if len(md.ICC) > 0 {
+		var chunk bytes.Buffer
+		chunk.WriteString("ICC profile")
+		chunk.Write([]byte{0, 0}) // null separator, deflate compression
+		zw := zlib.NewWriter(&chunk)
+		if _, err := zw.Write(md.ICC); err != nil {
+			return nil, fmt.Errorf("embed metadata: compress ICC profile: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("embed metadata: compress ICC profile: %w", err)
+		}
+		writePNGChunk(&out, "iCCP", chunk.Bytes())
+	}
+
+	if len(md.EXIF) > 0 {
+		writePNGChunk(&out, "eXIf", md.EXIF)
+	}
+
+	if len(md.XMP) > 0 {
+		var chunk bytes.Buffer
+		chunk.WriteString(pngXMPKeyword)
+		chunk.Write([]byte{0, 0, 0, 0, 0}) // separator, uncompressed, method, empty language and translated keyword
+		chunk.Write(md.XMP)
+		writePNGChunk(&out, "iTXt", chunk.Bytes())
+	}
+
+	out.Write(encoded[ihdrEnd:])
+	return out.Bytes(), nil
+}
+
+func writePNGChunk(w *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	w.WriteString(chunkType)
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// embedWebPMetadata turns the lossless WebP written by Compress into the
+// extended format, which is the only one that can carry metadata
+func embedWebPMetadata(encoded []byte, md *Metadata) ([]byte, error) {
+	if !isWebP(encoded) {
+		return nil, fmt.Errorf("embed metadata: output is not a WebP stream")
+	}
+	chunks := webpChunks(encoded)
+	if len(chunks) != 1 {
+		return nil, fmt.Errorf("embed metadata: expected a single image chunk")
+	}
+	img := chunks[0]
+	if img.fourCC != "VP8L" || len(img.data) < 5 || img.data[0] != 0x2f {
+		return nil, fmt.Errorf("embed metadata: unsupported WebP chunk %q", img.fourCC)
+	}
+	bits := binary.LittleEndian.Uint32(img.data[1:])
+	width := int(bits&0x3fff) + 1
+	height := int(bits>>14&0x3fff) + 1
+
+	// VP8L carries its own alpha bit, decoders read that one and
+	// x/image/webp rejects the VP8X alpha flag next to VP8L
+	var flags byte
+	if len(md.ICC) > 0 {
+		flags |= webpFlagICC
+	}
+	if len(md.EXIF) > 0 {
+		flags |= webpFlagEXIF
+	}
+	if len(md.XMP) > 0 {
+		flags |= webpFlagXMP
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	vp8x := make([]byte, 10)
+	vp8x[0] = flags
+	putUint24LE(vp8x[4:], uint32(width-1))
+	putUint24LE(vp8x[7:], uint32(height-1))
+	writeWebPChunk(&body, "VP8X", vp8x)
+	// ICCP precedes the image, EXIF and XMP follow it
+	if len(md.ICC) > 0 {
+		writeWebPChunk(&body, "ICCP", md.ICC)
+	}
+	body.Write(img.raw)
+	if len(img.raw)%2 != 0 {
+		body.WriteByte(0)
+	}
+	if len(md.EXIF) > 0 {
+		writeWebPChunk(&body, "EXIF", md.EXIF)
+	}
+	if len(md.XMP) > 0 {
+		writeWebPChunk(&body, "XMP ", md.XMP)
+	}
+
+	out := make([]byte, 0, 8+body.Len())
+	out = append(out, "RIFF"...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(body.Len()))
+	return append(out, body.Bytes()...), nil
+}
+
+func writeWebPChunk(w *bytes.Buffer, fourCC string, data []byte) {
+	w.WriteString(fourCC)
+	binary.Write(w, binary.LittleEndian, uint32(len(data)))
+	w.Write(data)
+	if len(data)%2 != 0 {
+		w.WriteByte(0)
+	}
+}
+
+func putUint24LE(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// tiff is a minimal view over an EXIF TIFF structure
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	offset int // position of the 12-byte entry inside data
+	tag    uint16
+	typ    uint16
+	count  uint32
+}
+
+func parseTIFF(data []byte) (*tiff, bool) {
+	if len(data) < tiffHeaderSize {
+		return nil, false
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, false
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil, false
+	}
+	return &tiff{data: data, order: order}, true
+}
+
+func (t *tiff) ifd0Offset() int {
+	return int(t.order.Uint32(t.data[4:]))
+}
+
+// entries returns the entries of the IFD at offset and the position of its
+// next-IFD pointer
+func (t *tiff) entries(offset int) ([]tiffEntry, int, bool) {
+	if offset < tiffHeaderSize || offset+2 > len(t.data) {
+		return nil, 0, false
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	end := offset + 2 + n*tiffEntrySize
+	if n > tiffMaxIFDEntries || end+tiffNextIFDSize > len(t.data) {
+		return nil, 0, false
+	}
+	out := make([]tiffEntry, n)
+	for i := range n {
+		pos := offset + 2 + i*tiffEntrySize
+		out[i] = tiffEntry{
+			offset: pos,
+			tag:    t.order.Uint16(t.data[pos:]),
+			typ:    t.order.Uint16(t.data[pos+2:]),
+			count:  t.order.Uint32(t.data[pos+4:]),
+		}
+	}
+	return out, end, true
+}
+
+func (t *tiff) uint32At(pos int) int {
+	return int(t.order.Uint32(t.data[pos:]))
+}
+
+// valueRange returns where the value of an entry lives, and whether it is
+// stored out of line (i.e. at an offset rather than inside the entry)
+func (t *tiff) valueRange(e tiffEntry) (start, end int, outOfLine bool) {
+	size := int(e.count) * tiffTypeSize(e.typ)
+	if size <= 4 {
+		return e.offset + 8, e.offset + 8 + size, false
+	}
+	start = t.uint32At(e.offset + 8)
+	return start, start + size, true
+}
+
+// zero clears a byte range, ignoring ranges outside the structure
+func (t *tiff) zero(start, end int) {
+	if start < 0 || end > len(t.data) || start >= end {
+		return
+	}
+	clear(t.data[start:end])
+}
+
+func tiffTypeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// removeEntry deletes an entry from the IFD at offset, shifting the
+// following entries and the next-IFD pointer up
+func (t *tiff) removeEntry(offset int, entries []tiffEntry, next int, idx int) {
+	pos := entries[idx].offset
+	copy(t.data[pos:], t.data[pos+tiffEntrySize:next+tiffNextIFDSize])
+	t.zero(next+tiffNextIFDSize-tiffEntrySize, next+tiffNextIFDSize)
+	t.order.PutUint16(t.data[offset:], uint16(len(entries)-1))
+}
+
+// stripEXIFGPS removes the GPS IFD pointer from IFD0 and zeroes the GPS
+// data so it cannot be recovered from the embedded bytes
+func stripEXIFGPS(exif []byte) []byte {
+	t, ok := parseTIFF(bytes.Clone(exif))
+	if !ok {
+		return nil
+	}
+
+	offset := t.ifd0Offset()
+	entries, next, ok := t.entries(offset)
+	if !ok {
+		return nil
+	}
+
+	for i, e := range entries {
+		if e.tag != tiffTagGPSIFD {
+			continue
+		}
+		gpsOffset := t.uint32At(e.offset + 8)
+		if gpsEntries, gpsNext, ok := t.entries(gpsOffset); ok {
+			for _, ge := range gpsEntries {
+				if start, end, outOfLine := t.valueRange(ge); outOfLine {
+					t.zero(start, end)
+				}
+			}
+			t.zero(gpsOffset, gpsNext+tiffNextIFDSize)
+		}
+		t.removeEntry(offset, entries, next, i)
+		break
+	}
+
+	return t.data
+}
+
+// dropEXIFThumbnail unlinks IFD1 and zeroes the thumbnail it points at
+func dropEXIFThumbnail(exif []byte) []byte {
+	if len(exif) == 0 {
+		return nil
+	}
+	t, ok := parseTIFF(bytes.Clone(exif))
+	if !ok {
+		return nil
+	}
+
+	_, next, ok := t.entries(t.ifd0Offset())
+	if !ok {
+		return nil
+	}
+
+	ifd1 := t.uint32At(next)
+	if ifd1 == 0 {
+		return t.data
+	}
+	if entries, ifd1Next, ok := t.entries(ifd1); ok {
+		var thumbOffset, thumbLength int
+		for _, e := range entries {
+			switch e.tag {
+			case tiffTagThumbOffset:
+				thumbOffset = t.uint32At(e.offset + 8)
+			case tiffTagThumbLength:
+				thumbLength = t.uint32At(e.offset + 8)
+			}
+			if start, end, outOfLine := t.valueRange(e); outOfLine {
+				t.zero(start, end)
+			}
+		}
+		t.zero(thumbOffset, thumbOffset+thumbLength)
+		t.zero(ifd1, ifd1Next+tiffNextIFDSize)
+	}
+	t.order.PutUint32(t.data[next:], 0)
+
+	return t.data
+}
+
+// exifCopyright returns the Copyright tag of IFD0, if any
+func exifCopyright(exif []byte) string {
+	t, ok := parseTIFF(exif)
+	if !ok {
+		return ""
+	}
+	entries, _, ok := t.entries(t.ifd0Offset())
+	if !ok {
+		return ""
+	}
+	for _, e := range entries {
+		if e.tag != tiffTagCopyright || e.typ != tiffTypeASCII {
+			continue
+		}
+		start, end, _ := t.valueRange(e)
+		if start < 0 || end > len(t.data) || start > end {
+			return ""
+		}
+		return string(bytes.TrimRight(t.data[start:end], "\x00"))
+	}
+	return ""
+}
+
+// buildCopyrightEXIF writes a little-endian TIFF whose IFD0 only holds the
+// Copyright tag
+func buildCopyrightEXIF(copyright string) []byte {
+	value := append([]byte(copyright), 0)
+	valueOffset := tiffHeaderSize + 2 + tiffEntrySize + tiffNextIFDSize
+
+	buf := make([]byte, valueOffset, valueOffset+len(value))
+	le := binary.LittleEndian
+	copy(buf, "II")
+	le.PutUint16(buf[2:], 42)
+	le.PutUint32(buf[4:], tiffHeaderSize)
+	le.PutUint16(buf[8:], 1)
+	le.PutUint16(buf[10:], tiffTagCopyright)
+	le.PutUint16(buf[12:], tiffTypeASCII)
+	le.PutUint32(buf[14:], uint32(len(value)))
+	if len(value) <= 4 {
+		copy(buf[18:22], value)
+		return buf
+	}
+	le.PutUint32(buf[18:], uint32(valueOffset))
+	// next IFD pointer (buf[22:26]) stays zero
+	return append(buf, value...)
+}
+
+var (
+	xmpGPSAttr    = regexp.MustCompile(`\s+exif:GPS\w+="[^"]*"`)
+	xmpGPSElement = regexp.MustCompile(`(?s)<exif:GPS(\w+)\b[^>]*?(?:/>|>.*?</exif:GPS\w+>)`)
+)
+
+// stripXMPGPS removes exif:GPS* properties from an XMP packet
+func stripXMPGPS(xmp []byte) []byte {
+	if len(xmp) == 0 {
+		return nil
+	}
+	xmp = xmpGPSAttr.ReplaceAll(xmp, nil)
+	return xmpGPSElement.ReplaceAll(xmp, nil)
+}
+
+// inflate decompresses a zlib stream of at most maxInflatedSize bytes
+func inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxInflatedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxInflatedSize {
+		return nil, errInflatedTooLarge
+	}
+	return out, nil
+}
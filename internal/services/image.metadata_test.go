@@ -0,0 +1,283 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	testCopyright = "ACME Photo"
+	testLatitude  = []byte("LAT1LAT2LAT3LAT4LAT5LAT6") // 3 rationals
+	testThumbnail = []byte("\xFF\xD8THUMBNAIL-PIXELS\xFF\xD9")
+	testXMP       = []byte(`<rdf:Description exif:GPSLatitude="52,22.1N" dc:creator="ACME"><exif:GPSAltitude>12</exif:GPSAltitude></rdf:Description>`)
+)
+
+// testEXIF builds a big-endian TIFF with a copyright and a GPS IFD in IFD0
+// and a thumbnail in IFD1
+func testEXIF() []byte {
+	be := binary.BigEndian
+	const (
+		ifd0      = 8
+		copyOff   = ifd0 + 2 + 2*tiffEntrySize + tiffNextIFDSize
+		gpsOff    = copyOff + 12
+		latOff    = gpsOff + 2 + tiffEntrySize + tiffNextIFDSize
+		ifd1      = latOff + 24
+		thumbOff  = ifd1 + 2 + 2*tiffEntrySize + tiffNextIFDSize
+		copyCount = 11 // "ACME Photo" and its terminator
+	)
+	entry := func(b []byte, tag, typ uint16, count, value uint32) []byte {
+		b = be.AppendUint16(b, tag)
+		b = be.AppendUint16(b, typ)
+		b = be.AppendUint32(b, count)
+		return be.AppendUint32(b, value)
+	}
+
+	b := []byte("MM\x00\x2a")
+	b = be.AppendUint32(b, ifd0)
+	b = be.AppendUint16(b, 2)
+	b = entry(b, tiffTagCopyright, tiffTypeASCII, copyCount, copyOff)
+	b = entry(b, tiffTagGPSIFD, 4, 1, gpsOff)
+	b = be.AppendUint32(b, ifd1)
+	b = append(b, testCopyright+"\x00\x00"...) // padded to an even offset
+	b = be.AppendUint16(b, 1)
+	b = entry(b, 0x0002, 5, 3, latOff) // GPSLatitude
+	b = be.AppendUint32(b, 0)
+	b = append(b, testLatitude...)
+	b = be.AppendUint16(b, 2)
+	b = entry(b, tiffTagThumbOffset, 4, 1, thumbOff)
+	b = entry(b, tiffTagThumbLength, 4, 1, uint32(len(testThumbnail)))
+	b = be.AppendUint32(b, 0)
+	return append(b, testThumbnail...)
+}
+
+func testMetadata() *Metadata {
+	// large enough to be split across JPEG APP2 segments
+	icc := bytes.Repeat(buildICCProfile(targetSpaces[ColorProfileDisplayP3]), 200)
+	return &Metadata{EXIF: testEXIF(), ICC: icc, XMP: testXMP}
+}
+
+func encodeTestImage(t *testing.T, format string) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	img.Set(0, 0, color.NRGBA{R: 10, G: 20, B: 30, A: 255})
+	var buf bytes.Buffer
+	if err := Compress(img, CompressParams{Format: format, Quality: 90}, &buf); err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	md := testMetadata()
+	if len(md.ICC) <= jpegMaxSegment {
+		t.Fatalf("test ICC profile is %d bytes, want it split across segments", len(md.ICC))
+	}
+
+	for _, format := range []string{"jpeg", "png", "webp"} {
+		t.Run(format, func(t *testing.T) {
+			out, err := EmbedMetadata(encodeTestImage(t, format), format, md)
+			if err != nil {
+				t.Fatalf("EmbedMetadata: %v", err)
+			}
+			if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+				t.Fatalf("output does not decode: %v", err)
+			}
+
+			got := ExtractMetadata(out)
+			if !bytes.Equal(got.EXIF, md.EXIF) {
+				t.Error("EXIF changed")
+			}
+			if !bytes.Equal(got.ICC, md.ICC) {
+				t.Errorf("ICC is %d bytes, want %d", len(got.ICC), len(md.ICC))
+			}
+			if !bytes.Equal(got.XMP, md.XMP) {
+				t.Errorf("XMP = %q", got.XMP)
+			}
+		})
+	}
+}
+
+func TestEmbedMetadataEmpty(t *testing.T) {
+	encoded := encodeTestImage(t, "png")
+	out, err := EmbedMetadata(encoded, "png", &Metadata{})
+	if err != nil || !bytes.Equal(out, encoded) {
+		t.Errorf("EmbedMetadata with no metadata = %d bytes, %v; want the input", len(out), err)
+	}
+	if _, err := EmbedMetadata([]byte("not an image"), "jpeg", testMetadata()); err == nil {
+		t.Error("embedding into a non-JPEG stream succeeded")
+	}
+}
+
+func TestFilterMetadata(t *testing.T) {
+	md := testMetadata()
+
+	tests := []struct {
+		policy    string
+		gps       bool
+		copyright bool
+		icc       bool
+		xmp       bool
+	}{
+		{MetadataStrip, false, false, false, false},
+		{MetadataKeep, true, true, true, true},
+		{MetadataICCCopyright, false, true, true, false},
+		{MetadataStripGPS, false, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			got := FilterMetadata(md, tt.policy)
+
+			if hasGPS := bytes.Contains(got.EXIF, testLatitude) || hasIFD0Tag(got.EXIF, tiffTagGPSIFD); hasGPS != tt.gps {
+				t.Errorf("GPS present = %v, want %v", hasGPS, tt.gps)
+			}
+			if copyright := exifCopyright(got.EXIF); (copyright == testCopyright) != tt.copyright {
+				t.Errorf("copyright = %q", copyright)
+			}
+			if (len(got.ICC) > 0) != tt.icc {
+				t.Errorf("ICC present = %v, want %v", len(got.ICC) > 0, tt.icc)
+			}
+			if (len(got.XMP) > 0) != tt.xmp {
+				t.Errorf("XMP present = %v, want %v", len(got.XMP) > 0, tt.xmp)
+			}
+			if bytes.Contains(got.XMP, []byte("GPS")) != (tt.gps && tt.xmp) {
+				t.Errorf("XMP = %q", got.XMP)
+			}
+
+			// the thumbnail would show the unprocessed source
+			if bytes.Contains(got.EXIF, testThumbnail) {
+				t.Error("thumbnail kept")
+			}
+			if t2, ok := parseTIFF(got.EXIF); ok {
+				if _, next, ok := t2.entries(t2.ifd0Offset()); ok && t2.uint32At(next) != 0 {
+					t.Error("IFD1 still linked")
+				}
+			}
+		})
+	}
+
+	if !bytes.Equal(md.EXIF, testEXIF()) {
+		t.Error("filtering modified the source EXIF")
+	}
+	if strip := stripXMPGPS(testXMP); !bytes.Contains(strip, []byte(`dc:creator="ACME"`)) {
+		t.Errorf("stripXMPGPS removed other properties: %q", strip)
+	}
+}
+
+func hasIFD0Tag(exif []byte, tag uint16) bool {
+	t, ok := parseTIFF(exif)
+	if !ok {
+		return false
+	}
+	entries, _, ok := t.entries(t.ifd0Offset())
+	if !ok {
+		return false
+	}
+	for _, e := range entries {
+		if e.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMalformedEXIF(t *testing.T) {
+	valid := testEXIF()
+	put32 := func(pos int, v uint32) []byte {
+		b := bytes.Clone(valid)
+		binary.BigEndian.PutUint32(b[pos:], v)
+		return b
+	}
+	put16 := func(pos int, v uint16) []byte {
+		b := bytes.Clone(valid)
+		binary.BigEndian.PutUint16(b[pos:], v)
+		return b
+	}
+	gpsValue := 8 + 2 + tiffEntrySize + 8
+	next := 8 + 2 + 2*tiffEntrySize
+
+	tests := []struct {
+		name string
+		exif []byte
+	}{
+		{"empty", nil},
+		{"header only", valid[:8]},
+		{"bad byte order", append([]byte("XX"), valid[2:]...)},
+		{"ifd0 past the end", put32(4, 0xfffffff0)},
+		{"ifd0 inside the header", put32(4, 2)},
+		{"too many entries", put16(8, 0xffff)},
+		{"gps ifd past the end", put32(gpsValue, 0xfffffff0)},
+		{"gps ifd inside the header", put32(gpsValue, 0)},
+		{"ifd1 past the end", put32(next, 0xfffffff0)},
+		{"ifd1 loops to ifd0", put32(next, 8)},
+		{"copyright past the end", put32(8+2+8, 0xfffffff0)},
+		{"huge copyright count", put32(8+2+4, 0xffffffff)},
+	}
+	// every truncation of a valid structure as well
+	for n := range len(valid) {
+		tests = append(tests, struct {
+			name string
+			exif []byte
+		}{"truncated", valid[:n]})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := &Metadata{EXIF: tt.exif}
+			for _, policy := range []string{MetadataStrip, MetadataKeep, MetadataICCCopyright, MetadataStripGPS} {
+				FilterMetadata(md, policy)
+			}
+			exifCopyright(tt.exif)
+		})
+	}
+}
+
+func TestExtractMetadataTruncated(t *testing.T) {
+	md := testMetadata()
+	for _, format := range []string{"jpeg", "png", "webp"} {
+		out, err := EmbedMetadata(encodeTestImage(t, format), format, md)
+		if err != nil {
+			t.Fatalf("%s: EmbedMetadata: %v", format, err)
+		}
+		for n := 0; n < len(out); n += len(out)/500 + 1 {
+			ExtractMetadata(out[:n])
+		}
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	compress := func(n int) []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(make([]byte, n))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	if out, err := inflate(compress(maxInflatedSize)); err != nil || len(out) != maxInflatedSize {
+		t.Errorf("inflate at the limit = %d bytes, %v", len(out), err)
+	}
+	bomb := compress(16 * maxInflatedSize)
+	if len(bomb) > 256<<10 {
+		t.Fatalf("bomb is %d bytes, want it small", len(bomb))
+	}
+	if _, err := inflate(bomb); !errors.Is(err, errInflatedTooLarge) {
+		t.Errorf("inflate past the limit = %v, want errInflatedTooLarge", err)
+	}
+
+	// a PNG iCCP chunk that inflates past the limit is dropped
+	out, err := EmbedMetadata(encodeTestImage(t, "png"), "png", &Metadata{ICC: make([]byte, maxInflatedSize+1)})
+	if err != nil {
+		t.Fatalf("EmbedMetadata: %v", err)
+	}
+	if md := ExtractMetadata(out); md.ICC != nil {
+		t.Errorf("extracted a %d byte ICC profile past the limit", len(md.ICC))
+	}
+}
@@ -9,17 +9,24 @@ import (
 	"image/png"
 	"io"
 	"math"
+	"slices"
+	"strings"
 
+	"github.com/HugoSmits86/nativewebp"
 	"github.com/disintegration/imaging"
 	"github.com/fogleman/gg"
+	"golang.org/x/image/font"
+	// Registers the decoder, for WebP sources and reading outputs back
+	_ "golang.org/x/image/webp"
 )
 
 // CompressParams defines image compression parameters
 type CompressParams struct {
-	Quality   int
-	Format    string
-	MaxWidth  int
-	MaxHeight int
+	Quality     int    // JPEG only, WebP is encoded lossless
+	Format      string // jpeg, png or webp
+	MaxWidth    int
+	MaxHeight   int
+	AutoSharpen bool // sharpen after downscaling to counter resampling softness
 }
 
 // WatermarkParams defines watermark parameters
@@ -28,14 +35,45 @@ type WatermarkParams struct {
 	Position string
 	Opacity  float64
 	FontSize float64
+	Font     string // registered font name, DefaultFont when empty
 	Color    string // hex color, e.g., "#FFFFFF"
+
+	Mode         string  // "single" (default) or "tile"
+	Angle        float64 // rotation in degrees, counter-clockwise
+	Spacing      float64 // gap between tiles in pixels
+	Align        string  // left, center or right for multi-line text
+	WrapWidth    float64 // wrap lines at this fraction of the image width, 0 disables wrapping
+	LineHeight   float64 // line height as a multiple of the font height
+	StrokeWidth  float64
+	StrokeColor  string
+	ShadowOffset float64
+	ShadowColor  string
+}
+
+// OverlayParams defines logo overlay parameters
+type OverlayParams struct {
+	Logo     image.Image
+	Position string
+	Scale    float64 // logo width as a fraction of the image width
+	Opacity  float64
+	Margin   int
+}
+
+// LogoBucketAllowed reports whether an overlay may read its logo from bucket:
+// the job's own bucket, which an empty bucket means, or one of allowed
+func LogoBucketAllowed(bucket, jobBucket string, allowed []string) bool {
+	return bucket == "" || bucket == jobBucket || slices.Contains(allowed, bucket)
 }
 
 // Compress processes resizing and encoding based on CompressParams
 func Compress(img image.Image, params CompressParams, out io.Writer) error {
 	// Handle Resizing
 	if params.MaxWidth > 0 || params.MaxHeight > 0 {
+		before := img.Bounds().Dx()
 		img = imaging.Fit(img, params.MaxWidth, params.MaxHeight, imaging.Lanczos)
+		if params.AutoSharpen && img.Bounds().Dx() < before {
+			img = ApplySharpen(img, autoSharpen)
+		}
 	}
 
 	// Handle Format and Quality
@@ -45,27 +83,43 @@ func Compress(img image.Image, params CompressParams, out io.Writer) error {
 		if quality < 1 || quality > 100 {
 			quality = 85
 		}
-		return jpeg.Encode(out, img, &jpeg.Options{Quality: quality})
+		return jpeg.Encode(out, flattenForJPEG(img), &jpeg.Options{Quality: quality})
 	case "png":
 		enc := png.Encoder{CompressionLevel: png.DefaultCompression}
 		return enc.Encode(out, img)
+	case "webp":
+		// Lossless, the quality doesn't apply
+		return nativewebp.Encode(out, img, nil)
 	default:
-		return jpeg.Encode(out, img, &jpeg.Options{Quality: 85})
+		return jpeg.Encode(out, flattenForJPEG(img), &jpeg.Options{Quality: 85})
+	}
+}
+
+// flattenForJPEG puts transparent images on white, JPEG has no alpha and the
+// encoder would otherwise show premultiplied pixels on black. Use the
+// flatten operation beforehand to pick another background.
+func flattenForJPEG(img image.Image) image.Image {
+	if isOpaque(img) {
+		return img
 	}
+	return ApplyFlatten(img, "")
 }
 
-// ApplyWatermark overlays text on the image
+// ApplyWatermark overlays text on the image, either once at an anchor
+// position or tiled across the whole image
 func ApplyWatermark(img image.Image, params WatermarkParams) (image.Image, error) {
 	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
+	width := float64(bounds.Dx())
+	height := float64(bounds.Dy())
 
 	// Create a new RGBA image to draw on
 	dst := image.NewRGBA(bounds)
 	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
 
-	// Create gg context for drawing text
-	dc := gg.NewContextForRGBA(dst)
+	// Text is drawn opaque on its own layer and blended once, so strokes and
+	// shadows don't show through semi-transparent glyphs
+	layer := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	dc := gg.NewContextForRGBA(layer)
 
 	// Set font size
 	fontSize := params.FontSize
@@ -73,45 +127,254 @@ func ApplyWatermark(img image.Image, params WatermarkParams) (image.Image, error
 		fontSize = 24
 	}
 
-	// Load font (using gg's default font with error handling)
-	// Try to load a system font, fallback to gg's default if not found
-	if err := dc.LoadFontFace("Arial", fontSize); err != nil {
-		// If Arial fails, try other common fonts
-		if err := dc.LoadFontFace("Helvetica", fontSize); err != nil {
-			// Use gg's built-in font as final fallback
-			// gg will use its default font when LoadFontFace fails
-		}
+	// Load font from the registry, unknown fonts are an error rather than
+	// silently falling back to gg's fixed-size default face
+	face, err := FontFace(params.Font, fontSize)
+	if err != nil {
+		return nil, err
 	}
+	defer face.Close()
+	dc.SetFontFace(face)
 
-	// Parse color
-	c := parseColor(params.Color)
-	alpha := uint8(math.Max(0, math.Min(255, params.Opacity*255)))
-	textColor := color.RGBA{c.R, c.G, c.B, alpha}
+	block := layoutText(dc, params, width)
+	if len(block.lines) == 0 {
+		return dst, nil
+	}
 
-	dc.SetColor(textColor)
+	if params.Mode == "tile" {
+		drawTiled(dc, face, block, params, width, height)
+		blendLayer(dst, layer, params.Opacity)
+		return dst, nil
+	}
 
-	// Calculate position
-	text := params.Text
-	tw, th := dc.MeasureString(text)
+	// Place the rotated bounding box of the text block at the anchor
+	const margin = 20.0
+	angle := gg.Radians(params.Angle)
+	bw := math.Abs(block.width*math.Cos(angle)) + math.Abs(block.height*math.Sin(angle))
+	bh := math.Abs(block.width*math.Sin(angle)) + math.Abs(block.height*math.Cos(angle))
 
-	var x, y float64
+	var cx, cy float64
 	switch params.Position {
 	case "top-left":
-		x, y = 20, 20+th
+		cx, cy = margin+bw/2, margin+bh/2
 	case "top-right":
-		x, y = float64(width)-tw-20, 20+th
+		cx, cy = width-margin-bw/2, margin+bh/2
 	case "bottom-left":
-		x, y = 20, float64(height)-20
-	case "bottom-right":
-		x, y = float64(width)-tw-20, float64(height)-20
+		cx, cy = margin+bw/2, height-margin-bh/2
 	case "center":
-		x, y = (float64(width)-tw)/2, (float64(height)+th)/2
+		cx, cy = width/2, height/2
+	default: // bottom-right
+		cx, cy = width-margin-bw/2, height-margin-bh/2
+	}
+
+	drawTextBlock(dc, block, params, cx, cy)
+	blendLayer(dst, layer, params.Opacity)
+
+	return dst, nil
+}
+
+// blendLayer composites a layer over dst with a uniform opacity in [0, 1]
+func blendLayer(dst *image.RGBA, layer image.Image, opacity float64) {
+	alpha := uint8(math.Max(0, math.Min(255, opacity*255)))
+	mask := image.NewUniform(color.Alpha{A: alpha})
+	draw.DrawMask(dst, dst.Bounds(), layer, image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+// textBlock is a laid out, possibly multi-line, watermark text
+type textBlock struct {
+	lines      []string
+	width      float64
+	height     float64
+	lineHeight float64
+}
+
+// layoutText splits the text on newlines and wraps lines wider than the
+// requested fraction of the image width
+func layoutText(dc *gg.Context, params WatermarkParams, imageWidth float64) textBlock {
+	var lines []string
+	for _, line := range strings.Split(params.Text, "\n") {
+		if params.WrapWidth > 0 {
+			wrapped := dc.WordWrap(line, params.WrapWidth*imageWidth)
+			if len(wrapped) == 0 {
+				wrapped = []string{""}
+			}
+			lines = append(lines, wrapped...)
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	lineSpacing := params.LineHeight
+	if lineSpacing <= 0 {
+		lineSpacing = 1.2
+	}
+
+	block := textBlock{
+		lines:      lines,
+		lineHeight: dc.FontHeight() * lineSpacing,
+	}
+	for _, line := range lines {
+		w, _ := dc.MeasureString(line)
+		block.width = math.Max(block.width, w)
+	}
+	block.height = block.lineHeight * float64(len(lines))
+
+	return block
+}
+
+// drawTiled repeats the text block on a staggered grid rotated by the
+// watermark angle, covering the whole image. The block is rendered once
+// and the image is tiled, stamping the stroke at every position is too slow.
+func drawTiled(dc *gg.Context, face font.Face, block textBlock, params WatermarkParams, width, height float64) {
+	tile := renderTextBlock(face, block, params)
+
+	spacing := params.Spacing
+	if spacing <= 0 {
+		spacing = block.height * 2
+	}
+	stepX := block.width + spacing
+	stepY := block.height + spacing
+
+	dc.Push()
+	defer dc.Pop()
+	dc.RotateAbout(gg.Radians(-params.Angle), width/2, height/2)
+
+	// the grid spans the image diagonal so rotated corners are covered too
+	diagonal := math.Hypot(width, height)
+	startX := width/2 - diagonal/2
+	startY := height/2 - diagonal/2
+	for row := 0; float64(row)*stepY <= diagonal+stepY; row++ {
+		offset := 0.0
+		if row%2 == 1 {
+			offset = stepX / 2
+		}
+		y := startY + float64(row)*stepY
+		for x := startX - offset; x <= startX+diagonal+stepX; x += stepX {
+			dc.DrawImageAnchored(tile, int(math.Round(x)), int(math.Round(y)), 0.5, 0.5)
+		}
+	}
+}
+
+// renderTextBlock draws the block with its shadow and stroke on a
+// transparent image, padded so neither is clipped
+func renderTextBlock(face font.Face, block textBlock, params WatermarkParams) image.Image {
+	pad := math.Ceil(params.StrokeWidth + math.Abs(params.ShadowOffset) + block.lineHeight/2)
+	w := int(math.Ceil(block.width + 2*pad))
+	h := int(math.Ceil(block.height + 2*pad))
+
+	tc := gg.NewContext(w, h)
+	tc.SetFontFace(face)
+	drawTextLines(tc, block, params, float64(w)/2, float64(h)/2)
+	return tc.Image()
+}
+
+// drawTextBlock draws the block centered on (cx, cy), rotated by the watermark angle
+func drawTextBlock(dc *gg.Context, block textBlock, params WatermarkParams, cx, cy float64) {
+	dc.Push()
+	defer dc.Pop()
+	dc.RotateAbout(gg.Radians(-params.Angle), cx, cy)
+	drawTextLines(dc, block, params, cx, cy)
+}
+
+// drawTextLines draws shadow, stroke and fill for each line of the block
+// centered on (cx, cy) in the current coordinate space
+func drawTextLines(dc *gg.Context, block textBlock, params WatermarkParams, cx, cy float64) {
+	var x, ax float64
+	switch params.Align {
+	case "left":
+		x, ax = cx-block.width/2, 0
+	case "right":
+		x, ax = cx+block.width/2, 1
 	default:
-		x, y = float64(width)-tw-20, float64(height)-20
+		x, ax = cx, 0.5
+	}
+	top := cy - block.height/2 + block.lineHeight/2
+
+	stamp := func(c color.Color, dx, dy float64) {
+		dc.SetColor(c)
+		for i, line := range block.lines {
+			dc.DrawStringAnchored(line, x+dx, top+float64(i)*block.lineHeight+dy, ax, 0.5)
+		}
+	}
+
+	if params.ShadowOffset != 0 {
+		shadow := parseColor(params.ShadowColor)
+		if params.ShadowColor == "" {
+			shadow = color.RGBA{0, 0, 0, 255}
+		}
+		stamp(withAlpha(shadow, 0.6), params.ShadowOffset, params.ShadowOffset)
+	}
+
+	if params.StrokeWidth > 0 {
+		stroke := parseColor(params.StrokeColor)
+		if params.StrokeColor == "" {
+			stroke = color.RGBA{0, 0, 0, 255}
+		}
+		// gg has no stroked text, so the outline is stamped around the glyphs
+		steps := max(8, int(params.StrokeWidth*4))
+		for i := range steps {
+			theta := 2 * math.Pi * float64(i) / float64(steps)
+			stamp(stroke, params.StrokeWidth*math.Cos(theta), params.StrokeWidth*math.Sin(theta))
+		}
 	}
 
-	dc.DrawStringAnchored(text, x, y, 0, 0.5)
-	dc.Clip()
+	stamp(parseColor(params.Color), 0, 0)
+}
+
+// withAlpha applies an alpha in [0, 1] to an opaque color
+func withAlpha(c color.RGBA, alpha float64) color.NRGBA {
+	return color.NRGBA{c.R, c.G, c.B, uint8(math.Round(alpha * 255))}
+}
+
+// ApplyOverlay composites a logo on the image, keeping the logo's own alpha
+func ApplyOverlay(img image.Image, params OverlayParams) (image.Image, error) {
+	if params.Logo == nil {
+		return nil, fmt.Errorf("overlay logo is missing")
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// Scale the logo relative to the image width
+	scale := params.Scale
+	if scale <= 0 || scale > 1 {
+		scale = 0.2
+	}
+	logoWidth := int(math.Round(float64(width) * scale))
+	if logoWidth < 1 {
+		logoWidth = 1
+	}
+	logo := imaging.Resize(params.Logo, logoWidth, 0, imaging.Lanczos)
+	lw, lh := logo.Bounds().Dx(), logo.Bounds().Dy()
+
+	margin := params.Margin
+	if margin < 0 {
+		margin = 20
+	}
+
+	var x, y int
+	switch params.Position {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		x, y = width-lw-margin, margin
+	case "bottom-left":
+		x, y = margin, height-lh-margin
+	case "center":
+		x, y = (width-lw)/2, (height-lh)/2
+	default: // bottom-right
+		x, y = width-lw-margin, height-lh-margin
+	}
+
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+
+	// Opacity is applied as a uniform mask on top of the logo alpha
+	alpha := uint8(math.Max(0, math.Min(255, params.Opacity*255)))
+	mask := image.NewUniform(color.Alpha{A: alpha})
+	target := image.Rect(x, y, x+lw, y+lh).Add(bounds.Min)
+	draw.DrawMask(dst, target, logo, image.Point{}, mask, image.Point{}, draw.Over)
 
 	return dst, nil
 }
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// RedactRegion is a rectangle to hide, in pixels of the current image
+type RedactRegion struct {
+	X, Y          int
+	Width, Height int
+	Mode          string  // fill, blur or pixelate
+	Color         string  // fill color, black when empty
+	Sigma         float64 // blur strength
+	BlockSize     int     // pixelate block size
+}
+
+// RedactParams defines the regions hidden by the redact operation
+type RedactParams struct {
+	Regions []RedactRegion
+}
+
+const (
+	defaultRedactSigma     = 20
+	defaultRedactBlockSize = 16
+)
+
+// ApplyRedact hides each region with its own mode. Regions are clipped to
+// the image; a region entirely outside it is an error since silently
+// skipping it would leave the data it was meant to hide visible.
+func ApplyRedact(img image.Image, params RedactParams) (image.Image, error) {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+
+	for i, region := range params.Regions {
+		rect := image.Rect(region.X, region.Y, region.X+region.Width, region.Y+region.Height).
+			Add(bounds.Min).
+			Intersect(bounds)
+		if rect.Empty() {
+			return nil, fmt.Errorf("redact region %d is outside the %dx%d image", i, bounds.Dx(), bounds.Dy())
+		}
+
+		switch region.Mode {
+		case "blur":
+			sigma := region.Sigma
+			if sigma <= 0 {
+				sigma = defaultRedactSigma
+			}
+			// only the region's own pixels are sampled, so nothing from
+			// outside bleeds in and nothing inside survives at the edges
+			blurred := imaging.Blur(dst.SubImage(rect), sigma)
+			draw.Draw(dst, rect, blurred, image.Point{}, draw.Src)
+		case "pixelate":
+			blockSize := region.BlockSize
+			if blockSize < 2 {
+				blockSize = defaultRedactBlockSize
+			}
+			pixelate(dst, rect, blockSize)
+		case "fill":
+			c := color.RGBA{0, 0, 0, 255}
+			if region.Color != "" {
+				c = parseColor(region.Color)
+			}
+			draw.Draw(dst, rect, image.NewUniform(c), image.Point{}, draw.Src)
+		default:
+			return nil, fmt.Errorf("redact region %d: unknown mode %q", i, region.Mode)
+		}
+	}
+
+	return dst, nil
+}
+
+// pixelate replaces each block inside rect with its average color
+func pixelate(img *image.RGBA, rect image.Rectangle, blockSize int) {
+	for by := rect.Min.Y; by < rect.Max.Y; by += blockSize {
+		for bx := rect.Min.X; bx < rect.Max.X; bx += blockSize {
+			block := image.Rect(bx, by, bx+blockSize, by+blockSize).Intersect(rect)
+
+			var r, g, b, a, n int
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					c := img.RGBAAt(x, y)
+					r += int(c.R)
+					g += int(c.G)
+					b += int(c.B)
+					a += int(c.A)
+					n++
+				}
+			}
+			avg := color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)}
+			draw.Draw(img, block, image.NewUniform(avg), image.Point{}, draw.Src)
+		}
+	}
+}
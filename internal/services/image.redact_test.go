@@ -0,0 +1,124 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// checkerImage returns a w x h black and white checkerboard of 1px squares
+func checkerImage(w, h int) *image.NRGBA {
+	img := filledImage(w, h, opaqueWhite)
+	for y := range h {
+		for x := range w {
+			if (x+y)%2 == 1 {
+				img.SetNRGBA(x, y, opaqueBlack)
+			}
+		}
+	}
+	return img
+}
+
+func TestApplyRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		region RedactRegion
+		inside image.Rectangle // where the region lands after clipping
+		check  func(t *testing.T, out image.Image, p image.Point)
+	}{
+		{
+			"fill defaults to black", RedactRegion{X: 1, Y: 1, Width: 3, Height: 2, Mode: "fill"}, image.Rect(1, 1, 4, 3),
+			func(t *testing.T, out image.Image, p image.Point) {
+				if got := nrgbaAt(out, p.X, p.Y); got != opaqueBlack {
+					t.Errorf("%v = %v, want black", p, got)
+				}
+			},
+		},
+		{
+			"fill color partly outside", RedactRegion{X: 6, Y: 5, Width: 10, Height: 10, Mode: "fill", Color: "#ff0000"}, image.Rect(6, 5, 8, 8),
+			func(t *testing.T, out image.Image, p image.Point) {
+				if got := nrgbaAt(out, p.X, p.Y); got != opaqueRed {
+					t.Errorf("%v = %v, want red", p, got)
+				}
+			},
+		},
+		{
+			"pixelate", RedactRegion{X: 0, Y: 0, Width: 4, Height: 4, Mode: "pixelate", BlockSize: 4}, image.Rect(0, 0, 4, 4),
+			func(t *testing.T, out image.Image, p image.Point) {
+				if got := nrgbaAt(out, p.X, p.Y); !closeColor(got, color.NRGBA{127, 127, 127, 255}, 1) {
+					t.Errorf("%v = %v, want the block average", p, got)
+				}
+			},
+		},
+		{
+			"pixelate default block size", RedactRegion{X: 0, Y: 0, Width: 8, Height: 8, Mode: "pixelate"}, image.Rect(0, 0, 8, 8),
+			func(t *testing.T, out image.Image, p image.Point) {
+				if got := nrgbaAt(out, p.X, p.Y); !closeColor(got, color.NRGBA{127, 127, 127, 255}, 1) {
+					t.Errorf("%v = %v, want the block average", p, got)
+				}
+			},
+		},
+		{
+			"blur", RedactRegion{X: 2, Y: 2, Width: 4, Height: 4, Mode: "blur", Sigma: 3}, image.Rect(2, 2, 6, 6),
+			func(t *testing.T, out image.Image, p image.Point) {
+				if got := nrgbaAt(out, p.X, p.Y); got == opaqueBlack || got == opaqueWhite {
+					t.Errorf("%v = %v, want it blurred", p, got)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := checkerImage(8, 8)
+			out, err := ApplyRedact(src, RedactParams{Regions: []RedactRegion{tt.region}})
+			if err != nil {
+				t.Fatalf("ApplyRedact: %v", err)
+			}
+			for y := range 8 {
+				for x := range 8 {
+					p := image.Pt(x, y)
+					if p.In(tt.inside) {
+						tt.check(t, out, p)
+					} else if got, want := nrgbaAt(out, x, y), nrgbaAt(src, x, y); got != want {
+						t.Errorf("%v outside the region = %v, want %v", p, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRedactRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		region RedactRegion
+	}{
+		{"right of the image", RedactRegion{X: 8, Y: 0, Width: 4, Height: 4, Mode: "fill"}},
+		{"below the image", RedactRegion{X: 0, Y: 20, Width: 4, Height: 4, Mode: "fill"}},
+		{"unknown mode", RedactRegion{X: 0, Y: 0, Width: 4, Height: 4, Mode: "smudge"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a valid region first, the bad one must still fail the operation
+			regions := []RedactRegion{{Width: 1, Height: 1, Mode: "fill"}, tt.region}
+			if _, err := ApplyRedact(checkerImage(8, 8), RedactParams{Regions: regions}); err == nil {
+				t.Error("ApplyRedact succeeded")
+			}
+		})
+	}
+}
+
+func TestApplyRedactOffsetBounds(t *testing.T) {
+	// regions are relative to the image, not to its bounds
+	src := filledImage(12, 12, opaqueWhite).SubImage(image.Rect(4, 4, 12, 12))
+	out, err := ApplyRedact(src, RedactParams{Regions: []RedactRegion{{X: 0, Y: 0, Width: 2, Height: 2, Mode: "fill"}}})
+	if err != nil {
+		t.Fatalf("ApplyRedact: %v", err)
+	}
+	if got := nrgbaAt(out, 4, 4); got != opaqueBlack {
+		t.Errorf("region origin = %v, want black", got)
+	}
+	if got := nrgbaAt(out, 6, 6); got != opaqueWhite {
+		t.Errorf("past the region = %v, want white", got)
+	}
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// TrimParams defines border trimming parameters
+type TrimParams struct {
+	Color        string // border color, the top-left pixel when empty
+	Tolerance    int    // maximum per-channel difference (0-255) still counted as border
+	Padding      int    // uniform padding added back after trimming
+	PaddingColor string // padding color, the border color when empty
+}
+
+// ApplyTrim crops away uniform borders, then optionally re-adds padding so
+// trimmed images line up consistently. Images that are entirely border
+// color are returned unchanged.
+func ApplyTrim(img image.Image, params TrimParams) image.Image {
+	src := imaging.Clone(img)
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		return src
+	}
+
+	border := src.NRGBAAt(0, 0)
+	if params.Color != "" {
+		c := parseColor(params.Color)
+		border = color.NRGBA{c.R, c.G, c.B, 255}
+	}
+	tolerance := max(0, min(255, params.Tolerance))
+
+	isBorder := func(x, y int) bool {
+		c := src.NRGBAAt(x, y)
+		return absDiff(c.R, border.R) <= tolerance &&
+			absDiff(c.G, border.G) <= tolerance &&
+			absDiff(c.B, border.B) <= tolerance &&
+			absDiff(c.A, border.A) <= tolerance
+	}
+	rowIsBorder := func(y, minX, maxX int) bool {
+		for x := minX; x < maxX; x++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	colIsBorder := func(x, minY, maxY int) bool {
+		for y := minY; y < maxY; y++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	top, bottom := 0, bounds.Dy()
+	for top < bottom && rowIsBorder(top, 0, bounds.Dx()) {
+		top++
+	}
+	if top == bottom {
+		return src
+	}
+	for bottom > top && rowIsBorder(bottom-1, 0, bounds.Dx()) {
+		bottom--
+	}
+	left, right := 0, bounds.Dx()
+	for left < right && colIsBorder(left, top, bottom) {
+		left++
+	}
+	for right > left && colIsBorder(right-1, top, bottom) {
+		right--
+	}
+
+	trimmed := imaging.Crop(src, image.Rect(left, top, right, bottom))
+	if params.Padding <= 0 {
+		return trimmed
+	}
+
+	padColor := color.Color(border)
+	if params.PaddingColor != "" {
+		padColor = parseColor(params.PaddingColor)
+	}
+	p := params.Padding
+	out := image.NewNRGBA(image.Rect(0, 0, trimmed.Bounds().Dx()+2*p, trimmed.Bounds().Dy()+2*p))
+	draw.Draw(out, out.Bounds(), image.NewUniform(padColor), image.Point{}, draw.Src)
+	draw.Draw(out, trimmed.Bounds().Add(image.Pt(p, p)), trimmed, image.Point{}, draw.Src)
+
+	return out
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// framedImage returns a w x h image of border with a red rectangle at rect
+func framedImage(w, h int, border color.NRGBA, rect image.Rectangle) *image.NRGBA {
+	img := filledImage(w, h, border)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.SetNRGBA(x, y, opaqueRed)
+		}
+	}
+	return img
+}
+
+func TestApplyTrim(t *testing.T) {
+	nearWhite := color.NRGBA{R: 250, G: 250, B: 250, A: 255}
+
+	tests := []struct {
+		name    string
+		src     image.Image
+		params  TrimParams
+		size    image.Point
+		padding color.NRGBA
+	}{
+		{"uniform border", framedImage(10, 8, opaqueWhite, image.Rect(2, 3, 6, 5)), TrimParams{}, image.Pt(4, 2), color.NRGBA{}},
+		{"one sided border", framedImage(10, 8, opaqueWhite, image.Rect(0, 0, 6, 8)), TrimParams{Color: "#ffffff"}, image.Pt(6, 8), color.NRGBA{}},
+		// the top-left pixel is the border color by default
+		{"top-left default", framedImage(10, 8, opaqueWhite, image.Rect(0, 0, 6, 8)), TrimParams{}, image.Pt(4, 8), color.NRGBA{}},
+		{"within tolerance", framedImage(10, 8, nearWhite, image.Rect(2, 3, 6, 5)), TrimParams{Color: "#ffffff", Tolerance: 10}, image.Pt(4, 2), color.NRGBA{}},
+		{"outside tolerance", framedImage(10, 8, nearWhite, image.Rect(2, 3, 6, 5)), TrimParams{Color: "#ffffff", Tolerance: 2}, image.Pt(10, 8), color.NRGBA{}},
+		{"all border", filledImage(10, 8, opaqueWhite), TrimParams{}, image.Pt(10, 8), color.NRGBA{}},
+		{"padding in the border color", framedImage(10, 8, opaqueWhite, image.Rect(2, 3, 6, 5)), TrimParams{Padding: 3}, image.Pt(10, 8), opaqueWhite},
+		{"padding color", framedImage(10, 8, opaqueWhite, image.Rect(2, 3, 6, 5)), TrimParams{Padding: 1, PaddingColor: "#000000"}, image.Pt(6, 4), opaqueBlack},
+		{"all border with padding", filledImage(10, 8, opaqueWhite), TrimParams{Padding: 5}, image.Pt(10, 8), color.NRGBA{}},
+		{"offset bounds", framedImage(12, 10, opaqueWhite, image.Rect(4, 5, 8, 7)).SubImage(image.Rect(2, 2, 12, 10)), TrimParams{}, image.Pt(4, 2), color.NRGBA{}},
+		{"empty", image.NewNRGBA(image.Rect(0, 0, 0, 0)), TrimParams{Padding: 2}, image.Pt(0, 0), color.NRGBA{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := ApplyTrim(tt.src, tt.params)
+			if got := out.Bounds().Size(); got != tt.size {
+				t.Fatalf("size = %v, want %v", got, tt.size)
+			}
+			if tt.padding != (color.NRGBA{}) {
+				if got := nrgbaAt(out, 0, 0); got != tt.padding {
+					t.Errorf("padding = %v, want %v", got, tt.padding)
+				}
+				p := tt.params.Padding
+				if got := nrgbaAt(out, p, p); got != opaqueRed {
+					t.Errorf("first content pixel = %v, want %v", got, opaqueRed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// Headers sent with every webhook request
+const (
+	WebhookSignatureHeader = "X-Imagepp-Signature"
+	WebhookTimestampHeader = "X-Imagepp-Timestamp"
+	WebhookEventHeader     = "X-Imagepp-Event"
+	WebhookDeliveryHeader  = "X-Imagepp-Delivery"
+)
+
+// SignWebhook returns the signature header value of a webhook body:
+// "sha256=" and the hex HMAC-SHA256 of "<timestamp>.<body>". The timestamp
+// is signed too, so receivers can reject replays of old requests.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature is the signature of body
+func VerifyWebhook(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrNonPublicWebhookHost is returned for webhook URLs that point into the
+// network the workers run in
+var ErrNonPublicWebhookHost = errors.New("webhook host is not a public address")
+
+// nonPublicPrefixes are ranges not covered by the netip predicates that
+// must not be reachable from webhooks
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, maps onto IPv4
+}
+
+// IsPublicIP reports whether ip is a globally routable unicast address.
+// Loopback, private, link-local (including 169.254.169.254, the cloud
+// metadata endpoint), multicast and reserved addresses are not.
+func IsPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || !ip.IsGlobalUnicast() || ip.IsPrivate() ||
+		ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateWebhookURL checks that a callback or webhook URL is http(s) and
+// that its host resolves to public addresses only. The check is repeated
+// when connecting, see WebhookDialControl, since DNS can change in between.
+func ValidateWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("URL must be http or https")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("URL has no host")
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrNonPublicWebhookHost, host)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !IsPublicIP(ip) {
+			return fmt.Errorf("%w: %s", ErrNonPublicWebhookHost, host)
+		}
+		return nil
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, ip := range ips {
+		if !IsPublicIP(ip) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrNonPublicWebhookHost, host, ip.Unmap())
+		}
+	}
+	return nil
+}
+
+// WebhookDialControl is a net.Dialer Control function that refuses
+// connections to non-public addresses. It runs after DNS resolution, for
+// every address dialed, so a host that resolved to a public address when
+// the URL was submitted can't be rebound to an internal one later.
+func WebhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrNonPublicWebhookHost, host)
+	}
+	if !IsPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrNonPublicWebhookHost, ip.Unmap())
+	}
+	return nil
+}
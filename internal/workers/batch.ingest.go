@@ -0,0 +1,230 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"imagepp/internal/db"
+	"imagepp/internal/jobs"
+	"imagepp/internal/services"
+
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ingestPageSize is how many objects are listed per ListObjectsV2 call,
+// each page is committed with its items in one transaction
+const ingestPageSize = 500
+
+// HandleBatchIngest pages through the objects under a batch's prefix and
+// adds those that pass the filters as queued items. Objects the batch's
+// owner already processed into the same destination bucket with the same
+// source and pipeline are skipped unless the job skips the cache. Items are
+// released as pages are committed, so processing starts while the prefix
+// is still being listed.
+func HandleBatchIngest(ctx context.Context, t *asynq.Task) error {
+	var p jobs.BatchIngest
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal ingest payload: %w", err)
+	}
+
+	batch, err := Queries.GetBatchByID(ctx, int32(p.BatchID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("batch %d not found: %w", p.BatchID, asynq.SkipRetry)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load batch: %w", err)
+	}
+	if batch.Status != "listing" {
+		return nil
+	}
+
+	truncated, err := ingestPrefix(ctx, p, batch)
+	if err != nil {
+		if !finalAttempt(ctx) {
+			return err
+		}
+		// Keep what was listed, the batch finishes with the items it has
+		ctx = context.WithoutCancel(ctx)
+		if finishErr := finishListing(ctx, batch.ID, false, err); finishErr != nil {
+			return errors.Join(err, finishErr)
+		}
+		return errors.Join(err, advanceBatch(ctx, batch.ID))
+	}
+
+	if err := finishListing(ctx, batch.ID, truncated, nil); err != nil {
+		return err
+	}
+	return advanceBatch(ctx, batch.ID)
+}
+
+// ingestPrefix lists the prefix from where the batch's listing stopped. It
+// reports whether listing stopped at MaxObjects.
+func ingestPrefix(ctx context.Context, p jobs.BatchIngest, batch db.Batch) (bool, error) {
+	svc, err := services.NewS3Service(ctx, p.Job.BucketName)
+	if err != nil {
+		return false, fmt.Errorf("failed to create S3 service: %w", err)
+	}
+
+	after := batch.ListAfter.String
+	total := batch.TotalItems
+	for {
+		objects, more, err := svc.List(ctx, p.Prefix, after, ingestPageSize)
+		if err != nil {
+			return false, err
+		}
+
+		var keys []string
+		var skipped int32
+		truncated := false
+		for _, obj := range objects {
+			if total+int32(len(keys)) >= p.MaxObjects {
+				truncated = true
+				break
+			}
+			after = obj.Key
+			if !ingestMatches(p, obj) {
+				continue
+			}
+			processed, err := alreadyProcessed(ctx, batch.UserID, p.Job, obj)
+			if err != nil {
+				return false, err
+			}
+			if processed {
+				skipped++
+				continue
+			}
+			keys = append(keys, obj.Key)
+		}
+
+		if err := addBatchItems(ctx, p, batch, keys, skipped, after); err != nil {
+			return false, err
+		}
+		total += int32(len(keys))
+		if len(keys) > 0 {
+			if err := advanceBatch(ctx, batch.ID); err != nil {
+				return false, err
+			}
+		}
+
+		if truncated || !more {
+			return truncated, nil
+		}
+	}
+}
+
+// ingestMatches applies the extension, size and modification time filters
+func ingestMatches(p jobs.BatchIngest, obj services.ObjectInfo) bool {
+	// Folder placeholders of storage consoles
+	if strings.HasSuffix(obj.Key, "/") {
+		return false
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(obj.Key), "."))
+	if !slices.Contains(p.Extensions, ext) {
+		return false
+	}
+	if obj.Size < p.MinSize || (p.MaxSize > 0 && obj.Size > p.MaxSize) {
+		return false
+	}
+	if p.ModifiedSince != nil && obj.LastModified.Before(*p.ModifiedSince) {
+		return false
+	}
+	return true
+}
+
+// alreadyProcessed reports whether the user has outputs of the object in
+// the job's destination bucket from a completed image with the same cache
+// key, i.e. the same content and pipeline. Objects processed by someone
+// else or into another bucket go through the result cache instead.
+func alreadyProcessed(ctx context.Context, userID int32, job jobs.Job, obj services.ObjectInfo) (bool, error) {
+	if job.SkipCache {
+		return false, nil
+	}
+	key, err := resultCacheKey(job, obj.ETag)
+	if err != nil {
+		return false, err
+	}
+	processed, err := Queries.ImageAlreadyProcessed(ctx, db.ImageAlreadyProcessedParams{
+		UserID:            pgtype.Int4{Int32: userID, Valid: true},
+		BucketName:        job.BucketName,
+		ImageKey:          obj.Key,
+		CacheKey:          pgtype.Text{String: key, Valid: true},
+		DestinationBucket: destinationBucket(job),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to look up earlier results: %w", err)
+	}
+	return processed, nil
+}
+
+// addBatchItems creates queued images for a page of keys and records how
+// far the listing got, together
+func addBatchItems(ctx context.Context, p jobs.BatchIngest, batch db.Batch, keys []string, skipped int32, after string) error {
+	return pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) error {
+		qtx := Queries.WithTx(tx)
+		now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+		for _, key := range keys {
+			image, err := qtx.CreateImage(ctx, db.CreateImageParams{
+				UserID:          pgtype.Int4{Int32: batch.UserID, Valid: true},
+				BucketName:      p.Job.BucketName,
+				ImageKey:        key,
+				Status:          pgtype.Text{String: "queued", Valid: true},
+				CreatedAt:       now,
+				UpdatedAt:       now,
+				PresetID:        pgtype.Int4{Int32: p.PresetID, Valid: p.PresetID != 0},
+				PresetVersion:   pgtype.Int4{Int32: p.PresetVersion, Valid: p.PresetID != 0},
+				Revision:        1,
+				PipelineVersion: pgtype.Int4{Int32: jobs.PipelineVersion, Valid: true},
+				BatchID:         pgtype.Int4{Int32: batch.ID, Valid: true},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create image record: %w", err)
+			}
+
+			job := p.Job
+			job.ImageID = int64(image.ID)
+			job.ImageKey = key
+			payload, err := json.Marshal(job)
+			if err != nil {
+				return fmt.Errorf("failed to encode job: %w", err)
+			}
+			if err := qtx.SetImageJobPayload(ctx, db.SetImageJobPayloadParams{
+				ID:         image.ID,
+				JobPayload: payload,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return qtx.RecordBatchListing(ctx, db.RecordBatchListingParams{
+			ListAfter:    pgtype.Text{String: after, Valid: after != ""},
+			AddedItems:   int32(len(keys)),
+			SkippedItems: skipped,
+			UpdatedAt:    now,
+			ID:           batch.ID,
+		})
+	})
+}
+
+// finishListing moves a batch from listing to processing
+func finishListing(ctx context.Context, batchID int32, truncated bool, listErr error) error {
+	params := db.FinishBatchListingParams{
+		Truncated: truncated,
+		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+		ID:        batchID,
+	}
+	if listErr != nil {
+		params.ListingError = pgtype.Text{String: listErr.Error(), Valid: true}
+	}
+	if err := Queries.FinishBatchListing(ctx, params); err != nil {
+		return fmt.Errorf("failed to finish listing: %w", err)
+	}
+	return nil
+}
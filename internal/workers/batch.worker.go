@@ -0,0 +1,151 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"imagepp/internal/db"
+	"imagepp/internal/jobs"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// advanceBatchSize bounds the unfinished batches the reaper advances per run
+const advanceBatchSize = 100
+
+// advanceImageBatch advances the batch of an image that just finished, if
+// it belongs to one. Items are released best effort, the reaper advances
+// every unfinished batch as well.
+func advanceImageBatch(ctx context.Context, imageID int32) error {
+	img, err := Queries.GetImageByID(ctx, imageID)
+	if err != nil {
+		return fmt.Errorf("failed to load image: %w", err)
+	}
+	if !img.BatchID.Valid {
+		return nil
+	}
+	return advanceBatch(ctx, img.BatchID.Int32)
+}
+
+// advanceBatch releases queued items of a batch until max_in_flight items
+// are pending or processing, and completes the batch once no item is left
+// to run and no more are being listed. The batch row is locked so
+// concurrent finishes don't release more than the limit. The
+// batch.completed deliveries are created with the completion.
+func advanceBatch(ctx context.Context, batchID int32) error {
+	var entries []db.JobOutbox
+	err := pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) error {
+		qtx := Queries.WithTx(tx)
+		batch, err := qtx.LockBatch(ctx, batchID)
+		if err != nil {
+			return fmt.Errorf("failed to lock batch: %w", err)
+		}
+		if batch.Status != "listing" && batch.Status != "processing" {
+			return nil
+		}
+
+		id := pgtype.Int4{Int32: batchID, Valid: true}
+		inFlight, err := qtx.CountInFlightBatchImages(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to count items in flight: %w", err)
+		}
+		var released []db.ReleaseQueuedBatchImagesRow
+		if free := batch.MaxInFlight - inFlight; free > 0 {
+			released, err = qtx.ReleaseQueuedBatchImages(ctx, db.ReleaseQueuedBatchImagesParams{
+				UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+				BatchID:   id,
+				MaxImages: free,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to release items: %w", err)
+			}
+		}
+
+		for _, item := range released {
+			var job jobs.Job
+			if err := json.Unmarshal(item.JobPayload, &job); err != nil {
+				return fmt.Errorf("item %d has a corrupt job: %w", item.ID, err)
+			}
+			entry, err := jobs.CreateImageOutboxEntry(ctx, qtx, job, item.Attempt)
+			if err != nil {
+				return fmt.Errorf("failed to create outbox entry: %w", err)
+			}
+			entries = append(entries, entry)
+		}
+
+		// Nothing running, nothing left in the queue and nothing to list
+		if batch.Status == "processing" && inFlight == 0 && len(released) == 0 {
+			if err := qtx.CompleteBatch(ctx, db.CompleteBatchParams{
+				ID:          batchID,
+				CompletedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+			}); err != nil {
+				return err
+			}
+			deliveries, err := batchDeliveries(ctx, qtx, batch)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, deliveries...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dispatchEntries(ctx, entries)
+	return nil
+}
+
+// advanceUnfinishedBatches advances every batch still listing or
+// processing, so a batch whose last items were cancelled from the API, or
+// whose advance failed after an item finished, still completes
+func advanceUnfinishedBatches(ctx context.Context) error {
+	ids, err := Queries.ListUnfinishedBatches(ctx, advanceBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to list unfinished batches: %w", err)
+	}
+	var errs []error
+	for _, id := range ids {
+		if err := advanceBatch(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("batch %d: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// batchDeliveries creates the deliveries of the batch.completed event to
+// the batch's callback and the webhooks of its owner
+func batchDeliveries(ctx context.Context, qtx *db.Queries, batch db.Batch) ([]db.JobOutbox, error) {
+	rows, err := qtx.CountBatchImagesByStatus(ctx, pgtype.Int4{Int32: batch.ID, Valid: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count items: %w", err)
+	}
+	counts := make(map[string]int32, len(rows))
+	for _, row := range rows {
+		counts[row.Status.String] = row.Count
+	}
+
+	payload, err := json.Marshal(jobs.BatchEvent{
+		Event:      jobs.EventBatchCompleted,
+		OccurredAt: time.Now().UTC(),
+		BatchID:    int64(batch.ID),
+		Status:     "completed",
+		TotalItems: batch.TotalItems,
+		Counts:     counts,
+
+		SkippedItems: batch.SkippedItems,
+		Truncated:    batch.Truncated,
+		ListingError: batch.ListingError.String,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event: %w", err)
+	}
+	return createDeliveries(ctx, qtx, batch.UserID, batch.CallbackUrl, jobs.EventBatchCompleted, payload, db.CreateWebhookDeliveryParams{
+		BatchID: pgtype.Int4{Int32: batch.ID, Valid: true},
+	})
+}
@@ -0,0 +1,40 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"imagepp/internal/services"
+)
+
+// ensureFont registers a custom font from storage the first time a job uses
+// it, and again once it was registered anew with a different file. Bundled
+// fonts and the loaded version are a no-op.
+func ensureFont(ctx context.Context, name string) error {
+	if name == "" || services.IsBundledFont(name) {
+		return nil
+	}
+
+	font, err := Queries.GetFontByName(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to look up font %q: %w", name, err)
+	}
+	if services.HasFont(name, font.Etag) {
+		return nil
+	}
+	if !slices.Contains(FontBuckets, font.BucketName) {
+		return fmt.Errorf("font %q: bucket %q is not allowed", name, font.BucketName)
+	}
+
+	s3Svc, err := services.NewS3Service(ctx, font.BucketName)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 service for font bucket: %w", err)
+	}
+	data, err := s3Svc.Download(ctx, font.FontKey)
+	if err != nil {
+		return fmt.Errorf("failed to download font %q: %w", name, err)
+	}
+
+	return services.RegisterFont(name, font.Etag, data)
+}
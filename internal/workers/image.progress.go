@@ -0,0 +1,125 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"imagepp/internal/events"
+	"imagepp/internal/jobs"
+
+	"github.com/hibiken/asynq"
+)
+
+// progress counts the steps of a job: decoding the source, every operation,
+// and writing every output. After each one it publishes an event for the
+// API's streams and rewrites the task result for the asynq inspector.
+type progress struct {
+	imageID  int64
+	total    int
+	rw       *asynq.ResultWriter
+	started  time.Time
+	last     time.Time
+	steps    []jobs.StepTiming
+	cacheHit bool
+}
+
+func newProgress(p jobs.Job, rw *asynq.ResultWriter) *progress {
+	total := 1 + len(p.Operations)
+	for _, out := range jobOutputs(p) {
+		total += len(out.Operations) + 1
+	}
+	now := time.Now()
+	return &progress{imageID: p.ImageID, total: total, rw: rw, started: now, last: now}
+}
+
+// step records a finished step
+func (pr *progress) step(ctx context.Context, step, operation, output string) {
+	now := time.Now()
+	pr.steps = append(pr.steps, jobs.StepTiming{
+		Step:       step,
+		Operation:  operation,
+		Output:     output,
+		DurationMs: now.Sub(pr.last).Milliseconds(),
+	})
+	pr.last = now
+
+	publishEvent(ctx, events.Event{
+		Type:      events.TypeProgress,
+		ImageID:   pr.imageID,
+		Step:      step,
+		Operation: operation,
+		Output:    output,
+		Completed: len(pr.steps),
+		Total:     pr.total,
+	})
+	pr.writeResult(jobs.TaskProgress{
+		State:      "running",
+		ImageID:    pr.imageID,
+		StepIndex:  len(pr.steps),
+		TotalSteps: pr.total,
+		Step:       step,
+		Operation:  operation,
+		Output:     output,
+		ElapsedMs:  now.Sub(pr.started).Milliseconds(),
+	})
+}
+
+// finish writes the final result of a completed job. Outputs are read back
+// from the image, so reused cached outputs are listed too.
+func (pr *progress) finish(ctx context.Context) {
+	outputs, err := resultOutputs(ctx, int32(pr.imageID))
+	if err != nil {
+		return
+	}
+	pr.writeResult(jobs.TaskResult{
+		State:    "completed",
+		ImageID:  pr.imageID,
+		CacheHit: pr.cacheHit,
+		Outputs:  outputs,
+		TotalMs:  time.Since(pr.started).Milliseconds(),
+		Steps:    pr.steps,
+	})
+}
+
+// writeResult replaces the task result. Results are informational, a
+// failed write doesn't fail the job.
+func (pr *progress) writeResult(v any) {
+	if pr.rw == nil {
+		return
+	}
+	if data, err := json.Marshal(v); err == nil {
+		_, _ = pr.rw.Write(data)
+	}
+}
+
+// resultOutputs lists the outputs recorded for an image
+func resultOutputs(ctx context.Context, imageID int32) ([]jobs.ResultOutput, error) {
+	rows, err := Queries.GetImageOutputsByImageID(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outputs: %w", err)
+	}
+	outputs := make([]jobs.ResultOutput, 0, len(rows))
+	for _, out := range rows {
+		outputs = append(outputs, jobs.ResultOutput{
+			Variant:    out.Variant,
+			BucketName: out.BucketName,
+			Key:        out.OutputKey,
+			Format:     out.Format,
+			Width:      out.Width,
+			Height:     out.Height,
+			SizeBytes:  out.SizeBytes,
+		})
+	}
+	return outputs, nil
+}
+
+// publishEvent sends an image event to API clients. Events are best effort,
+// a Redis hiccup doesn't fail the job.
+func publishEvent(ctx context.Context, e events.Event) {
+	if Events == nil {
+		return
+	}
+	_ = Events.Publish(context.WithoutCancel(ctx), e)
+}
@@ -0,0 +1,156 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"imagepp/internal/db"
+	"imagepp/internal/events"
+	"imagepp/internal/jobs"
+
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// reapBatchSize bounds the images checked per run, the rest wait for the next one
+	reapBatchSize = 200
+	// maxReaps is how many times a lost task is re-enqueued before the
+	// image is failed, an image that kills its worker shouldn't loop forever
+	maxReaps = 3
+)
+
+// HandleReapStuckImages finds images left pending or processing longer than
+// the thresholds in the payload and asks asynq what became of their task.
+// Tasks that are still queued or running are left alone, tasks asynq gave up
+// on fail the image, and tasks asynq lost (e.g. a worker was OOM-killed
+// after its lease was recovered) are enqueued again. Unfinished batches are
+// advanced too, in case an item finished without releasing the next ones.
+func HandleReapStuckImages(ctx context.Context, t *asynq.Task) error {
+	var p jobs.ReapStuckImages
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal reaper payload: %w", err)
+	}
+	if p.PendingAfter <= 0 || p.ProcessingAfter <= 0 {
+		return fmt.Errorf("invalid reaper payload: thresholds must be positive")
+	}
+
+	now := time.Now()
+	stuck, err := Queries.ListStuckImages(ctx, db.ListStuckImagesParams{
+		PendingBefore:    pgtype.Timestamp{Time: now.Add(-p.PendingAfter), Valid: true},
+		ProcessingBefore: pgtype.Timestamp{Time: now.Add(-p.ProcessingAfter), Valid: true},
+		MaxImages:        reapBatchSize,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list stuck images: %w", err)
+	}
+
+	var errs []error
+	for _, img := range stuck {
+		if err := reapImage(ctx, img); err != nil {
+			errs = append(errs, fmt.Errorf("image %d: %w", img.ID, err))
+		}
+	}
+	if err := advanceUnfinishedBatches(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// reapImage decides what to do with one stuck image
+func reapImage(ctx context.Context, img db.ListStuckImagesRow) error {
+	taskID := jobs.ImageTaskID(int64(img.ID), img.Attempt)
+	entry, err := Queries.GetOutboxEntryByTaskID(ctx, taskID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return failImage(ctx, img.ID, "task payload is no longer available", true)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load outbox entry: %w", err)
+	}
+	if !entry.DispatchedAt.Valid {
+		// Still waiting in the outbox, the relay owns it
+		return nil
+	}
+
+	info, err := Scheduler.TaskInfo(entry.Queue, taskID)
+	switch {
+	case errors.Is(err, asynq.ErrTaskNotFound), errors.Is(err, asynq.ErrQueueNotFound):
+		return requeueImage(ctx, img, entry)
+	case err != nil:
+		return fmt.Errorf("failed to inspect task: %w", err)
+	}
+
+	switch info.State {
+	case asynq.TaskStateArchived:
+		return failImage(ctx, img.ID, "task exhausted its retries: "+info.LastErr, true)
+	case asynq.TaskStateCompleted:
+		return failImage(ctx, img.ID, "task completed without recording a result", true)
+	default:
+		// Pending, scheduled, retrying or running: asynq still owns it
+		return nil
+	}
+}
+
+// requeueImage enqueues a lost task again from its outbox entry
+func requeueImage(ctx context.Context, img db.ListStuckImagesRow, entry db.JobOutbox) error {
+	if img.ReapCount >= maxReaps {
+		return failImage(ctx, img.ID, fmt.Sprintf("task was lost %d times", img.ReapCount+1), true)
+	}
+
+	// Same task ID as the lost task, asynq has forgotten it
+	if err := jobs.DispatchOutboxEntry(ctx, Queries, Scheduler, entry); err != nil {
+		return fmt.Errorf("failed to re-enqueue task: %w", err)
+	}
+
+	return Queries.RequeueStuckImage(ctx, db.RequeueStuckImageParams{
+		ID:        img.ID,
+		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+}
+
+// failImage marks an unfinished image failed with a reason. An attempt
+// asynq runs again only records the reason: the image stays processing, so
+// it still counts against its batch's max_in_flight and event streams don't
+// see a final status. Webhooks only hear about final failures.
+func failImage(ctx context.Context, imageID int32, reason string, final bool) error {
+	if !final {
+		n, err := Queries.RecordAttemptFailure(ctx, db.RecordAttemptFailureParams{
+			ID:            imageID,
+			FailureReason: pgtype.Text{String: reason, Valid: true},
+			UpdatedAt:     pgtype.Timestamp{Time: time.Now(), Valid: true},
+		})
+		if err != nil || n == 0 {
+			return err
+		}
+		publishEvent(ctx, events.Event{Type: events.TypeRetry, ImageID: int64(imageID), FailureReason: reason})
+		return nil
+	}
+
+	// The image.failed deliveries are created with the status
+	var entries []db.JobOutbox
+	failed := false
+	err := pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) error {
+		qtx := Queries.WithTx(tx)
+		n, err := qtx.FailImage(ctx, db.FailImageParams{
+			ID:            imageID,
+			FailureReason: pgtype.Text{String: reason, Valid: true},
+			UpdatedAt:     pgtype.Timestamp{Time: time.Now(), Valid: true},
+		})
+		if err != nil || n == 0 {
+			return err
+		}
+		failed = true
+		entries, err = imageDeliveries(ctx, qtx, imageID, jobs.EventImageFailed)
+		return err
+	})
+	if err != nil || !failed {
+		return err
+	}
+	publishEvent(ctx, events.Event{Type: events.TypeStatus, ImageID: int64(imageID), Status: "failed", FailureReason: reason})
+	dispatchEntries(ctx, entries)
+	return advanceImageBatch(ctx, imageID)
+}
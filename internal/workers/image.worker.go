@@ -4,19 +4,37 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"imagepp/internal/db"
+	"imagepp/internal/events"
 	"imagepp/internal/jobs"
+	"imagepp/internal/scheduler"
 	"imagepp/internal/services"
+	"imagepp/pkg/logger"
 	"time"
 
 	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// Queries is set by main.go during initialization
-var Queries *db.Queries
+// DB, Queries, Scheduler, Events and the bucket allow-lists are set by
+// main.go during initialization
+var (
+	DB        *pgxpool.Pool
+	Queries   *db.Queries
+	Scheduler *scheduler.Client
+	Events    *events.Broker
+	// LogoBuckets are the buckets overlays may read logos from besides the job's own
+	LogoBuckets []string
+	// OutputBuckets are the buckets outputs may be written to besides the job's own
+	OutputBuckets []string
+	// FontBuckets are the buckets registered fonts may be read from
+	FontBuckets []string
+)
 
 func HandleImagePP(ctx context.Context, t *asynq.Task) error {
 	var p jobs.Job
@@ -29,135 +47,447 @@ func HandleImagePP(ctx context.Context, t *asynq.Task) error {
 		return fmt.Errorf("invalid job payload: missing required fields")
 	}
 
-	// Update status to "processing"
-	if err := Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-		ID:        int32(p.ImageID),
-		Status:    pgtype.Text{String: "processing", Valid: true},
-		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
-	}); err != nil {
+	// The image may have been cancelled while its task was queued
+	cancelled, err := cancelRequested(ctx, p.ImageID)
+	if err != nil {
+		return fmt.Errorf("failed to load image: %w", err)
+	}
+	if cancelled {
+		return recordCancelled(ctx, p.ImageID)
+	}
+
+	// Update status to "processing", an image cancelled or failed since
+	// the check above is left alone
+	started, err := setStatus(ctx, p.ImageID, "processing")
+	if err != nil {
 		return fmt.Errorf("failed to update image status to processing: %w", err)
 	}
+	if !started {
+		return nil
+	}
 
-	// Initialize S3 service
-	s3Svc, err := services.NewS3Service(ctx, p.BucketName)
+	pr := newProgress(p, t.ResultWriter())
+	if err := processImage(ctx, p, pr); err != nil {
+		// The context is cancelled both by the cancel endpoint and on
+		// shutdown, only the former is a cancellation
+		if ctx.Err() != nil {
+			if cancelled, _ := cancelRequested(context.WithoutCancel(ctx), p.ImageID); cancelled {
+				return recordCancelled(ctx, p.ImageID)
+			}
+		}
+		_ = failImage(context.WithoutCancel(ctx), int32(p.ImageID), err.Error(), finalAttempt(ctx))
+		return err
+	}
+
+	completed, err := completeImage(ctx, int32(p.ImageID))
 	if err != nil {
-		_ = Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-			ID:        int32(p.ImageID),
-			Status:    pgtype.Text{String: "failed", Valid: true},
+		return fmt.Errorf("failed to update image status to completed: %w", err)
+	}
+	if !completed {
+		// Cancelled or failed while the outputs were written, whoever
+		// finished the image advanced its batch
+		return nil
+	}
+	pr.finish(ctx)
+
+	// The image is done, a retry would only process it again
+	if err := advanceImageBatch(ctx, int32(p.ImageID)); err != nil {
+		return fmt.Errorf("failed to advance batch: %v: %w", err, asynq.SkipRetry)
+	}
+
+	return nil
+}
+
+// finalAttempt reports whether asynq gives up on the task if this run fails
+func finalAttempt(ctx context.Context) bool {
+	retried, ok := asynq.GetRetryCount(ctx)
+	if !ok {
+		return true
+	}
+	maxRetry, ok := asynq.GetMaxRetry(ctx)
+	return !ok || retried >= maxRetry
+}
+
+// setStatus records an image status transition. It reports false when the
+// image is no longer pending or processing.
+func setStatus(ctx context.Context, imageID int64, status string) (bool, error) {
+	n, err := Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
+		ID:        int32(imageID),
+		Status:    pgtype.Text{String: status, Valid: true},
+		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+	if err != nil || n == 0 {
+		return false, err
+	}
+	publishEvent(ctx, events.Event{Type: events.TypeStatus, ImageID: imageID, Status: status})
+	return true, nil
+}
+
+// completeImage marks an image completed and creates the deliveries of
+// its image.completed event in the same transaction. It reports false,
+// without creating deliveries, when the image was cancelled or failed in
+// the meantime.
+func completeImage(ctx context.Context, imageID int32) (bool, error) {
+	var entries []db.JobOutbox
+	completed := false
+	err := pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) error {
+		qtx := Queries.WithTx(tx)
+		n, err := qtx.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
+			ID:        imageID,
+			Status:    pgtype.Text{String: "completed", Valid: true},
 			UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
 		})
+		if err != nil || n == 0 {
+			return err
+		}
+		completed = true
+		entries, err = imageDeliveries(ctx, qtx, imageID, jobs.EventImageCompleted)
+		return err
+	})
+	if err != nil || !completed {
+		return false, err
+	}
+	publishEvent(ctx, events.Event{Type: events.TypeStatus, ImageID: int64(imageID), Status: "completed"})
+	dispatchEntries(ctx, entries)
+	return true, nil
+}
+
+// cancelRequested reports whether a cancel was requested for the image
+func cancelRequested(ctx context.Context, imageID int64) (bool, error) {
+	img, err := Queries.GetImageByID(ctx, int32(imageID))
+	if err != nil {
+		return false, err
+	}
+	return img.CancelRequested, nil
+}
+
+// recordCancelled marks the image cancelled. The task itself succeeds,
+// there is nothing left to retry.
+func recordCancelled(ctx context.Context, imageID int64) error {
+	_, err := Queries.CancelImage(context.WithoutCancel(ctx), db.CancelImageParams{
+		ID:        int32(imageID),
+		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record cancellation: %w", err)
+	}
+	publishEvent(ctx, events.Event{Type: events.TypeStatus, ImageID: imageID, Status: "cancelled"})
+	return advanceImageBatch(context.WithoutCancel(ctx), int32(imageID))
+}
+
+// destinationBucket is the bucket a job's outputs go to, the source bucket
+// unless the job names another one
+func destinationBucket(p jobs.Job) string {
+	if p.Destination != nil && p.Destination.BucketName != "" {
+		return p.Destination.BucketName
+	}
+	return p.BucketName
+}
+
+// processImage downloads and decodes the source once, runs the shared
+// operations, then encodes and uploads every requested output from that
+// shared result
+func processImage(ctx context.Context, p jobs.Job, pr *progress) error {
+	// Initialize S3 service
+	s3Svc, err := services.NewS3Service(ctx, p.BucketName)
+	if err != nil {
 		return fmt.Errorf("failed to create S3 service: %w", err)
 	}
-	defer func() {
-		// Note: S3Service doesn't have Close method, but if it did, we'd call it here
-	}()
+
+	dstBucket := destinationBucket(p)
+	dstSvc := s3Svc
+	if dstBucket != p.BucketName {
+		dstSvc, err = services.NewS3Service(ctx, dstBucket)
+		if err != nil {
+			return fmt.Errorf("failed to create S3 service for destination bucket: %w", err)
+		}
+	}
+
+	// Reuse the outputs of an earlier image with the same source content and
+	// operations instead of processing it again
+	reused, err := reuseCachedResult(ctx, p, s3Svc, dstSvc, dstBucket)
+	if err != nil {
+		return err
+	}
+	if reused {
+		pr.cacheHit = true
+		return nil
+	}
 
 	// Download image from S3
 	imageData, err := s3Svc.Download(ctx, p.ImageKey)
 	if err != nil {
-		_ = Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-			ID:        int32(p.ImageID),
-			Status:    pgtype.Text{String: "failed", Valid: true},
-			UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
-		})
 		return fmt.Errorf("failed to download image: %w", err)
 	}
 
 	// Decode image
 	img, _, err := image.Decode(bytes.NewReader(imageData))
 	if err != nil {
-		_ = Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-			ID:        int32(p.ImageID),
-			Status:    pgtype.Text{String: "failed", Valid: true},
-			UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
-		})
 		return fmt.Errorf("failed to decode image: %w", err)
 	}
 
-	// Process operations
-	for _, op := range p.Operations {
-		opType, _ := op["type"].(string)
-		params, ok := op["params"].(map[string]any)
-		if !ok {
-			return fmt.Errorf("invalid operation params for %s: expected map[string]any, got %T", opType, op["params"])
-		}
-
-		switch opType {
-		case "watermark":
-			wparams := parseWatermarkParams(params)
-			img, err = services.ApplyWatermark(img, wparams)
-			if err != nil {
-				_ = Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-					ID:        int32(p.ImageID),
-					Status:    pgtype.Text{String: "failed", Valid: true},
-					UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
-				})
-				return fmt.Errorf("failed to apply watermark: %w", err)
-			}
-		case "compress":
-			// Compression happens during encoding
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Keep the source metadata around, re-encoding drops it
+	source := services.ExtractMetadata(imageData)
+	metadata := services.FilterMetadata(source, p.Metadata)
+
+	// Convert to the requested color space before running operations
+	if p.ColorProfile != "" {
+		converted, profile, err := services.ConvertColorProfile(img, source.ICC, p.ColorProfile)
+		switch {
+		case errors.Is(err, services.ErrUnsupportedProfile):
+			// CMYK, LUT based and other profiles the pipeline can't convert
+			// from: the pixels are left as they are, tagged with their own
+			// profile, rather than failing the job
+			log := logger.FromContext(ctx)
+			log.Warn().Err(err).Int64("image_id", p.ImageID).Msg("keeping the source color profile")
+			metadata.ICC = source.ICC
+		case err != nil:
+			return fmt.Errorf("failed to convert color profile: %w", err)
+		default:
+			// the output profile is always embedded so the pixels stay tagged
+			img = converted
+			metadata.ICC = profile
 		}
 	}
 
-	// Get compress params (default or from operations)
-	compressParams := services.CompressParams{
-		Quality: 85,
-		Format:  "jpeg",
+	pr.step(ctx, "decode", "", "")
+
+	// Process the operations shared by every output
+	img, err = applyOperations(ctx, img, p.Operations, s3Svc, p.BucketName, pr, "")
+	if err != nil {
+		return err
 	}
-	for _, op := range p.Operations {
-		if opType, _ := op["type"].(string); opType == "compress" {
-			params, ok := op["params"].(map[string]any)
-			if !ok {
-				return fmt.Errorf("invalid compress params: expected map[string]any, got %T", op["params"])
-			}
-			compressParams = parseCompressParams(params)
-			break
+
+	for _, out := range jobOutputs(p) {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+
+		// Operations never modify their input, so every output starts from
+		// the same shared image
+		variant, err := applyOperations(ctx, img, out.Operations, s3Svc, p.BucketName, pr, out.Name)
+		if err != nil {
+			return fmt.Errorf("output %q: %w", out.Name, err)
+		}
+
+		compressParams := parseCompressParams(findCompressParams(out.Operations, p.Operations))
+		if err := writeOutput(ctx, dstSvc, dstBucket, p, out.Name, variant, compressParams, metadata); err != nil {
+			return fmt.Errorf("output %q: %w", out.Name, err)
+		}
+		pr.step(ctx, "output", "", out.Name)
 	}
 
+	return nil
+}
+
+// writeOutput encodes one output, uploads it to the destination bucket and
+// records it on the image
+func writeOutput(ctx context.Context, dstSvc *services.S3Service, dstBucket string, p jobs.Job, name string, img image.Image, compressParams services.CompressParams, metadata *services.Metadata) error {
 	// Encode image
 	var buf bytes.Buffer
 	if err := services.Compress(img, compressParams, &buf); err != nil {
-		_ = Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-			ID:        int32(p.ImageID),
-			Status:    pgtype.Text{String: "failed", Valid: true},
-			UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
-		})
 		return fmt.Errorf("failed to encode image: %w", err)
 	}
 
-	// Generate output key
-	ext := compressParams.Format
-	if ext == "jpeg" {
-		ext = "jpg"
+	// Re-insert the metadata selected by the job's policy
+	output, err := services.EmbedMetadata(buf.Bytes(), compressParams.Format, metadata)
+	if err != nil {
+		return fmt.Errorf("failed to embed metadata: %w", err)
+	}
+
+	// Compress may have resized, read the final dimensions back
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(output))
+	if err != nil {
+		return fmt.Errorf("failed to read encoded image: %w", err)
+	}
+
+	// Templates can refer to the final size and content, so the key is
+	// only known once the output is encoded
+	hash := services.ContentHash(output)
+	key, err := outputKey(p, name, compressParams.Format, cfg.Width, cfg.Height, hash)
+	if err != nil {
+		return err
 	}
-	outputKey := fmt.Sprintf("processed/%d.%s", p.ImageID, ext)
 
 	// Upload processed image
-	if err := s3Svc.Upload(ctx, outputKey, buf.Bytes()); err != nil {
-		_ = Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-			ID:        int32(p.ImageID),
-			Status:    pgtype.Text{String: "failed", Valid: true},
-			UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
-		})
+	if err := dstSvc.Upload(ctx, key, output); err != nil {
 		return fmt.Errorf("failed to upload processed image: %w", err)
 	}
 
-	// Note: processed_image_key column doesn't exist in DB, so we log the key
-	// In a real implementation, you might want to add this column or create a separate table
-
-	// Update status to "completed"
-	if err := Queries.UpdateImageStatus(ctx, db.UpdateImageStatusParams{
-		ID:        int32(p.ImageID),
-		Status:    pgtype.Text{String: "completed", Valid: true},
-		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	if _, err := Queries.UpsertImageOutput(ctx, db.UpsertImageOutputParams{
+		ImageID:     int32(p.ImageID),
+		Variant:     name,
+		BucketName:  dstBucket,
+		OutputKey:   key,
+		Format:      compressParams.Format,
+		Width:       int32(cfg.Width),
+		Height:      int32(cfg.Height),
+		SizeBytes:   int64(len(output)),
+		CreatedAt:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+		ContentHash: hash,
 	}); err != nil {
-		return fmt.Errorf("failed to update image status to completed: %w", err)
+		return fmt.Errorf("failed to record output: %w", err)
+	}
+
+	return nil
+}
+
+// jobOutputs returns the outputs a job produces, a job without variants
+// produces a single default one
+func jobOutputs(p jobs.Job) []jobs.Output {
+	if len(p.Outputs) == 0 {
+		return []jobs.Output{{Name: jobs.DefaultOutput}}
+	}
+	return p.Outputs
+}
+
+// outputKey returns where an output is stored. Without a key template a job
+// without variants keeps the historical processed/{id}.{ext} key. A key
+// that would replace the source object is rejected, the source must stay
+// for retries and revisions, and so is a destination bucket that isn't
+// allowed, jobs queued before the handler checked it included.
+func outputKey(p jobs.Job, variant, format string, width, height int, hash string) (string, error) {
+	if p.Destination != nil && !services.OutputBucketAllowed(p.Destination.BucketName, p.BucketName, OutputBuckets) {
+		return "", fmt.Errorf("output bucket %q is not allowed", p.Destination.BucketName)
+	}
+
+	ext := format
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+
+	var key string
+	switch {
+	case p.Destination != nil && p.Destination.KeyTemplate != "":
+		var err error
+		key, err = services.RenderKey(p.Destination.KeyTemplate, services.KeyVars{
+			UserID:       p.UserID,
+			ImageID:      p.ImageID,
+			Variant:      variant,
+			Width:        width,
+			Height:       height,
+			Hash:         hash,
+			OrigBasename: services.OrigBasename(p.ImageKey),
+			Ext:          ext,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to render output key: %w", err)
+		}
+	case len(p.Outputs) == 0:
+		key = fmt.Sprintf("processed/%d.%s", p.ImageID, ext)
+	default:
+		key = fmt.Sprintf("processed/%d/%s.%s", p.ImageID, variant, ext)
+	}
+
+	if key == p.ImageKey && destinationBucket(p) == p.BucketName {
+		return "", fmt.Errorf("output %q: %w: %s", variant, services.ErrOverwritesSource, key)
 	}
+	return key, nil
+}
 
+// findCompressParams returns the params of the first compress operation,
+// looking through each list in order
+func findCompressParams(lists ...[]map[string]any) map[string]any {
+	for _, ops := range lists {
+		for _, op := range ops {
+			if opType, _ := op["type"].(string); opType == "compress" {
+				params, _ := op["params"].(map[string]any)
+				return params
+			}
+		}
+	}
 	return nil
 }
 
+// applyOperations runs operations in order and returns the resulting image.
+// Each operation is reported to pr as a step of output, empty for the
+// shared operations.
+func applyOperations(ctx context.Context, img image.Image, ops []map[string]any, s3Svc *services.S3Service, bucket string, pr *progress, output string) (image.Image, error) {
+	for _, op := range ops {
+		// Checked between operations, a cancelled job stops at the next one
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		opType, _ := op["type"].(string)
+		params, ok := op["params"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid operation params for %s: expected map[string]any, got %T", opType, op["params"])
+		}
+
+		var err error
+		img, err = applyOperation(ctx, img, opType, params, s3Svc, bucket)
+		if err != nil {
+			return nil, err
+		}
+		pr.step(ctx, "operation", opType, output)
+	}
+	return img, nil
+}
+
+// applyOperation runs a single operation. Compression happens during encoding.
+func applyOperation(ctx context.Context, img image.Image, opType string, params map[string]any, s3Svc *services.S3Service, bucket string) (image.Image, error) {
+	var err error
+
+	switch opType {
+	case "watermark":
+		wparams := parseWatermarkParams(params)
+		if err := ensureFont(ctx, wparams.Font); err != nil {
+			return nil, fmt.Errorf("failed to apply watermark: %w", err)
+		}
+		img, err = services.ApplyWatermark(img, wparams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply watermark: %w", err)
+		}
+	case "overlay":
+		oparams := parseOverlayParams(params)
+		oparams.Logo, err = loadLogo(ctx, s3Svc, bucket, stringParam(params, "logo_bucket"), stringParam(params, "logo_key"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply overlay: %w", err)
+		}
+		img, err = services.ApplyOverlay(img, oparams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply overlay: %w", err)
+		}
+	case "adjust":
+		img = services.ApplyAdjust(img, parseAdjustParams(params))
+	case "sharpen":
+		img = services.ApplySharpen(img, parseSharpenParams(params))
+	case "blur":
+		sigma, _ := numberParam(params, "sigma")
+		img = services.ApplyBlur(img, sigma)
+	case "redact":
+		img, err = services.ApplyRedact(img, parseRedactParams(params))
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply redaction: %w", err)
+		}
+	case "trim":
+		img = services.ApplyTrim(img, parseTrimParams(params))
+	case "border":
+		width, _ := numberParam(params, "width")
+		img = services.ApplyBorder(img, services.BorderParams{
+			Width: int(width),
+			Color: stringParam(params, "color"),
+		})
+	case "round_corners":
+		radius, _ := numberParam(params, "radius")
+		img = services.ApplyRoundCorners(img, services.RoundCornersParams{
+			Radius:     int(radius),
+			Background: stringParam(params, "background"),
+		})
+	case "flatten":
+		img = services.ApplyFlatten(img, stringParam(params, "background"))
+	case "compress":
+		// Compression happens during encoding
+	}
+
+	return img, nil
+}
+
 func parseWatermarkParams(params map[string]any) services.WatermarkParams {
 	wp := services.WatermarkParams{
 		Text:     "Watermark",
@@ -172,17 +502,26 @@ func parseWatermarkParams(params map[string]any) services.WatermarkParams {
 	if pos, ok := params["position"].(string); ok {
 		wp.Position = pos
 	}
-	if opacity, ok := params["opacity"].(float64); ok {
+	if opacity, ok := numberParam(params, "opacity"); ok {
 		wp.Opacity = opacity
 	}
-	if fontSize, ok := params["font_size"].(float64); ok {
+	if fontSize, ok := numberParam(params, "font_size"); ok {
 		wp.FontSize = fontSize
-	} else if fontSizeInt, ok := params["font_size"].(int); ok {
-		wp.FontSize = float64(fontSizeInt)
 	}
 	if color, ok := params["color"].(string); ok {
 		wp.Color = color
 	}
+	wp.Font = stringParam(params, "font")
+	wp.Mode = stringParam(params, "mode")
+	wp.Align = stringParam(params, "align")
+	wp.StrokeColor = stringParam(params, "stroke_color")
+	wp.ShadowColor = stringParam(params, "shadow_color")
+	wp.Angle, _ = numberParam(params, "angle")
+	wp.Spacing, _ = numberParam(params, "spacing")
+	wp.WrapWidth, _ = numberParam(params, "wrap_width")
+	wp.LineHeight, _ = numberParam(params, "line_height")
+	wp.StrokeWidth, _ = numberParam(params, "stroke_width")
+	wp.ShadowOffset, _ = numberParam(params, "shadow_offset")
 	return wp
 }
 
@@ -193,23 +532,130 @@ func parseCompressParams(params map[string]any) services.CompressParams {
 		MaxWidth:  0,
 		MaxHeight: 0,
 	}
-	if quality, ok := params["quality"].(float64); ok {
+	if quality, ok := numberParam(params, "quality"); ok {
 		cp.Quality = int(quality)
-	} else if qualityInt, ok := params["quality"].(int); ok {
-		cp.Quality = qualityInt
 	}
 	if format, ok := params["format"].(string); ok {
 		cp.Format = format
 	}
-	if maxWidth, ok := params["max_width"].(float64); ok {
+	if maxWidth, ok := numberParam(params, "max_width"); ok {
 		cp.MaxWidth = int(maxWidth)
-	} else if maxWidthInt, ok := params["max_width"].(int); ok {
-		cp.MaxWidth = maxWidthInt
 	}
-	if maxHeight, ok := params["max_height"].(float64); ok {
+	if maxHeight, ok := numberParam(params, "max_height"); ok {
 		cp.MaxHeight = int(maxHeight)
-	} else if maxHeightInt, ok := params["max_height"].(int); ok {
-		cp.MaxHeight = maxHeightInt
 	}
+	cp.AutoSharpen, _ = params["auto_sharpen"].(bool)
 	return cp
 }
+
+func parseOverlayParams(params map[string]any) services.OverlayParams {
+	op := services.OverlayParams{
+		Position: "bottom-right",
+		Scale:    0.2,
+		Opacity:  1,
+		Margin:   20,
+	}
+	if pos, ok := params["position"].(string); ok {
+		op.Position = pos
+	}
+	if scale, ok := numberParam(params, "scale"); ok {
+		op.Scale = scale
+	}
+	if opacity, ok := numberParam(params, "opacity"); ok {
+		op.Opacity = opacity
+	}
+	if margin, ok := numberParam(params, "margin"); ok {
+		op.Margin = int(margin)
+	}
+	return op
+}
+
+func parseAdjustParams(params map[string]any) services.AdjustParams {
+	ap := services.AdjustParams{
+		Gamma:  1,
+		Preset: stringParam(params, "preset"),
+	}
+	ap.Brightness, _ = numberParam(params, "brightness")
+	ap.Contrast, _ = numberParam(params, "contrast")
+	ap.Saturation, _ = numberParam(params, "saturation")
+	ap.Hue, _ = numberParam(params, "hue")
+	if gamma, ok := numberParam(params, "gamma"); ok {
+		ap.Gamma = gamma
+	}
+	return ap
+}
+
+func parseSharpenParams(params map[string]any) services.SharpenParams {
+	sp := services.SharpenParams{
+		Radius: 1,
+		Amount: 1,
+	}
+	if radius, ok := numberParam(params, "radius"); ok {
+		sp.Radius = radius
+	}
+	if amount, ok := numberParam(params, "amount"); ok {
+		sp.Amount = amount
+	}
+	if threshold, ok := numberParam(params, "threshold"); ok {
+		sp.Threshold = int(threshold)
+	}
+	return sp
+}
+
+func parseRedactParams(params map[string]any) services.RedactParams {
+	var rp services.RedactParams
+	regions, _ := params["regions"].([]any)
+	for _, r := range regions {
+		region, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		rr := services.RedactRegion{
+			Mode:  stringParam(region, "mode"),
+			Color: stringParam(region, "color"),
+		}
+		x, _ := numberParam(region, "x")
+		y, _ := numberParam(region, "y")
+		width, _ := numberParam(region, "width")
+		height, _ := numberParam(region, "height")
+		blockSize, _ := numberParam(region, "block_size")
+		rr.X, rr.Y, rr.Width, rr.Height, rr.BlockSize = int(x), int(y), int(width), int(height), int(blockSize)
+		rr.Sigma, _ = numberParam(region, "sigma")
+		rp.Regions = append(rp.Regions, rr)
+	}
+	return rp
+}
+
+func parseTrimParams(params map[string]any) services.TrimParams {
+	tp := services.TrimParams{
+		Color:        stringParam(params, "color"),
+		Tolerance:    10,
+		PaddingColor: stringParam(params, "padding_color"),
+	}
+	if tolerance, ok := numberParam(params, "tolerance"); ok {
+		tp.Tolerance = int(tolerance)
+	}
+	if padding, ok := numberParam(params, "padding"); ok {
+		tp.Padding = int(padding)
+	}
+	return tp
+}
+
+// numberParam reads a numeric param, JSON payloads decode numbers as float64
+// while params built in Go may hold ints
+func numberParam(params map[string]any, key string) (float64, bool) {
+	switch v := params[key].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// stringParam reads a string param, returning "" when absent
+func stringParam(params map[string]any, key string) string {
+	v, _ := params[key].(string)
+	return v
+}
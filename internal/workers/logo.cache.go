@@ -0,0 +1,118 @@
+package workers
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"imagepp/internal/services"
+)
+
+const (
+	logoCacheSize = 32
+	logoCacheTTL  = 10 * time.Minute
+)
+
+// logos keeps decoded overlay logos between tasks so that a brand stamping
+// thousands of images only downloads and decodes its logo once
+var logos = newLogoCache(logoCacheSize, logoCacheTTL)
+
+type logoEntry struct {
+	key      string
+	img      image.Image
+	loadedAt time.Time
+}
+
+// logoCache is a small LRU cache of decoded logos, entries expire after ttl
+// so replaced logos are picked up without restarting the worker
+type logoCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLogoCache(max int, ttl time.Duration) *logoCache {
+	return &logoCache{
+		max:     max,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *logoCache) get(key string) (image.Image, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*logoEntry)
+	if time.Since(entry.loadedAt) > c.ttl {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.img, true
+}
+
+func (c *logoCache) put(key string, img image.Image) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = &logoEntry{key: key, img: img, loadedAt: time.Now()}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&logoEntry{key: key, img: img, loadedAt: time.Now()})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*logoEntry).key)
+	}
+}
+
+// loadLogo returns the decoded logo, downloading it from storage on a cache miss.
+// s3Svc is reused when the logo lives in the job's bucket.
+func loadLogo(ctx context.Context, s3Svc *services.S3Service, jobBucket, bucket, key string) (image.Image, error) {
+	if !services.LogoBucketAllowed(bucket, jobBucket, LogoBuckets) {
+		return nil, fmt.Errorf("logo bucket %q is not allowed", bucket)
+	}
+	if bucket == "" {
+		bucket = jobBucket
+	}
+	cacheKey := bucket + "/" + key
+	if img, ok := logos.get(cacheKey); ok {
+		return img, nil
+	}
+
+	if bucket != jobBucket {
+		var err error
+		s3Svc, err = services.NewS3Service(ctx, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 service for logo bucket: %w", err)
+		}
+	}
+
+	data, err := s3Svc.Download(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download logo: %w", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode logo: %w", err)
+	}
+
+	logos.put(cacheKey, img)
+	return img, nil
+}
@@ -0,0 +1,171 @@
+package workers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"imagepp/internal/db"
+	"imagepp/internal/jobs"
+	"imagepp/internal/services"
+	"imagepp/pkg/logger"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// resultCacheKey hashes everything that determines the pixels and encoding
+// of a job's outputs. The destination is left out: reused outputs are copied
+// to wherever the new job wants them.
+//
+// Logos and fonts are referenced by key and name, so replacing one in
+// storage doesn't change the cache key. Jobs can set skip_cache for that.
+func resultCacheKey(p jobs.Job, etag string) (string, error) {
+	// encoding/json sorts map keys, which makes params canonical
+	canonical, err := json.Marshal(struct {
+		Version      int              `json:"v"`
+		ETag         string           `json:"etag"`
+		Operations   []map[string]any `json:"operations"`
+		Outputs      []jobs.Output    `json:"outputs"`
+		Metadata     string           `json:"metadata"`
+		ColorProfile string           `json:"color_profile"`
+	}{
+		Version:      jobs.PipelineVersion,
+		ETag:         etag,
+		Operations:   p.Operations,
+		Outputs:      jobOutputs(p),
+		Metadata:     p.Metadata,
+		ColorProfile: p.ColorProfile,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to canonicalize operations: %w", err)
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// reuseCachedResult records the job's cache key and, unless the job skips
+// the cache, copies or references the outputs of an earlier completed image
+// of the same user with the same key. It reports whether the job is done, a
+// cached output that can't be copied leaves the job to be processed.
+func reuseCachedResult(ctx context.Context, p jobs.Job, s3Svc, dstSvc *services.S3Service, dstBucket string) (bool, error) {
+	etag, err := s3Svc.ETag(ctx, p.ImageKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to read source object: %w", err)
+	}
+	key, err := resultCacheKey(p, etag)
+	if err != nil {
+		return false, err
+	}
+	cacheKey := pgtype.Text{String: key, Valid: true}
+
+	if err := Queries.SetImageCacheKey(ctx, db.SetImageCacheKeyParams{
+		ID:        int32(p.ImageID),
+		CacheKey:  cacheKey,
+		UpdatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	}); err != nil {
+		return false, fmt.Errorf("failed to record cache key: %w", err)
+	}
+	if p.SkipCache {
+		return false, nil
+	}
+
+	cachedID, err := Queries.FindCachedImage(ctx, db.FindCachedImageParams{
+		CacheKey: cacheKey,
+		ID:       int32(p.ImageID),
+		UserID:   pgtype.Int4{Int32: int32(p.UserID), Valid: true},
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up cached result: %w", err)
+	}
+
+	cached, err := usableCachedOutputs(ctx, p, cachedID)
+	if err != nil || cached == nil {
+		return false, err
+	}
+
+	for _, out := range jobOutputs(p) {
+		src := cached[out.Name]
+		outKey, err := outputKey(p, out.Name, src.Format, int(src.Width), int(src.Height), src.ContentHash)
+		if err != nil {
+			return false, err
+		}
+
+		// Reference the cached object when it already sits where this job
+		// wants it, otherwise copy it there
+		if dstBucket != src.BucketName || outKey != src.OutputKey {
+			if err := dstSvc.Copy(ctx, src.BucketName, src.OutputKey, outKey); err != nil {
+				log := logger.FromContext(ctx)
+				log.Warn().Err(err).Int64("image_id", p.ImageID).Str("output", out.Name).Msg("processing instead of copying the cached output")
+				return false, nil
+			}
+		}
+
+		if _, err := Queries.UpsertImageOutput(ctx, db.UpsertImageOutputParams{
+			ImageID:     int32(p.ImageID),
+			Variant:     out.Name,
+			BucketName:  dstBucket,
+			OutputKey:   outKey,
+			Format:      src.Format,
+			Width:       src.Width,
+			Height:      src.Height,
+			SizeBytes:   src.SizeBytes,
+			CreatedAt:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+			ContentHash: src.ContentHash,
+		}); err != nil {
+			return false, fmt.Errorf("output %q: failed to record output: %w", out.Name, err)
+		}
+	}
+
+	if err := Queries.MarkImageCacheHit(ctx, db.MarkImageCacheHitParams{
+		ID:                int32(p.ImageID),
+		CachedFromImageID: pgtype.Int4{Int32: cachedID, Valid: true},
+		UpdatedAt:         pgtype.Timestamp{Time: time.Now(), Valid: true},
+	}); err != nil {
+		return false, fmt.Errorf("failed to record cache hit: %w", err)
+	}
+	return true, nil
+}
+
+// usableCachedOutputs returns the outputs of a cached image by variant, or
+// nil when any output the job needs is missing, predates content hashes or
+// was deleted from storage since
+func usableCachedOutputs(ctx context.Context, p jobs.Job, cachedID int32) (map[string]db.ImageOutput, error) {
+	rows, err := Queries.GetImageOutputsByImageID(ctx, cachedID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cached outputs: %w", err)
+	}
+	byVariant := make(map[string]db.ImageOutput, len(rows))
+	for _, row := range rows {
+		byVariant[row.Variant] = row
+	}
+
+	buckets := make(map[string]*services.S3Service)
+	for _, out := range jobOutputs(p) {
+		src, ok := byVariant[out.Name]
+		if !ok || src.ContentHash == "" {
+			return nil, nil
+		}
+
+		svc, ok := buckets[src.BucketName]
+		if !ok {
+			svc, err = services.NewS3Service(ctx, src.BucketName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create S3 service for cached output: %w", err)
+			}
+			buckets[src.BucketName] = svc
+		}
+		if _, err := svc.ETag(ctx, src.OutputKey); err != nil {
+			return nil, nil
+		}
+	}
+	return byVariant, nil
+}
@@ -0,0 +1,184 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"imagepp/internal/db"
+	"imagepp/internal/jobs"
+	"imagepp/internal/services"
+
+	"github.com/hibiken/asynq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// webhookClient only connects to public addresses, whatever the endpoint's
+// host resolves to at delivery time
+var webhookClient = newWebhookClient(services.WebhookDialControl)
+
+// newWebhookClient returns a client that doesn't follow redirects, a
+// redirected POST would arrive as a GET without its body. control vets
+// every address the client dials.
+func newWebhookClient(control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: control,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// A proxy would make the dialer vet the proxy instead of the endpoint
+	transport.Proxy = nil
+	return &http.Client{
+		Timeout:   15 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// errWebhookGone is returned by deliverySecret when the delivery's webhook
+// was deleted or its image or batch no longer has a callback
+var errWebhookGone = errors.New("webhook no longer exists")
+
+// HandleWebhookDelivery POSTs a delivery's body to its endpoint. Any response
+// other than 2xx is an error, asynq retries it with WebhookRetryDelay; every
+// attempt is recorded on the delivery row.
+func HandleWebhookDelivery(ctx context.Context, t *asynq.Task) error {
+	var p jobs.WebhookDelivery
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal delivery payload: %w", err)
+	}
+
+	d, err := Queries.GetWebhookDelivery(ctx, p.DeliveryID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Deleted together with its image
+		return fmt.Errorf("delivery %d not found: %w", p.DeliveryID, asynq.SkipRetry)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load delivery: %w", err)
+	}
+	if d.Status != "pending" {
+		return nil
+	}
+
+	secret, err := deliverySecret(ctx, d)
+	if errors.Is(err, errWebhookGone) {
+		recordErr := recordDelivery(ctx, d.ID, "failed", 0, err)
+		return errors.Join(fmt.Errorf("delivery %d: %w", d.ID, asynq.SkipRetry), recordErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load webhook secret: %w", err)
+	}
+
+	return attemptDelivery(ctx, d, secret, finalAttempt(ctx))
+}
+
+// attemptDelivery sends a delivery and records the outcome. A failed
+// attempt leaves the delivery pending unless it is the final one.
+func attemptDelivery(ctx context.Context, d db.WebhookDelivery, secret string, final bool) error {
+	code, sendErr := sendWebhook(ctx, d, secret)
+	status := "delivered"
+	if sendErr != nil {
+		status = "pending"
+		if final {
+			status = "failed"
+		}
+	}
+	if err := recordDelivery(context.WithoutCancel(ctx), d.ID, status, code, sendErr); err != nil {
+		return errors.Join(sendErr, fmt.Errorf("failed to record delivery: %w", err))
+	}
+	return sendErr
+}
+
+// deliverySecret returns the HMAC key of a delivery's endpoint. Secrets are
+// looked up on every attempt, so a rotated secret applies to retries.
+func deliverySecret(ctx context.Context, d db.WebhookDelivery) (string, error) {
+	if d.Source == jobs.WebhookSourceWebhook {
+		if !d.WebhookID.Valid {
+			return "", errWebhookGone
+		}
+		wh, err := Queries.GetWebhookByID(ctx, d.WebhookID.Int32)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errWebhookGone
+		}
+		return wh.Secret, err
+	}
+
+	if d.BatchID.Valid {
+		batch, err := Queries.GetBatchByID(ctx, d.BatchID.Int32)
+		if err != nil {
+			return "", err
+		}
+		if !batch.CallbackSecret.Valid {
+			return "", errWebhookGone
+		}
+		return batch.CallbackSecret.String, nil
+	}
+
+	img, err := Queries.GetImageByID(ctx, d.ImageID.Int32)
+	if err != nil {
+		return "", err
+	}
+	if !img.CallbackSecret.Valid {
+		return "", errWebhookGone
+	}
+	return img.CallbackSecret.String, nil
+}
+
+// sendWebhook makes one delivery attempt and returns the response status
+func sendWebhook(ctx context.Context, d db.WebhookDelivery, secret string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("invalid webhook request: %w", err)
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imagepp-webhooks")
+	req.Header.Set(services.WebhookEventHeader, d.Event)
+	req.Header.Set(services.WebhookDeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(services.WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(services.WebhookSignatureHeader, services.SignWebhook(secret, timestamp, d.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordDelivery records the outcome of an attempt
+func recordDelivery(ctx context.Context, id int64, status string, code int, sendErr error) error {
+	params := db.RecordWebhookAttemptParams{
+		ID:     id,
+		Status: status,
+	}
+	if code != 0 {
+		params.ResponseStatus = pgtype.Int4{Int32: int32(code), Valid: true}
+	}
+	if sendErr != nil {
+		params.LastError = pgtype.Text{String: sendErr.Error(), Valid: true}
+	}
+	if status == "delivered" {
+		params.DeliveredAt = pgtype.Timestamp{Time: time.Now(), Valid: true}
+	}
+	return Queries.RecordWebhookAttempt(ctx, params)
+}
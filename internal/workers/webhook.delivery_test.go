@@ -0,0 +1,186 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"imagepp/internal/db"
+	"imagepp/internal/services"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// recordingDB captures the attempts recorded on delivery rows
+type recordingDB struct {
+	attempts []db.RecordWebhookAttemptParams
+}
+
+func (r *recordingDB) Exec(_ context.Context, _ string, args ...any) (pgconn.CommandTag, error) {
+	r.attempts = append(r.attempts, db.RecordWebhookAttemptParams{
+		ID:             args[0].(int64),
+		Status:         args[1].(string),
+		ResponseStatus: args[2].(pgtype.Int4),
+		LastError:      args[3].(pgtype.Text),
+		DeliveredAt:    args[4].(pgtype.Timestamp),
+	})
+	return pgconn.NewCommandTag("UPDATE 1"), nil
+}
+
+func (r *recordingDB) Query(context.Context, string, ...any) (pgx.Rows, error) {
+	return nil, errors.New("unexpected query")
+}
+
+func (r *recordingDB) QueryRow(context.Context, string, ...any) pgx.Row {
+	panic("unexpected query")
+}
+
+// withDeliveryStubs points the package at a recording database and a client
+// that may connect to the loopback test servers
+func withDeliveryStubs(t *testing.T, control bool) *recordingDB {
+	t.Helper()
+	rec := &recordingDB{}
+	prevQueries, prevClient := Queries, webhookClient
+	Queries = db.New(rec)
+	if !control {
+		webhookClient = newWebhookClient(nil)
+	}
+	t.Cleanup(func() {
+		Queries, webhookClient = prevQueries, prevClient
+	})
+	return rec
+}
+
+func testDelivery(url string) db.WebhookDelivery {
+	return db.WebhookDelivery{
+		ID:      42,
+		Event:   "image.completed",
+		Url:     url,
+		Payload: []byte(`{"event":"image.completed","image_id":7}`),
+		Status:  "pending",
+	}
+}
+
+func TestAttemptDeliverySignsRequest(t *testing.T) {
+	rec := withDeliveryStubs(t, false)
+
+	var verified bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, err := strconv.ParseInt(r.Header.Get(services.WebhookTimestampHeader), 10, 64)
+		if err != nil {
+			t.Errorf("timestamp header: %v", err)
+		}
+		verified = services.VerifyWebhook("s3cret", timestamp, body, r.Header.Get(services.WebhookSignatureHeader))
+		if got := r.Header.Get(services.WebhookEventHeader); got != "image.completed" {
+			t.Errorf("event header = %q", got)
+		}
+		if got := r.Header.Get(services.WebhookDeliveryHeader); got != "42" {
+			t.Errorf("delivery header = %q", got)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if err := attemptDelivery(context.Background(), testDelivery(srv.URL), "s3cret", false); err != nil {
+		t.Fatalf("attemptDelivery: %v", err)
+	}
+	if !verified {
+		t.Error("signature did not verify with the delivery secret")
+	}
+	if services.VerifyWebhook("other", 1, nil, services.SignWebhook("s3cret", 1, nil)) {
+		t.Error("signature verified with the wrong secret")
+	}
+
+	if len(rec.attempts) != 1 {
+		t.Fatalf("recorded %d attempts, want 1", len(rec.attempts))
+	}
+	got := rec.attempts[0]
+	if got.ID != 42 || got.Status != "delivered" || got.ResponseStatus.Int32 != http.StatusNoContent ||
+		got.LastError.Valid || !got.DeliveredAt.Valid {
+		t.Errorf("recorded %+v", got)
+	}
+}
+
+func TestAttemptDeliveryRetriesNon2xx(t *testing.T) {
+	tests := []struct {
+		name   string
+		final  bool
+		status string
+	}{
+		{"retry left", false, "pending"},
+		{"final attempt", true, "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := withDeliveryStubs(t, false)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer srv.Close()
+
+			if err := attemptDelivery(context.Background(), testDelivery(srv.URL), "s3cret", tt.final); err == nil {
+				t.Fatal("attemptDelivery succeeded on a 503, want an error so asynq retries")
+			}
+			if len(rec.attempts) != 1 {
+				t.Fatalf("recorded %d attempts, want 1", len(rec.attempts))
+			}
+			got := rec.attempts[0]
+			if got.Status != tt.status || got.ResponseStatus.Int32 != http.StatusServiceUnavailable ||
+				!got.LastError.Valid || got.DeliveredAt.Valid {
+				t.Errorf("recorded %+v", got)
+			}
+		})
+	}
+}
+
+func TestAttemptDeliveryDoesNotFollowRedirects(t *testing.T) {
+	rec := withDeliveryStubs(t, false)
+
+	followed := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+	}))
+	defer target.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	if err := attemptDelivery(context.Background(), testDelivery(srv.URL), "s3cret", false); err == nil {
+		t.Fatal("attemptDelivery succeeded on a redirect")
+	}
+	if followed {
+		t.Error("the redirect was followed")
+	}
+	if got := rec.attempts[0]; got.Status != "pending" || got.ResponseStatus.Int32 != http.StatusFound {
+		t.Errorf("recorded %+v", got)
+	}
+}
+
+func TestAttemptDeliveryRefusesLoopback(t *testing.T) {
+	rec := withDeliveryStubs(t, true)
+
+	reached := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer srv.Close()
+
+	err := attemptDelivery(context.Background(), testDelivery(srv.URL), "s3cret", true)
+	if !errors.Is(err, services.ErrNonPublicWebhookHost) {
+		t.Fatalf("attemptDelivery = %v, want ErrNonPublicWebhookHost", err)
+	}
+	if reached {
+		t.Error("the loopback server was reached")
+	}
+	if got := rec.attempts[0]; got.Status != "failed" || got.ResponseStatus.Valid || !got.LastError.Valid {
+		t.Errorf("recorded %+v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"imagepp/internal/db"
+	"imagepp/internal/jobs"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// webhookTarget is an endpoint an event is delivered to
+type webhookTarget struct {
+	source    string
+	webhookID pgtype.Int4
+	url       string
+}
+
+// imageDeliveries creates the deliveries of an image event to the image's
+// callback and to every webhook of its owner. Call it in the transaction
+// that records the status the event reports, so the event can't be lost
+// between the two; dispatch the returned entries after commit.
+func imageDeliveries(ctx context.Context, qtx *db.Queries, imageID int32, event string) ([]db.JobOutbox, error) {
+	img, err := qtx.GetImageByID(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load image: %w", err)
+	}
+	if !img.UserID.Valid {
+		return nil, nil
+	}
+
+	payload, err := imageEventPayload(ctx, img, event)
+	if err != nil {
+		return nil, err
+	}
+	return createDeliveries(ctx, qtx, img.UserID.Int32, img.CallbackUrl, event, payload, db.CreateWebhookDeliveryParams{
+		ImageID: pgtype.Int4{Int32: img.ID, Valid: true},
+	})
+}
+
+// createDeliveries creates a delivery of an event for the callback, if any,
+// and for every webhook of the user, each with the outbox entry of its
+// task. subject sets what the event is about (ImageID or BatchID).
+func createDeliveries(ctx context.Context, qtx *db.Queries, userID int32, callbackURL pgtype.Text, event string, payload []byte, subject db.CreateWebhookDeliveryParams) ([]db.JobOutbox, error) {
+	var targets []webhookTarget
+	if callbackURL.Valid {
+		targets = append(targets, webhookTarget{source: jobs.WebhookSourceCallback, url: callbackURL.String})
+	}
+	webhooks, err := qtx.ListWebhooksByUserID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	for _, wh := range webhooks {
+		targets = append(targets, webhookTarget{
+			source:    jobs.WebhookSourceWebhook,
+			webhookID: pgtype.Int4{Int32: wh.ID, Valid: true},
+			url:       wh.Url,
+		})
+	}
+
+	var entries []db.JobOutbox
+	for _, target := range targets {
+		delivery, err := qtx.CreateWebhookDelivery(ctx, db.CreateWebhookDeliveryParams{
+			UserID:    userID,
+			ImageID:   subject.ImageID,
+			BatchID:   subject.BatchID,
+			Source:    target.source,
+			WebhookID: target.webhookID,
+			Event:     event,
+			Url:       target.url,
+			Payload:   payload,
+			CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create delivery: %w", err)
+		}
+		entry, err := jobs.CreateWebhookOutboxEntry(ctx, qtx, delivery.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create outbox entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// dispatchEntries enqueues committed outbox entries right away. Entries
+// that can't be enqueued go out with the outbox relay.
+func dispatchEntries(ctx context.Context, entries []db.JobOutbox) {
+	for _, entry := range entries {
+		_ = jobs.DispatchOutboxEntry(ctx, Queries, Scheduler, entry)
+	}
+}
+
+// imageEventPayload builds the body of an image event, completed images
+// list their outputs
+func imageEventPayload(ctx context.Context, img db.Image, event string) ([]byte, error) {
+	body := jobs.WebhookEvent{
+		Event:         event,
+		OccurredAt:    time.Now().UTC(),
+		ImageID:       int64(img.ID),
+		BucketName:    img.BucketName,
+		ImageKey:      img.ImageKey,
+		Status:        img.Status.String,
+		FailureReason: img.FailureReason.String,
+	}
+	if event == jobs.EventImageCompleted {
+		var err error
+		body.Outputs, err = resultOutputs(ctx, img.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event: %w", err)
+	}
+	return payload, nil
+}
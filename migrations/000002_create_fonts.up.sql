@@ -0,0 +1,11 @@
+-- Custom fonts uploaded to storage and registered by name
+CREATE TABLE fonts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),  -- owner, the only one who can replace or delete it
+    name VARCHAR(100) UNIQUE NOT NULL,
+    bucket_name VARCHAR(255) NOT NULL,
+    font_key VARCHAR(500) NOT NULL,  -- S3/minio key of the TTF/OTF file
+    etag VARCHAR(255) NOT NULL,      -- entity tag of the file when registered, workers reload the font when it changes
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
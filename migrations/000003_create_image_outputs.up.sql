@@ -0,0 +1,14 @@
+-- One row per output variant produced for an image
+CREATE TABLE image_outputs (
+    id SERIAL PRIMARY KEY,
+    image_id INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    variant VARCHAR(100) NOT NULL,
+    bucket_name VARCHAR(255) NOT NULL,
+    output_key VARCHAR(1024) NOT NULL,
+    format VARCHAR(20) NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (image_id, variant)
+);
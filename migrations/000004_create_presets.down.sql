@@ -0,0 +1,6 @@
+ALTER TABLE images
+    DROP COLUMN IF EXISTS preset_version,
+    DROP COLUMN IF EXISTS preset_id;
+DROP TABLE IF EXISTS preset_versions;
+DROP INDEX IF EXISTS idx_presets_user_id_name;
+DROP TABLE IF EXISTS presets;
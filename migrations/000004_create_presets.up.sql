@@ -0,0 +1,27 @@
+-- Named operation pipelines owned by a user
+CREATE TABLE presets (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    version INTEGER NOT NULL DEFAULT 1,
+    operations JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP  -- soft delete, images keep pointing at the versions they used
+);
+
+-- Names are unique per owner among live presets
+CREATE UNIQUE INDEX idx_presets_user_id_name ON presets(user_id, name) WHERE deleted_at IS NULL;
+
+-- Every version a preset went through, so jobs can be traced to exact operations
+CREATE TABLE preset_versions (
+    preset_id INTEGER NOT NULL REFERENCES presets(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    operations JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (preset_id, version)
+);
+
+ALTER TABLE images
+    ADD COLUMN preset_id INTEGER REFERENCES presets(id) ON DELETE SET NULL,
+    ADD COLUMN preset_version INTEGER;
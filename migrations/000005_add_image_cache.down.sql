@@ -0,0 +1,7 @@
+ALTER TABLE image_outputs
+    DROP COLUMN IF EXISTS content_hash;
+DROP INDEX IF EXISTS idx_images_cache_key;
+ALTER TABLE images
+    DROP COLUMN IF EXISTS cached_from_image_id,
+    DROP COLUMN IF EXISTS cache_hit,
+    DROP COLUMN IF EXISTS cache_key;
@@ -0,0 +1,12 @@
+-- Content-addressed result caching: jobs with the same source content and
+-- operations reuse the outputs of an earlier completed image of the same user
+ALTER TABLE images
+    ADD COLUMN cache_key VARCHAR(64),
+    ADD COLUMN cache_hit BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN cached_from_image_id INTEGER REFERENCES images(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_images_cache_key ON images(user_id, cache_key) WHERE status = 'completed';
+
+-- Needed to render {hash} key templates for reused outputs without downloading them
+ALTER TABLE image_outputs
+    ADD COLUMN content_hash VARCHAR(64) NOT NULL DEFAULT '';
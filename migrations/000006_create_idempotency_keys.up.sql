@@ -0,0 +1,14 @@
+-- Responses to requests sent with an Idempotency-Key header, replayed when
+-- a client retries the same request
+CREATE TABLE idempotency_keys (
+    scope VARCHAR(255) NOT NULL,     -- method and path the key was used on
+    key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    status_code INTEGER,             -- NULL while the first request is in flight
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_job_outbox_pending;
+DROP TABLE IF EXISTS job_outbox;
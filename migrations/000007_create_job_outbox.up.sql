@@ -0,0 +1,16 @@
+-- Tasks written in the same transaction as the rows they belong to and
+-- relayed to the queue afterwards, so a Redis outage can't strand a row
+CREATE TABLE job_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    task_type VARCHAR(100) NOT NULL,
+    task_id VARCHAR(255) NOT NULL UNIQUE,  -- asynq task ID, dedupes enqueues of the same entry
+    queue VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    dispatched_at TIMESTAMP
+);
+
+CREATE INDEX idx_job_outbox_pending ON job_outbox(next_attempt_at) WHERE dispatched_at IS NULL;
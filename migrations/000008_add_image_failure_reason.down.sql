@@ -0,0 +1,3 @@
+ALTER TABLE images
+    DROP COLUMN IF EXISTS reap_count,
+    DROP COLUMN IF EXISTS failure_reason;
@@ -0,0 +1,3 @@
+ALTER TABLE images
+    ADD COLUMN failure_reason TEXT,
+    ADD COLUMN reap_count INTEGER NOT NULL DEFAULT 0;  -- times the reaper re-enqueued a lost task
@@ -0,0 +1,3 @@
+-- Set by the cancel endpoint, checked by the worker before and during processing
+ALTER TABLE images
+    ADD COLUMN cancel_requested BOOLEAN NOT NULL DEFAULT FALSE;
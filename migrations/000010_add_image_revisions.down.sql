@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_images_parent_image_id;
+ALTER TABLE images
+    DROP COLUMN IF EXISTS revision,
+    DROP COLUMN IF EXISTS parent_image_id,
+    DROP COLUMN IF EXISTS attempt,
+    DROP COLUMN IF EXISTS job_payload;
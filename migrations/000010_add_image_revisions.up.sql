@@ -0,0 +1,9 @@
+-- The job payload is kept on the image so it can be retried after the
+-- task and its outbox entry are gone
+ALTER TABLE images
+    ADD COLUMN job_payload JSONB,
+    ADD COLUMN attempt INTEGER NOT NULL DEFAULT 1,  -- bumped by manual retries, part of the task ID
+    ADD COLUMN parent_image_id INTEGER REFERENCES images(id) ON DELETE SET NULL,
+    ADD COLUMN revision INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX idx_images_parent_image_id ON images(parent_image_id);
@@ -0,0 +1,4 @@
+ALTER TABLE images
+    DROP COLUMN IF EXISTS pipeline_version,
+    DROP COLUMN IF EXISTS outputs,
+    DROP COLUMN IF EXISTS operations;
@@ -0,0 +1,7 @@
+-- The submitted operations are kept on the image for audits and analytics,
+-- the task payload is gone once the job completes. They are derived from
+-- the stored job so the two can't drift apart.
+ALTER TABLE images
+    ADD COLUMN operations JSONB GENERATED ALWAYS AS (job_payload->'operations') STORED,
+    ADD COLUMN outputs JSONB GENERATED ALWAYS AS (job_payload->'outputs') STORED,
+    ADD COLUMN pipeline_version INTEGER;
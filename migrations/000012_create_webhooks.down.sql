@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+ALTER TABLE images
+    DROP COLUMN IF EXISTS callback_secret,
+    DROP COLUMN IF EXISTS callback_url;
@@ -0,0 +1,37 @@
+-- Per-request callbacks, signed with a secret the client chose
+ALTER TABLE images
+    ADD COLUMN callback_url VARCHAR(2048),
+    ADD COLUMN callback_secret VARCHAR(256);
+
+-- Endpoints a user registered to be notified about all of their images
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(256) NOT NULL,  -- HMAC-SHA256 key for the signature header
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_webhooks_user_id ON webhooks(user_id);
+
+-- One row per event sent to one endpoint, redeliveries get a row of their own
+CREATE TABLE webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    image_id INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    source VARCHAR(20) NOT NULL,  -- 'callback' (the image's callback_url) or 'webhook'
+    webhook_id INTEGER REFERENCES webhooks(id) ON DELETE SET NULL,
+    event VARCHAR(50) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',  -- pending, delivered or failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    last_error TEXT,
+    redelivery_of BIGINT REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX idx_webhook_deliveries_user_id ON webhook_deliveries(user_id, id);
+CREATE INDEX idx_webhook_deliveries_image_id ON webhook_deliveries(image_id);
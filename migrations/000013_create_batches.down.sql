@@ -0,0 +1,10 @@
+DELETE FROM webhook_deliveries WHERE image_id IS NULL;
+ALTER TABLE webhook_deliveries
+    DROP COLUMN IF EXISTS batch_id,
+    ALTER COLUMN image_id SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_images_batch_id_status;
+ALTER TABLE images
+    DROP COLUMN IF EXISTS batch_id;
+
+DROP TABLE IF EXISTS batches;
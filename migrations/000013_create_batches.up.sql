@@ -0,0 +1,28 @@
+-- Many source keys submitted with one pipeline. Items are images with a
+-- batch_id, released to the queue a few at a time.
+CREATE TABLE batches (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(50) NOT NULL DEFAULT 'processing',  -- processing or completed
+    total_items INTEGER NOT NULL,
+    max_in_flight INTEGER NOT NULL,  -- items pending or processing at once
+    callback_url VARCHAR(2048),      -- notified once every item is finished
+    callback_secret VARCHAR(256),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX idx_batches_user_id ON batches(user_id);
+CREATE INDEX idx_batches_processing ON batches(id) WHERE status = 'processing';
+
+-- Batch items wait in status 'queued' until the batch releases them
+ALTER TABLE images
+    ADD COLUMN batch_id INTEGER REFERENCES batches(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_images_batch_id_status ON images(batch_id, status) WHERE batch_id IS NOT NULL;
+
+-- Batch events are delivered like image events
+ALTER TABLE webhook_deliveries
+    ALTER COLUMN image_id DROP NOT NULL,
+    ADD COLUMN batch_id INTEGER REFERENCES batches(id) ON DELETE CASCADE;
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_batches_unfinished;
+CREATE INDEX idx_batches_processing ON batches(id) WHERE status = 'processing';
+
+UPDATE batches SET status = 'processing' WHERE status = 'listing';
+
+ALTER TABLE batches
+    DROP COLUMN IF EXISTS listing_error,
+    DROP COLUMN IF EXISTS truncated,
+    DROP COLUMN IF EXISTS skipped_items,
+    DROP COLUMN IF EXISTS list_after,
+    DROP COLUMN IF EXISTS source_prefix;
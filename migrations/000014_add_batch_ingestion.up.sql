@@ -0,0 +1,11 @@
+-- Batches can list their items from a bucket prefix. The batch stays in
+-- status 'listing' while the coordinator task pages through the prefix.
+ALTER TABLE batches
+    ADD COLUMN source_prefix VARCHAR(1024),
+    ADD COLUMN list_after VARCHAR(1024),
+    ADD COLUMN skipped_items INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN truncated BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN listing_error TEXT;
+
+DROP INDEX IF EXISTS idx_batches_processing;
+CREATE INDEX idx_batches_unfinished ON batches(id) WHERE status IN ('listing', 'processing');
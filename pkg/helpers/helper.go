@@ -24,6 +24,37 @@ type StatusResponse struct {
 	Status     string    `json:"status"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
+
+	Preset        string `json:"preset,omitempty"`
+	PresetVersion int32  `json:"preset_version,omitempty"`
+
+	ParentImageID int64 `json:"parent_image_id,omitempty"`
+	Revision      int32 `json:"revision,omitempty"`
+	Attempt       int32 `json:"attempt,omitempty"`
+
+	CacheHit          bool  `json:"cache_hit,omitempty"`
+	CachedFromImageID int64 `json:"cached_from_image_id,omitempty"`
+
+	Operations      json.RawMessage `json:"operations,omitempty"`
+	Outputs         json.RawMessage `json:"outputs,omitempty"`
+	PipelineVersion int32           `json:"pipeline_version,omitempty"`
+	FailureReason   string          `json:"failure_reason,omitempty"`
+
+	BatchID int64 `json:"batch_id,omitempty"`
+
+	// Results are the outputs written so far, Outputs the requested ones
+	Results []OutputResult `json:"results,omitempty"`
+}
+
+// OutputResult describes one output written for an image
+type OutputResult struct {
+	Variant    string `json:"variant"`
+	BucketName string `json:"bucket_name"`
+	Key        string `json:"key"`
+	Format     string `json:"format"`
+	Width      int32  `json:"width"`
+	Height     int32  `json:"height"`
+	SizeBytes  int64  `json:"size_bytes"`
 }
 
 // Helper functions
@@ -0,0 +1,49 @@
+-- name: CreateBatch :one
+INSERT INTO batches (user_id, status, total_items, max_in_flight, callback_url, callback_secret, created_at, updated_at, source_prefix)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+RETURNING id, user_id, status, total_items, max_in_flight, callback_url, callback_secret, created_at, updated_at, completed_at, source_prefix, list_after, skipped_items, truncated, listing_error;
+
+-- name: GetBatchByID :one
+SELECT id, user_id, status, total_items, max_in_flight, callback_url, callback_secret, created_at, updated_at, completed_at, source_prefix, list_after, skipped_items, truncated, listing_error
+FROM batches
+WHERE id = $1;
+
+-- name: GetBatchByOwner :one
+SELECT b.id, b.user_id, b.status, b.total_items, b.max_in_flight, b.callback_url, b.callback_secret, b.created_at, b.updated_at, b.completed_at, b.source_prefix, b.list_after, b.skipped_items, b.truncated, b.listing_error
+FROM batches b
+JOIN users u ON u.id = b.user_id
+WHERE b.id = $1 AND u.email = $2;
+
+-- name: LockBatch :one
+-- Serializes releases of a batch's items
+SELECT id, user_id, status, total_items, max_in_flight, callback_url, callback_secret, created_at, updated_at, completed_at, source_prefix, list_after, skipped_items, truncated, listing_error
+FROM batches
+WHERE id = $1
+FOR UPDATE;
+
+-- name: ListUnfinishedBatches :many
+SELECT id
+FROM batches
+WHERE status IN ('listing', 'processing')
+ORDER BY id
+LIMIT $1;
+
+-- name: CompleteBatch :exec
+UPDATE batches
+SET status = 'completed', completed_at = $2, updated_at = $2
+WHERE id = $1;
+
+-- name: RecordBatchListing :exec
+-- Saves a listed page: its items were created in the same transaction
+UPDATE batches
+SET list_after = @list_after,
+    total_items = total_items + @added_items::int,
+    skipped_items = skipped_items + @skipped_items::int,
+    updated_at = @updated_at
+WHERE id = @id;
+
+-- name: FinishBatchListing :exec
+-- Items are no longer added, the batch completes once they are finished
+UPDATE batches
+SET status = 'processing', truncated = @truncated, listing_error = @listing_error, updated_at = @updated_at
+WHERE id = @id AND status = 'listing';
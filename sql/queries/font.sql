@@ -0,0 +1,26 @@
+-- name: UpsertFont :one
+-- Registering a name again replaces the file, only for the font's owner
+INSERT INTO fonts (user_id, name, bucket_name, font_key, etag, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (name) DO UPDATE
+SET bucket_name = EXCLUDED.bucket_name,
+    font_key = EXCLUDED.font_key,
+    etag = EXCLUDED.etag,
+    updated_at = EXCLUDED.updated_at
+WHERE fonts.user_id = EXCLUDED.user_id
+RETURNING id, user_id, name, bucket_name, font_key, etag, created_at, updated_at;
+
+-- name: GetFontByName :one
+SELECT id, user_id, name, bucket_name, font_key, etag, created_at, updated_at
+FROM fonts
+WHERE name = $1;
+
+-- name: ListFonts :many
+SELECT id, user_id, name, bucket_name, font_key, etag, created_at, updated_at
+FROM fonts
+ORDER BY name;
+
+-- name: DeleteFont :execrows
+DELETE FROM fonts f
+USING users u
+WHERE f.name = $1 AND u.id = f.user_id AND u.email = $2;
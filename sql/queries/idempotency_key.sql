@@ -0,0 +1,32 @@
+-- name: ClaimIdempotencyKey :execrows
+-- Claims a key for a new request, taking over rows that have expired and
+-- claims whose request never finished (e.g. the process crashed)
+INSERT INTO idempotency_keys (scope, key, request_hash, created_at, expires_at)
+VALUES (@scope, @key, @request_hash, @created_at, @expires_at)
+ON CONFLICT (scope, key) DO UPDATE
+SET request_hash = EXCLUDED.request_hash,
+    status_code = NULL,
+    response_body = NULL,
+    created_at = EXCLUDED.created_at,
+    expires_at = EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at < EXCLUDED.created_at
+   OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < @claimed_before);
+
+-- name: GetIdempotencyKey :one
+SELECT scope, key, request_hash, status_code, response_body, created_at, expires_at
+FROM idempotency_keys
+WHERE scope = $1 AND key = $2;
+
+-- name: CompleteIdempotencyKey :exec
+UPDATE idempotency_keys
+SET status_code = $3, response_body = $4
+WHERE scope = $1 AND key = $2;
+
+-- name: ReleaseIdempotencyKey :exec
+-- Frees a key whose request failed so the client can retry with it
+DELETE FROM idempotency_keys
+WHERE scope = $1 AND key = $2 AND status_code IS NULL;
+
+-- name: DeleteExpiredIdempotencyKeys :execrows
+DELETE FROM idempotency_keys
+WHERE expires_at < $1;
@@ -9,22 +9,171 @@ VALUES ($1, $2)
 RETURNING id, email, created_at;
 
 -- name: CreateImage :one
-INSERT INTO images (user_id, bucket_name, image_key, status, created_at, updated_at)
-VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING id, user_id, bucket_name, image_key, status, created_at, updated_at;
+INSERT INTO images (user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, parent_image_id, revision, pipeline_version, callback_url, callback_secret, batch_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+RETURNING id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id;
 
 -- name: GetImageByID :one
-SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at
+SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id
 FROM images
 WHERE id = $1;
 
--- name: UpdateImageStatus :exec
+-- name: UpdateImageStatus :execrows
+-- Only unfinished images move on, a worker finishing late doesn't undo a
+-- cancellation or a failure
 UPDATE images 
-SET status = $1, updated_at = $2
-WHERE id = $3;
+SET status = $1, updated_at = $2, failure_reason = NULL
+WHERE id = $3 AND status IN ('pending', 'processing');
 
 -- name: GetImagesByUserID :many
-SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at
+SELECT id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id
 FROM images
 WHERE user_id = $1
-ORDER BY created_at DESC;
\ No newline at end of file
+ORDER BY created_at DESC;
+
+-- name: SetImageCacheKey :exec
+UPDATE images
+SET cache_key = $2, updated_at = $3
+WHERE id = $1;
+
+-- name: FindCachedImage :one
+-- Most recent completed image of the same user with the same cache key,
+-- other than the one being processed
+SELECT id
+FROM images
+WHERE cache_key = $1 AND status = 'completed' AND id <> $2 AND user_id = $3
+ORDER BY updated_at DESC
+LIMIT 1;
+
+-- name: MarkImageCacheHit :exec
+UPDATE images
+SET cache_hit = TRUE, cached_from_image_id = $2, updated_at = $3
+WHERE id = $1;
+
+-- name: FailImage :execrows
+-- Only unfinished images can fail, a late failure doesn't undo a completion
+UPDATE images
+SET status = 'failed', failure_reason = $2, updated_at = $3
+WHERE id = $1 AND status IN ('pending', 'processing');
+
+-- name: RecordAttemptFailure :execrows
+-- A failed attempt asynq will retry: the image stays in flight, only the
+-- reason is kept until the next attempt starts
+UPDATE images
+SET failure_reason = $2, updated_at = $3
+WHERE id = $1 AND status IN ('pending', 'processing');
+
+-- name: ListStuckImages :many
+SELECT id, status, reap_count, attempt, updated_at
+FROM images
+WHERE (status = 'pending' AND updated_at < @pending_before)
+   OR (status = 'processing' AND updated_at < @processing_before)
+ORDER BY id
+LIMIT @max_images;
+
+-- name: RequeueStuckImage :exec
+UPDATE images
+SET status = 'pending', reap_count = reap_count + 1, updated_at = $2
+WHERE id = $1;
+
+-- name: RequestImageCancel :one
+UPDATE images
+SET cancel_requested = TRUE, updated_at = $2
+WHERE id = $1 AND status IN ('queued', 'pending', 'processing')
+RETURNING status;
+
+-- name: CancelImage :execrows
+UPDATE images
+SET status = 'cancelled', updated_at = $2
+WHERE id = $1 AND status IN ('queued', 'pending', 'processing');
+
+-- name: SetImageJobPayload :exec
+UPDATE images
+SET job_payload = $2
+WHERE id = $1;
+
+-- name: RetryImage :one
+-- Starts a new attempt of a failed or cancelled image with its stored payload
+UPDATE images
+SET status = 'pending',
+    attempt = attempt + 1,
+    cancel_requested = FALSE,
+    failure_reason = NULL,
+    reap_count = 0,
+    cache_hit = FALSE,
+    cached_from_image_id = NULL,
+    pipeline_version = $2,
+    updated_at = $3
+WHERE id = $1 AND status IN ('failed', 'cancelled')
+RETURNING id, user_id, bucket_name, image_key, status, created_at, updated_at, preset_id, preset_version, cache_key, cache_hit, cached_from_image_id, failure_reason, reap_count, cancel_requested, job_payload, attempt, parent_image_id, revision, operations, outputs, pipeline_version, callback_url, callback_secret, batch_id;
+
+-- name: CountInFlightBatchImages :one
+SELECT COUNT(*)::int AS count
+FROM images
+WHERE batch_id = $1 AND status IN ('pending', 'processing');
+
+-- name: ReleaseQueuedBatchImages :many
+-- Moves the next queued items of a batch to pending, their tasks are
+-- created by the caller in the same transaction
+UPDATE images
+SET status = 'pending', updated_at = @updated_at
+WHERE id IN (
+    SELECT id
+    FROM images
+    WHERE batch_id = @batch_id AND status = 'queued'
+    ORDER BY id
+    LIMIT @max_images
+) AND status = 'queued'
+RETURNING id, attempt, job_payload;
+
+-- name: CountBatchImagesByStatus :many
+SELECT status, COUNT(*)::int AS count
+FROM images
+WHERE batch_id = $1
+GROUP BY status;
+
+-- name: ImageAlreadyProcessed :one
+-- Whether the user completed the object before with the same source and
+-- pipeline and has its outputs in the destination bucket
+SELECT EXISTS (
+    SELECT 1
+    FROM images
+    WHERE user_id = @user_id AND bucket_name = @bucket_name AND image_key = @image_key
+      AND cache_key = @cache_key AND status = 'completed'
+      AND EXISTS (
+          SELECT 1
+          FROM image_outputs
+          WHERE image_outputs.image_id = images.id AND image_outputs.bucket_name = @destination_bucket
+      )
+) AS processed;
+
+-- name: LockImageChain :one
+-- Locks the first image of the revision chain an image belongs to, so that
+-- revisions of one chain are numbered one at a time
+WITH RECURSIVE ancestors AS (
+    SELECT id, parent_image_id, 0 AS depth
+    FROM images
+    WHERE id = $1
+    UNION ALL
+    SELECT images.id, images.parent_image_id, ancestors.depth + 1
+    FROM images
+    JOIN ancestors ON images.id = ancestors.parent_image_id
+)
+SELECT images.id AS root_id
+FROM images
+WHERE images.id = (SELECT ancestors.id FROM ancestors ORDER BY ancestors.depth DESC LIMIT 1)
+FOR UPDATE;
+
+-- name: NextImageRevision :one
+-- One past the highest revision in the chain starting at an image
+WITH RECURSIVE chain AS (
+    SELECT id, revision
+    FROM images
+    WHERE id = $1
+    UNION ALL
+    SELECT images.id, images.revision
+    FROM images
+    JOIN chain ON images.parent_image_id = chain.id
+)
+SELECT (COALESCE(MAX(revision), 0) + 1)::integer AS revision
+FROM chain;
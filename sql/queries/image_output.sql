@@ -0,0 +1,20 @@
+-- name: UpsertImageOutput :one
+-- Retried tasks overwrite the output they already recorded
+INSERT INTO image_outputs (image_id, variant, bucket_name, output_key, format, width, height, size_bytes, created_at, content_hash)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (image_id, variant) DO UPDATE
+SET bucket_name = EXCLUDED.bucket_name,
+    output_key = EXCLUDED.output_key,
+    format = EXCLUDED.format,
+    width = EXCLUDED.width,
+    height = EXCLUDED.height,
+    size_bytes = EXCLUDED.size_bytes,
+    created_at = EXCLUDED.created_at,
+    content_hash = EXCLUDED.content_hash
+RETURNING id, image_id, variant, bucket_name, output_key, format, width, height, size_bytes, created_at, content_hash;
+
+-- name: GetImageOutputsByImageID :many
+SELECT id, image_id, variant, bucket_name, output_key, format, width, height, size_bytes, created_at, content_hash
+FROM image_outputs
+WHERE image_id = $1
+ORDER BY id;
\ No newline at end of file
@@ -0,0 +1,38 @@
+-- name: CreateOutboxEntry :one
+INSERT INTO job_outbox (task_type, task_id, queue, payload, created_at, next_attempt_at)
+VALUES ($1, $2, $3, $4, $5, $5)
+RETURNING id, task_type, task_id, queue, payload, attempts, last_error, next_attempt_at, created_at, dispatched_at;
+
+-- name: LockPendingOutboxEntries :many
+-- Relays running in several processes each take a disjoint batch
+SELECT id, task_type, task_id, queue, payload, attempts, last_error, next_attempt_at, created_at, dispatched_at
+FROM job_outbox
+WHERE dispatched_at IS NULL AND next_attempt_at <= $1
+ORDER BY id
+LIMIT $2
+FOR UPDATE SKIP LOCKED;
+
+-- name: MarkOutboxDispatched :exec
+UPDATE job_outbox
+SET dispatched_at = $2, attempts = attempts + 1, last_error = NULL
+WHERE id = $1 AND dispatched_at IS NULL;
+
+-- name: RecordOutboxFailure :exec
+UPDATE job_outbox
+SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3
+WHERE id = $1;
+
+-- name: DeleteDispatchedOutboxEntries :execrows
+DELETE FROM job_outbox
+WHERE dispatched_at < $1;
+
+-- name: GetOutboxEntryByTaskID :one
+SELECT id, task_type, task_id, queue, payload, attempts, last_error, next_attempt_at, created_at, dispatched_at
+FROM job_outbox
+WHERE task_id = $1;
+
+-- name: CancelOutboxEntry :execrows
+-- Takes an entry the relay hasn't dispatched yet out of the outbox
+UPDATE job_outbox
+SET dispatched_at = $2, last_error = 'cancelled'
+WHERE task_id = $1 AND dispatched_at IS NULL;
@@ -0,0 +1,38 @@
+-- name: CreatePreset :one
+INSERT INTO presets (user_id, name, version, operations, created_at, updated_at)
+VALUES ($1, $2, 1, $3, $4, $5)
+RETURNING id, user_id, name, version, operations, created_at, updated_at, deleted_at;
+
+-- name: CreatePresetVersion :exec
+INSERT INTO preset_versions (preset_id, version, operations, created_at)
+VALUES ($1, $2, $3, $4);
+
+-- name: GetPresetByOwner :one
+SELECT p.id, p.user_id, p.name, p.version, p.operations, p.created_at, p.updated_at, p.deleted_at
+FROM presets p
+JOIN users u ON u.id = p.user_id
+WHERE u.email = $1 AND p.name = $2 AND p.deleted_at IS NULL;
+
+-- name: ListPresetsByOwner :many
+SELECT p.id, p.user_id, p.name, p.version, p.operations, p.created_at, p.updated_at, p.deleted_at
+FROM presets p
+JOIN users u ON u.id = p.user_id
+WHERE u.email = $1 AND p.deleted_at IS NULL
+ORDER BY p.name;
+
+-- name: GetPresetVersion :one
+SELECT preset_id, version, operations, created_at
+FROM preset_versions
+WHERE preset_id = $1 AND version = $2;
+
+-- name: UpdatePresetOperations :one
+-- Every change bumps the version, earlier versions stay in preset_versions
+UPDATE presets
+SET operations = $2, version = version + 1, updated_at = $3
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING id, user_id, name, version, operations, created_at, updated_at, deleted_at;
+
+-- name: DeletePreset :exec
+UPDATE presets
+SET deleted_at = $2
+WHERE id = $1;
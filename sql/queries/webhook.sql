@@ -0,0 +1,27 @@
+-- name: CreateWebhook :one
+INSERT INTO webhooks (user_id, url, secret, created_at)
+VALUES ($1, $2, $3, $4)
+RETURNING id, user_id, url, secret, created_at;
+
+-- name: GetWebhookByID :one
+SELECT id, user_id, url, secret, created_at
+FROM webhooks
+WHERE id = $1;
+
+-- name: ListWebhooksByUserID :many
+SELECT id, user_id, url, secret, created_at
+FROM webhooks
+WHERE user_id = $1
+ORDER BY id;
+
+-- name: ListWebhooksByOwner :many
+SELECT w.id, w.user_id, w.url, w.secret, w.created_at
+FROM webhooks w
+JOIN users u ON u.id = w.user_id
+WHERE u.email = $1
+ORDER BY w.id;
+
+-- name: DeleteWebhook :execrows
+DELETE FROM webhooks w
+USING users u
+WHERE w.id = $1 AND u.id = w.user_id AND u.email = $2;
@@ -0,0 +1,34 @@
+-- name: CreateWebhookDelivery :one
+INSERT INTO webhook_deliveries (user_id, image_id, batch_id, source, webhook_id, event, url, payload, redelivery_of, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING id, user_id, image_id, source, webhook_id, event, url, payload, status, attempts, response_status, last_error, redelivery_of, created_at, delivered_at, batch_id;
+
+-- name: GetWebhookDelivery :one
+SELECT id, user_id, image_id, source, webhook_id, event, url, payload, status, attempts, response_status, last_error, redelivery_of, created_at, delivered_at, batch_id
+FROM webhook_deliveries
+WHERE id = $1;
+
+-- name: GetWebhookDeliveryByOwner :one
+SELECT d.id, d.user_id, d.image_id, d.source, d.webhook_id, d.event, d.url, d.payload, d.status, d.attempts, d.response_status, d.last_error, d.redelivery_of, d.created_at, d.delivered_at
+FROM webhook_deliveries d
+JOIN users u ON u.id = d.user_id
+WHERE d.id = $1 AND u.email = $2;
+
+-- name: ListWebhookDeliveriesByOwner :many
+-- An image_id of 0 lists the deliveries of every image
+SELECT d.id, d.user_id, d.image_id, d.source, d.webhook_id, d.event, d.url, d.payload, d.status, d.attempts, d.response_status, d.last_error, d.redelivery_of, d.created_at, d.delivered_at
+FROM webhook_deliveries d
+JOIN users u ON u.id = d.user_id
+WHERE u.email = @email AND (@image_id::int = 0 OR d.image_id = @image_id)
+ORDER BY d.id DESC
+LIMIT @max_deliveries;
+
+-- name: RecordWebhookAttempt :exec
+-- The status stays pending while asynq has retries left
+UPDATE webhook_deliveries
+SET attempts = attempts + 1,
+    status = $2,
+    response_status = $3,
+    last_error = $4,
+    delivered_at = $5
+WHERE id = $1;
@@ -13,9 +13,179 @@ CREATE TABLE images (
     image_key VARCHAR(500) NOT NULL,  -- S3/minio key or path
     status VARCHAR(50) DEFAULT 'pending',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    preset_id INTEGER,       -- preset the operations came from, if any, see fk_images_preset_id
+    preset_version INTEGER,  -- version of that preset at submission time
+    cache_key VARCHAR(64),   -- hash of the source ETag and canonical operations
+    cache_hit BOOLEAN NOT NULL DEFAULT FALSE,
+    cached_from_image_id INTEGER REFERENCES images(id) ON DELETE SET NULL,  -- image whose outputs were reused on a cache hit
+    failure_reason TEXT,
+    reap_count INTEGER NOT NULL DEFAULT 0,  -- times the reaper re-enqueued a lost task
+    cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+    job_payload JSONB,                  -- kept so the image can be retried
+    attempt INTEGER NOT NULL DEFAULT 1, -- bumped by manual retries, part of the task ID
+    parent_image_id INTEGER REFERENCES images(id) ON DELETE SET NULL,  -- image this one is a revision of
+    revision INTEGER NOT NULL DEFAULT 1,
+    -- shared operations as submitted after preset resolution, and the named
+    -- outputs with their operations; read from the stored job
+    operations JSONB GENERATED ALWAYS AS (job_payload->'operations') STORED,
+    outputs JSONB GENERATED ALWAYS AS (job_payload->'outputs') STORED,
+    pipeline_version INTEGER,   -- worker pipeline version the operations were submitted for
+    callback_url VARCHAR(2048),    -- notified when the image completes or fails
+    callback_secret VARCHAR(256),  -- HMAC-SHA256 key for callback signatures
+    batch_id INTEGER               -- batch the image is an item of, see fk_images_batch_id
 );
 
 -- Index for faster lookups
 CREATE INDEX idx_images_user_id ON images(user_id);
 CREATE INDEX idx_images_status ON images(status);
+CREATE INDEX idx_images_parent_image_id ON images(parent_image_id);
+CREATE INDEX idx_images_cache_key ON images(user_id, cache_key) WHERE status = 'completed';
+CREATE INDEX idx_images_batch_id_status ON images(batch_id, status) WHERE batch_id IS NOT NULL;
+
+-- Custom fonts uploaded to storage and registered by name
+CREATE TABLE fonts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),  -- owner, the only one who can replace or delete it
+    name VARCHAR(100) UNIQUE NOT NULL,
+    bucket_name VARCHAR(255) NOT NULL,
+    font_key VARCHAR(500) NOT NULL,  -- S3/minio key of the TTF/OTF file
+    etag VARCHAR(255) NOT NULL,      -- entity tag of the file when registered, workers reload the font when it changes
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One row per output variant produced for an image
+CREATE TABLE image_outputs (
+    id SERIAL PRIMARY KEY,
+    image_id INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    variant VARCHAR(100) NOT NULL,
+    bucket_name VARCHAR(255) NOT NULL,
+    output_key VARCHAR(1024) NOT NULL,
+    format VARCHAR(20) NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    content_hash VARCHAR(64) NOT NULL DEFAULT '',
+    UNIQUE (image_id, variant)
+);
+
+-- Named operation pipelines owned by a user
+CREATE TABLE presets (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    version INTEGER NOT NULL DEFAULT 1,
+    operations JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP  -- soft delete, images keep pointing at the versions they used
+);
+
+-- Names are unique per owner among live presets
+CREATE UNIQUE INDEX idx_presets_user_id_name ON presets(user_id, name) WHERE deleted_at IS NULL;
+
+ALTER TABLE images
+    ADD CONSTRAINT fk_images_preset_id FOREIGN KEY (preset_id) REFERENCES presets(id) ON DELETE SET NULL;
+
+-- Every version a preset went through, so jobs can be traced to exact operations
+CREATE TABLE preset_versions (
+    preset_id INTEGER NOT NULL REFERENCES presets(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    operations JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (preset_id, version)
+);
+
+-- Responses to requests sent with an Idempotency-Key header, replayed when
+-- a client retries the same request
+CREATE TABLE idempotency_keys (
+    scope VARCHAR(255) NOT NULL,     -- method, path and caller the key was used by
+    key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,
+    status_code INTEGER,             -- NULL while the first request is in flight
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+-- Tasks written in the same transaction as the rows they belong to and
+-- relayed to the queue afterwards, so a Redis outage can't strand a row
+CREATE TABLE job_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    task_type VARCHAR(100) NOT NULL,
+    task_id VARCHAR(255) NOT NULL UNIQUE,  -- asynq task ID, dedupes enqueues of the same entry
+    queue VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    dispatched_at TIMESTAMP
+);
+
+CREATE INDEX idx_job_outbox_pending ON job_outbox(next_attempt_at) WHERE dispatched_at IS NULL;
+
+-- Many source keys submitted with one pipeline. Items are images with a
+-- batch_id, released to the queue a few at a time.
+CREATE TABLE batches (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(50) NOT NULL DEFAULT 'processing',  -- listing, processing or completed
+    total_items INTEGER NOT NULL,
+    max_in_flight INTEGER NOT NULL,  -- items pending or processing at once
+    callback_url VARCHAR(2048),      -- notified once every item is finished
+    callback_secret VARCHAR(256),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP,
+    source_prefix VARCHAR(1024),     -- items are listed from this prefix of the bucket
+    list_after VARCHAR(1024),        -- last key listed, listing resumes after it
+    skipped_items INTEGER NOT NULL DEFAULT 0,  -- listed objects that were already processed
+    truncated BOOLEAN NOT NULL DEFAULT FALSE,  -- listing stopped at max_objects
+    listing_error TEXT
+);
+
+CREATE INDEX idx_batches_user_id ON batches(user_id);
+CREATE INDEX idx_batches_unfinished ON batches(id) WHERE status IN ('listing', 'processing');
+
+ALTER TABLE images
+    ADD CONSTRAINT fk_images_batch_id FOREIGN KEY (batch_id) REFERENCES batches(id) ON DELETE SET NULL;
+
+-- Endpoints a user registered to be notified about all of their images
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(256) NOT NULL,  -- HMAC-SHA256 key for the signature header
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_webhooks_user_id ON webhooks(user_id);
+
+-- One row per event sent to one endpoint, redeliveries get a row of their own
+CREATE TABLE webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    image_id INTEGER REFERENCES images(id) ON DELETE CASCADE,  -- NULL for batch events
+    source VARCHAR(20) NOT NULL,  -- 'callback' (the image's or batch's callback_url) or 'webhook'
+    webhook_id INTEGER REFERENCES webhooks(id) ON DELETE SET NULL,
+    event VARCHAR(50) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',  -- pending, delivered or failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    last_error TEXT,
+    redelivery_of BIGINT REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP,
+    batch_id INTEGER REFERENCES batches(id) ON DELETE CASCADE  -- set for batch events
+);
+
+CREATE INDEX idx_webhook_deliveries_user_id ON webhook_deliveries(user_id, id);
+CREATE INDEX idx_webhook_deliveries_image_id ON webhook_deliveries(image_id);